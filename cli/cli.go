@@ -0,0 +1,740 @@
+// Package cli is the command line client built into the guardian binary, it
+// talks to a running guardian over its API
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gladiusio/gladius-common/pkg/utils"
+	"github.com/gladiusio/gladius-guardian/config"
+	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// command is a client subcommand
+type command struct {
+	usage string
+	run   func(o *options, args []string) error
+}
+
+var commands = map[string]*command{
+	"status":      {usage: "status [service]", run: statusCommand},
+	"start":       {usage: "start <service> [-env KEY=VALUE]... [-async]", run: actionCommand("start")},
+	"stop":        {usage: "stop <service> [-async]", run: actionCommand("stop")},
+	"restart":     {usage: "restart <service> [-env KEY=VALUE]... [-async]", run: actionCommand("restart")},
+	"logs":        {usage: "logs [-f] [-n lines] <service>", run: logsCommand},
+	"events":      {usage: "events [-since id]", run: eventsCommand},
+	"top":         {usage: "top [-interval 2s]", run: topCommand},
+	"version":     {usage: "version", run: versionCommand},
+	"hash-token":  {usage: "hash-token <token>", run: hashTokenCommand},
+	"config":      {usage: "config validate", run: configCommand},
+	"secret":      {usage: "secret set <name> | secret list | secret rm <name>", run: secretCommand},
+	"job":         {usage: "job list | job run <job> [-async] | job runs <job>", run: jobCommand},
+	"maintenance": {usage: "maintenance status | maintenance on [service] [-for 2h] [-reason text] | maintenance off [service]", run: maintenanceCommand},
+}
+
+// IsCommand returns true if the arguments are a client command. A bare start
+// or stop is left for the service manager
+func IsCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		return true
+	}
+	if _, ok := commands[args[0]]; !ok {
+		return false
+	}
+	if args[0] == "start" || args[0] == "stop" {
+		return len(args) > 1
+	}
+	return true
+}
+
+// Run runs the client command in args and returns the exit code
+func Run(version string, args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(os.Stdout)
+		return 0
+	}
+
+	o := &options{version: version, out: os.Stdout}
+	fs := o.flagSet(args[0])
+	positional, err := parseInterspersed(fs, args[1:])
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+
+	if err := cmd.run(o, positional); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		if _, ok := err.(usageError); ok {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: gladius-guardian <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Service manager commands:")
+	fmt.Fprintln(w, "  install, uninstall, start, stop")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Client commands, run any with -h for its flags:")
+	for _, name := range []string{"status", "start", "stop", "restart", "logs", "events", "top", "version", "hash-token", "config", "secret", "job", "maintenance"} {
+		fmt.Fprintln(w, "  "+commands[name].usage)
+	}
+}
+
+// usageError is returned for bad arguments
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// options are the flags every client command has, plus the ones only some
+// of them use
+type options struct {
+	version string
+	out     io.Writer
+
+	addr   string
+	token  string
+	caFile string
+	json   bool
+
+	env      stringList
+	async    bool
+	follow   bool
+	lines    int
+	since    uint64
+	interval time.Duration
+	duration time.Duration
+	reason   string
+}
+
+func (o *options) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gladius-guardian "+commands[name].usage)
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&o.addr, "addr", os.Getenv("GUARDIAN_ADDR"), "Guardian API address, http(s)://host:port or unix:///path (default from the guardian config, or $GUARDIAN_ADDR)")
+	fs.StringVar(&o.token, "token", os.Getenv("GUARDIAN_TOKEN"), "API token (default $GUARDIAN_TOKEN)")
+	fs.StringVar(&o.caFile, "ca", "", "CA certificate to trust for https")
+	fs.BoolVar(&o.json, "json", false, "Print JSON instead of tables")
+
+	switch name {
+	case "start", "restart":
+		fs.Var(&o.env, "env", "KEY=VALUE added to the default environment, can be repeated")
+		fs.BoolVar(&o.async, "async", false, "Don't wait, print the operation instead")
+	case "stop", "job":
+		fs.BoolVar(&o.async, "async", false, "Don't wait, print the operation instead")
+	case "logs":
+		fs.BoolVar(&o.follow, "f", false, "Keep printing new lines")
+		fs.IntVar(&o.lines, "n", 50, "Recent lines to print, 0 for all of them")
+	case "events":
+		fs.Uint64Var(&o.since, "since", 0, "Also print the remembered events after this event ID")
+	case "top":
+		fs.DurationVar(&o.interval, "interval", 2*time.Second, "How often to refresh")
+	case "maintenance":
+		fs.DurationVar(&o.duration, "for", 0, "End it by itself after this long, 0 to keep it on until it's turned off")
+		fs.StringVar(&o.reason, "reason", "", "Why, shown in the status and events")
+	}
+	return fs
+}
+
+// client connects to the address from the flags, or works it out from the
+// guardian's own config
+func (o *options) client() (*Client, error) {
+	addr := o.addr
+	if addr == "" {
+		addr = addrFromConfig()
+	}
+	return NewClient(addr, o.token, o.caFile)
+}
+
+// addrFromConfig prefers the unix socket, then the first TCP listener
+func addrFromConfig() string {
+	if base, err := gladiusBase(); err == nil {
+		log.SetLevel(log.ErrorLevel) // A missing config file isn't worth a warning here
+		config.SetupConfig(base)
+	}
+
+	if socket := viper.GetString("API.UnixSocket"); socket != "" {
+		return "unix://" + socket
+	}
+
+	scheme := "http"
+	if viper.GetString("API.TLS.CertFile") != "" {
+		scheme = "https"
+	}
+
+	hostPort := "127.0.0.1:" + strconv.Itoa(viper.GetInt("Ports.Guardian"))
+	if listen := viper.GetStringSlice("API.Listen"); len(listen) > 0 {
+		host, port, err := net.SplitHostPort(listen[0])
+		if err == nil {
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = "127.0.0.1"
+			}
+			hostPort = net.JoinHostPort(host, port)
+		}
+	}
+	return scheme + "://" + hostPort
+}
+
+// gladiusBase is utils.GetGladiusBase without the first argument, which it
+// would take as the base but is the client command here
+func gladiusBase() (string, error) {
+	args := os.Args
+	os.Args = args[:1]
+	defer func() { os.Args = args }()
+	return utils.GetGladiusBase()
+}
+
+// parseInterspersed parses flags that come before or after the positional
+// arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// printJSON prints v indented
+func (o *options) printJSON(v interface{}) error {
+	enc := json.NewEncoder(o.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// service is the status of a service as the API returns it
+type service struct {
+	Name          string                `json:"name"`
+	Running       bool                  `json:"running"`
+	PID           int                   `json:"pid"`
+	Env           []string              `json:"environment_vars"`
+	Args          []string              `json:"args,omitempty"`
+	Location      string                `json:"executable_location"`
+	StartedAt     *time.Time            `json:"started_at,omitempty"`
+	UptimeSeconds int64                 `json:"uptime_seconds,omitempty"`
+	Restarts      int                   `json:"restarts"`
+	LastExit      string                `json:"last_exit,omitempty"`
+	CPUSeconds    float64               `json:"cpu_seconds,omitempty"`
+	MemoryRSS     uint64                `json:"memory_rss_bytes,omitempty"`
+	Maintenance   *guardian.Maintenance `json:"maintenance,omitempty"`
+}
+
+func statusCommand(o *options, args []string) error {
+	if len(args) > 1 {
+		return usageError("status takes at most one service")
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	services := make([]*service, 0)
+	if len(args) == 1 {
+		s := &service{}
+		if err := c.Do("GET", "/v2/services/"+url.PathEscape(args[0]), nil, s); err != nil {
+			return err
+		}
+		services = append(services, s)
+	} else if err := c.Do("GET", "/v2/services", nil, &services); err != nil {
+		return err
+	}
+
+	if o.json {
+		return o.printJSON(services)
+	}
+	printServices(o.out, services)
+	return nil
+}
+
+func printServices(out io.Writer, services []*service) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tPID\tCOMMAND")
+	for _, s := range services {
+		state, pid, cmd := "stopped", "-", "-"
+		if s.Running {
+			state, pid = "running", strconv.Itoa(s.PID)
+			cmd = strings.Join(append([]string{s.Location}, s.Args...), " ")
+		}
+		if s.Maintenance != nil {
+			state += " (maintenance)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, state, pid, cmd)
+	}
+	tw.Flush()
+}
+
+func actionCommand(action string) func(o *options, args []string) error {
+	return func(o *options, args []string) error {
+		if len(args) != 1 {
+			return usageError(action + " takes exactly one service")
+		}
+		c, err := o.client()
+		if err != nil {
+			return err
+		}
+
+		path := "/v2/services/" + url.PathEscape(args[0]) + "/" + action
+		var body interface{}
+		if len(o.env) > 0 {
+			body = &guardian.StartRequest{EnvironmentVars: o.env}
+		}
+
+		if o.async {
+			op := &guardian.Operation{}
+			if err := c.Do("POST", path+"?async=true", body, op); err != nil {
+				return err
+			}
+			if o.json {
+				return o.printJSON(op)
+			}
+			fmt.Fprintf(o.out, "Started %s of %s as operation %s\n", action, args[0], op.ID)
+			return nil
+		}
+
+		s := &service{}
+		if err := c.Wait("POST", path, body, s); err != nil {
+			return err
+		}
+		if o.json {
+			return o.printJSON(s)
+		}
+		printServices(o.out, []*service{s})
+		return nil
+	}
+}
+
+func logsCommand(o *options, args []string) error {
+	if len(args) != 1 {
+		return usageError("logs takes exactly one service")
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+	name := url.PathEscape(args[0])
+
+	// Connect first so no lines are lost between the two requests
+	var conn *websocket.Conn
+	if o.follow {
+		conn, err = c.WebSocket("/service/ws/logs/" + name)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+	}
+
+	path := "/v2/services/" + name + "/logs"
+	if o.lines > 0 {
+		path += "?lines=" + strconv.Itoa(o.lines)
+	}
+	lines := make([]string, 0)
+	if err := c.Do("GET", path, nil, &lines); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		o.printLine(line)
+	}
+
+	if conn == nil {
+		return nil
+	}
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("log stream closed: %s", err)
+		}
+		o.printLine(string(msg))
+	}
+}
+
+func (o *options) printLine(line string) {
+	if o.json {
+		b, _ := json.Marshal(line)
+		fmt.Fprintln(o.out, string(b))
+		return
+	}
+	fmt.Fprintln(o.out, line)
+}
+
+func eventsCommand(o *options, args []string) error {
+	if len(args) != 0 {
+		return usageError("events doesn't take arguments")
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	path := "/service/ws/events"
+	if o.since > 0 {
+		path += "?since=" + strconv.FormatUint(o.since, 10)
+	}
+	conn, err := c.WebSocket(path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("event stream closed: %s", err)
+		}
+		if o.json {
+			fmt.Fprintln(o.out, string(msg))
+			continue
+		}
+
+		e := &guardian.Event{}
+		if err := json.Unmarshal(msg, e); err != nil {
+			continue
+		}
+		service := e.Service
+		if service == "" {
+			service = "-"
+		}
+		fmt.Fprintf(o.out, "%s  #%-5d %-16s %-16s %s\n", e.Time.Local().Format(time.RFC3339), e.ID, e.Type, service, e.Message)
+	}
+}
+
+func versionCommand(o *options, args []string) error {
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	server := &struct {
+		Version string `json:"version"`
+	}{}
+	serverErr := c.Do("GET", "/version", nil, server)
+
+	if o.json {
+		return o.printJSON(map[string]string{"client": o.version, "server": server.Version})
+	}
+	fmt.Fprintln(o.out, "client", o.version)
+	if serverErr != nil {
+		return serverErr
+	}
+	fmt.Fprintln(o.out, "server", server.Version)
+	return nil
+}
+
+// hashTokenCommand prints the config entry for a new API token, it doesn't
+// need a running guardian
+func hashTokenCommand(o *options, args []string) error {
+	if len(args) != 1 {
+		return usageError("hash-token takes exactly one token")
+	}
+	fmt.Fprintln(o.out, guardian.HashToken(args[0]))
+	return nil
+}
+
+// configCommand checks the config in the Gladius base without a running
+// guardian, problems that aren't warnings make it fail
+func configCommand(o *options, args []string) error {
+	if len(args) != 1 || args[0] != "validate" {
+		return usageError("config only has the validate subcommand")
+	}
+	base, err := gladiusBase()
+	if err != nil {
+		return fmt.Errorf("couldn't get the Gladius base: %s", err)
+	}
+	log.SetLevel(log.ErrorLevel) // Check reports a missing file itself
+	config.SetupConfig(base)
+
+	file, problems := config.Check()
+	if o.json {
+		if problems == nil {
+			problems = make([]*config.Problem, 0)
+		}
+		if err := o.printJSON(map[string]interface{}{"file": file, "problems": problems}); err != nil {
+			return err
+		}
+		return config.Errors(problems)
+	}
+
+	fmt.Fprintln(o.out, "Checked", file)
+	if len(problems) == 0 {
+		fmt.Fprintln(o.out, "No problems found")
+		return nil
+	}
+	tw := tabwriter.NewWriter(o.out, 0, 4, 2, ' ', 0)
+	for _, p := range problems {
+		level := "error"
+		if p.Warning {
+			level = "warning"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", level, p.Key, p.Message)
+	}
+	tw.Flush()
+	return config.Errors(problems)
+}
+
+// secretCommand manages the secret store in the Gladius base, it works on
+// the files directly so it doesn't need a running guardian. Values are read
+// from stdin so they don't end up in the shell history
+func secretCommand(o *options, args []string) error {
+	if len(args) == 0 {
+		return usageError("secret needs set, list or rm")
+	}
+	base, err := gladiusBase()
+	if err != nil {
+		return fmt.Errorf("couldn't get the Gladius base: %s", err)
+	}
+	log.SetLevel(log.ErrorLevel)
+	config.SetupConfig(base)
+	store := guardian.NewSecretStore(config.SecretPaths())
+
+	switch {
+	case args[0] == "set" && len(args) == 2:
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value := strings.TrimRight(string(b), "\r\n")
+		if value == "" {
+			return errors.New("no value on stdin")
+		}
+		if err := store.Set(args[1], value); err != nil {
+			return err
+		}
+		fmt.Fprintf(o.out, "Saved %s, use it with KEY=%s%s\n", args[1], guardian.SecretRefPrefix, args[1])
+	case args[0] == "list" && len(args) == 1:
+		names, err := store.Names()
+		if err != nil {
+			return err
+		}
+		if o.json {
+			return o.printJSON(names)
+		}
+		for _, name := range names {
+			fmt.Fprintln(o.out, name)
+		}
+	case args[0] == "rm" && len(args) == 2:
+		if err := store.Delete(args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintln(o.out, "Removed", args[1])
+	default:
+		return usageError("usage: secret set <name> | secret list | secret rm <name>")
+	}
+	return nil
+}
+
+// jobCommand lists jobs, runs one or shows its recent runs. A run that fails
+// makes the command fail too
+func jobCommand(o *options, args []string) error {
+	if len(args) == 0 {
+		return usageError("job needs list, run or runs")
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		jobs := make([]*guardian.JobStatus, 0)
+		if err := c.Do("GET", "/v2/jobs", nil, &jobs); err != nil {
+			return err
+		}
+		if o.json {
+			return o.printJSON(jobs)
+		}
+		tw := tabwriter.NewWriter(o.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSCHEDULE\tNEXT RUN\tLAST RUN")
+		for _, j := range jobs {
+			schedule, next, last := "-", "-", "-"
+			if j.Schedule != "" {
+				schedule = j.Schedule
+			}
+			if j.NextRun != nil {
+				next = j.NextRun.Local().Format(time.RFC3339)
+			}
+			if j.LastRun != nil {
+				last = j.LastRun.Status + " " + j.LastRun.StartedAt.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", j.Name, schedule, next, last)
+		}
+		tw.Flush()
+	case args[0] == "run" && len(args) == 2:
+		path := "/v2/jobs/" + url.PathEscape(args[1]) + "/run"
+		if o.async {
+			op := &guardian.Operation{}
+			if err := c.Do("POST", path+"?async=true", nil, op); err != nil {
+				return err
+			}
+			if o.json {
+				return o.printJSON(op)
+			}
+			fmt.Fprintf(o.out, "Started run of %s as operation %s\n", args[1], op.ID)
+			return nil
+		}
+
+		run := &guardian.JobRun{}
+		if err := c.Wait("POST", path, nil, run); err != nil {
+			return err
+		}
+		if o.json {
+			if err := o.printJSON(run); err != nil {
+				return err
+			}
+		} else {
+			printJobRuns(o.out, []*guardian.JobRun{run})
+		}
+		if run.Status == guardian.JobFailed {
+			return fmt.Errorf("run %d of %s failed: %s", run.ID, args[1], run.Error)
+		}
+	case args[0] == "runs" && len(args) == 2:
+		runs := make([]*guardian.JobRun, 0)
+		if err := c.Do("GET", "/v2/jobs/"+url.PathEscape(args[1])+"/runs", nil, &runs); err != nil {
+			return err
+		}
+		if o.json {
+			return o.printJSON(runs)
+		}
+		printJobRuns(o.out, runs)
+	default:
+		return usageError("usage: job list | job run <job> [-async] | job runs <job>")
+	}
+	return nil
+}
+
+func printJobRuns(out io.Writer, runs []*guardian.JobRun) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tTRIGGER\tSTATUS\tSTARTED\tDURATION\tEXIT")
+	for _, run := range runs {
+		exit := "-"
+		if run.ExitCode != nil {
+			exit = strconv.Itoa(*run.ExitCode)
+		}
+		duration := "-"
+		if run.FinishedAt != nil {
+			duration = run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", run.ID, run.Trigger, run.Status, run.StartedAt.Local().Format(time.RFC3339), duration, exit)
+	}
+	tw.Flush()
+}
+
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// maintenanceCommand shows, turns on or turns off the maintenance mode of a
+// service, or of every service when none is given
+func maintenanceCommand(o *options, args []string) error {
+	if len(args) == 0 || len(args) > 2 || (args[0] == "status" && len(args) > 1) {
+		return usageError("usage: maintenance status | maintenance on [service] [-for 2h] [-reason text] | maintenance off [service]")
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	path, label := "/v2/maintenance", "every service"
+	if len(args) == 2 {
+		path, label = "/v2/services/"+url.PathEscape(args[1])+"/maintenance", args[1]
+	}
+	switch args[0] {
+	case "status":
+	case "on":
+		req := &guardian.MaintenanceRequest{Reason: o.reason}
+		if o.duration > 0 {
+			req.Duration = o.duration.String()
+		}
+		m := &guardian.Maintenance{}
+		if err := c.Do("PUT", path, req, m); err != nil {
+			return err
+		}
+		if o.json {
+			return o.printJSON(m)
+		}
+		if m.Until != nil {
+			fmt.Fprintf(o.out, "Maintenance mode on for %s until %s\n", label, m.Until.Local().Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(o.out, "Maintenance mode on for %s until it's turned off\n", label)
+		}
+		return nil
+	case "off":
+		if err := c.Do("DELETE", path, nil, nil); err != nil {
+			return err
+		}
+		if !o.json {
+			fmt.Fprintf(o.out, "Maintenance mode off for %s\n", label)
+			return nil
+		}
+	default:
+		return usageError("usage: maintenance status | maintenance on [service] [-for 2h] [-reason text] | maintenance off [service]")
+	}
+
+	status := &guardian.MaintenanceStatus{}
+	if err := c.Do("GET", "/v2/maintenance", nil, status); err != nil {
+		return err
+	}
+	if o.json {
+		return o.printJSON(status)
+	}
+	all := status.Services
+	if status.Global != nil {
+		all = append([]*guardian.Maintenance{status.Global}, all...)
+	}
+	if len(all) == 0 {
+		fmt.Fprintln(o.out, "Nothing is in maintenance mode")
+		return nil
+	}
+	tw := tabwriter.NewWriter(o.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tSINCE\tUNTIL\tREASON")
+	for _, m := range all {
+		service, until, reason := m.Service, "turned off", "-"
+		if service == "" {
+			service = "*"
+		}
+		if m.Until != nil {
+			until = m.Until.Local().Format(time.RFC3339)
+		}
+		if m.Reason != "" {
+			reason = m.Reason
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", service, m.Since.Local().Format(time.RFC3339), until, reason)
+	}
+	return tw.Flush()
+}
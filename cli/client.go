@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/gorilla/websocket"
+)
+
+// Client talks to a running guardian over TCP or its unix socket
+type Client struct {
+	baseURL    string // http(s)://host:port, or http://unix for the socket
+	socketPath string
+	token      string
+	tlsConfig  *tls.Config
+	http       *http.Client
+}
+
+// apiResponse is the envelope every guardian route answers with
+type apiResponse struct {
+	Message  string          `json:"message"`
+	Success  bool            `json:"success"`
+	Error    string          `json:"error"`
+	Code     string          `json:"code"`
+	Response json.RawMessage `json:"response"`
+}
+
+// APIError is an unsuccessful answer from the guardian
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     string
+}
+
+func (e *APIError) Error() string {
+	if e.Err == "" {
+		return fmt.Sprintf("%s (%d %s)", e.Message, e.Status, e.Code)
+	}
+	return fmt.Sprintf("%s: %s (%d %s)", e.Message, e.Err, e.Status, e.Code)
+}
+
+// NewClient returns a client for addr, which is a URL like
+// http://127.0.0.1:7791 or unix:///path/to/guardian.sock. The CA file is
+// only needed for https with a certificate the system doesn't trust
+func NewClient(addr, token, caFile string) (*Client, error) {
+	c := &Client{token: token}
+
+	transport := &http.Transport{}
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		c.socketPath = strings.TrimPrefix(addr, "unix://")
+		c.baseURL = "http://unix"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", c.socketPath)
+		}
+	case strings.HasPrefix(addr, "http://"), strings.HasPrefix(addr, "https://"):
+		c.baseURL = strings.TrimSuffix(addr, "/")
+	default:
+		return nil, fmt.Errorf("address %q must start with http://, https:// or unix://", addr)
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in the CA file")
+		}
+		c.tlsConfig = &tls.Config{RootCAs: pool}
+		transport.TLSClientConfig = c.tlsConfig
+	}
+
+	c.http = &http.Client{Transport: transport, Timeout: 60 * time.Second}
+	return c, nil
+}
+
+// Do sends a request and decodes the response field into v if it's not nil
+func (c *Client) Do(method, path string, body interface{}, v interface{}) error {
+	_, response, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(response, v)
+}
+
+// Wait sends a request for an action and decodes its result into v. The
+// guardian answers with an operation instead if the action takes a while,
+// which is followed until it's done
+func (c *Client) Wait(method, path string, body interface{}, v interface{}) error {
+	status, response, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusAccepted {
+		return decodeResponse(response, v)
+	}
+
+	op := &guardian.Operation{}
+	if err := json.Unmarshal(response, op); err != nil {
+		return err
+	}
+	for op.Finished == nil {
+		time.Sleep(500 * time.Millisecond)
+		if err := c.Do("GET", "/service/operations/"+op.ID, nil, op); err != nil {
+			return fmt.Errorf("couldn't follow operation %s: %s", op.ID, err)
+		}
+	}
+	if op.Status == guardian.OperationFailed {
+		return fmt.Errorf("%s failed: %s (%s)", op.Action, op.Error, op.ErrorCode)
+	}
+
+	result, err := json.Marshal(op.Result)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(result, v)
+}
+
+// do sends a request and returns the status code and the response field
+func (c *Client) do(method, path string, body interface{}) (int, json.RawMessage, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("couldn't reach the guardian: %s", err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("couldn't read the response: %s", err)
+	}
+
+	resp := &apiResponse{}
+	if err := json.Unmarshal(resBody, resp); err != nil {
+		return 0, nil, fmt.Errorf("unexpected response (%d): %s", res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+	if res.StatusCode >= 400 || !resp.Success {
+		return 0, nil, &APIError{Status: res.StatusCode, Code: resp.Code, Message: resp.Message, Err: resp.Error}
+	}
+
+	return res.StatusCode, resp.Response, nil
+}
+
+func decodeResponse(response json.RawMessage, v interface{}) error {
+	if v != nil && len(response) > 0 {
+		return json.Unmarshal(response, v)
+	}
+	return nil
+}
+
+// WebSocket opens a WebSocket to the path, sending the token as a header
+func (c *Client) WebSocket(path string) (*websocket.Conn, error) {
+	u, err := url.Parse(c.baseURL + path)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:  c.tlsConfig,
+	}
+	if c.socketPath != "" {
+		dialer.NetDial = func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", c.socketPath)
+		}
+	}
+
+	header := http.Header{}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	conn, res, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("couldn't open WebSocket: %s", res.Status)
+		}
+		return nil, fmt.Errorf("couldn't open WebSocket: %s", err)
+	}
+	return conn, nil
+}
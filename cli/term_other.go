@@ -0,0 +1,20 @@
+// +build !linux,!darwin
+
+package cli
+
+import "errors"
+
+// terminal is a terminal put in raw mode, only Linux and macOS are supported
+type terminal struct{}
+
+func makeRaw(fd int) (*terminal, error) {
+	return nil, errors.New("top is only supported on Linux and macOS")
+}
+
+func (t *terminal) restore() error {
+	return nil
+}
+
+func terminalSize(fd int) (int, int, error) {
+	return 0, 0, errors.New("not supported")
+}
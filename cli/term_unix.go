@@ -0,0 +1,61 @@
+// +build linux darwin
+
+package cli
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// terminal is a terminal put in raw mode, restore puts it back
+type terminal struct {
+	fd       int
+	original unix.Termios
+}
+
+// makeRaw turns off echo, line buffering and signal keys so every key press
+// is read straight away
+func makeRaw(fd int) (*terminal, error) {
+	t, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return nil, err
+	}
+	term := &terminal{fd: fd, original: *t}
+
+	raw := *t
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+	return term, nil
+}
+
+func (t *terminal) restore() error {
+	return setTermios(t.fd, &t.original)
+}
+
+// terminalSize returns the columns and rows of the terminal
+func terminalSize(fd int) (int, int, error) {
+	ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(ws.Col), int(ws.Row), nil
+}
+
+// setTermios isn't exported by the version of x/sys we use
+func setTermios(fd int, t *unix.Termios) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), ioctlWriteTermios, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/gorilla/websocket"
+)
+
+// Escape sequences for the terminal
+const (
+	altScreenOn  = "\x1b[?1049h"
+	altScreenOff = "\x1b[?1049l"
+	cursorHide   = "\x1b[?25l"
+	cursorShow   = "\x1b[?25h"
+	cursorHome   = "\x1b[H"
+	clearLine    = "\x1b[K"
+	clearBelow   = "\x1b[J"
+	reverse      = "\x1b[7m"
+	bold         = "\x1b[1m"
+	reset        = "\x1b[0m"
+)
+
+const maxTopLogLines = 1000
+
+// topLine is a log line from the WebSocket of a service
+type topLine struct {
+	service string
+	line    string
+}
+
+// cpuSample is the CPU time of a process at a point in time
+type cpuSample struct {
+	pid int
+	cpu float64
+	at  time.Time
+}
+
+// top is the state of the terminal dashboard
+type top struct {
+	c    *Client
+	addr string
+
+	services   []*service
+	samples    map[string]cpuSample
+	cpuPercent map[string]float64
+	selected   int
+	refreshErr error
+
+	logService string
+	logLines   []string
+	logConn    *websocket.Conn
+	logs       chan topLine
+
+	message  string
+	messages chan string
+}
+
+func topCommand(o *options, args []string) error {
+	if len(args) != 0 {
+		return usageError("top doesn't take arguments")
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	term, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return fmt.Errorf("couldn't setup the terminal: %s", err)
+	}
+	defer term.restore()
+	fmt.Print(altScreenOn + cursorHide)
+	defer fmt.Print(cursorShow + altScreenOff)
+
+	t := &top{
+		c:          c,
+		addr:       c.baseURL,
+		samples:    make(map[string]cpuSample),
+		cpuPercent: make(map[string]float64),
+		logs:       make(chan topLine, 100),
+		messages:   make(chan string, 10),
+		message:    "q quit  up/down select  s start  x stop  r restart",
+	}
+	if c.socketPath != "" {
+		t.addr = "unix://" + c.socketPath
+	}
+	defer t.closeLog()
+
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	t.refresh()
+	t.render()
+	for {
+		select {
+		case k, ok := <-keys:
+			if !ok || !t.handleKey(k) {
+				return nil
+			}
+		case <-ticker.C:
+			t.refresh()
+		case l := <-t.logs:
+			if l.service == t.logService {
+				t.appendLog(l.line)
+			}
+		case m := <-t.messages:
+			t.message = m
+			t.refresh()
+		}
+		t.render()
+	}
+}
+
+// handleKey acts on a key press, it returns false to quit
+func (t *top) handleKey(k []byte) bool {
+	switch string(k) {
+	case "q", "Q", "\x03": // Ctrl-C doesn't send a signal in raw mode
+		return false
+	case "\x1b[A", "k":
+		if t.selected > 0 {
+			t.selected--
+		}
+	case "\x1b[B", "j":
+		if t.selected < len(t.services)-1 {
+			t.selected++
+		}
+	case "s":
+		t.act("start")
+	case "x":
+		t.act("stop")
+	case "r":
+		t.act("restart")
+	}
+	t.followSelected()
+	return true
+}
+
+// act starts an operation on the selected service and reports on it in the
+// message line when it's done
+func (t *top) act(action string) {
+	if t.selected >= len(t.services) {
+		return
+	}
+	name := t.services[t.selected].Name
+	t.message = fmt.Sprintf("%s of %s requested...", action, name)
+
+	go func() {
+		op := &guardian.Operation{}
+		path := "/v2/services/" + url.PathEscape(name) + "/" + action + "?async=true"
+		if err := t.c.Do("POST", path, nil, op); err != nil {
+			t.messages <- fmt.Sprintf("%s of %s failed: %s", action, name, err)
+			return
+		}
+
+		for op.Finished == nil {
+			time.Sleep(500 * time.Millisecond)
+			if err := t.c.Do("GET", "/service/operations/"+op.ID, nil, op); err != nil {
+				t.messages <- fmt.Sprintf("couldn't follow %s of %s: %s", action, name, err)
+				return
+			}
+		}
+		if op.Status == guardian.OperationFailed {
+			t.messages <- fmt.Sprintf("%s of %s failed: %s", action, name, op.Error)
+			return
+		}
+		t.messages <- fmt.Sprintf("%s of %s succeeded", action, name)
+	}()
+}
+
+// refresh gets the services and works out their CPU use since the last time
+func (t *top) refresh() {
+	services := make([]*service, 0)
+	if err := t.c.Do("GET", "/v2/services", nil, &services); err != nil {
+		t.refreshErr = err
+		return
+	}
+	t.refreshErr = nil
+	t.services = services
+	if t.selected >= len(services) {
+		t.selected = len(services) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+
+	now := time.Now()
+	for _, s := range services {
+		prev, ok := t.samples[s.Name]
+		if !s.Running {
+			delete(t.samples, s.Name)
+			delete(t.cpuPercent, s.Name)
+			continue
+		}
+		if ok && prev.pid == s.PID && now.After(prev.at) {
+			t.cpuPercent[s.Name] = (s.CPUSeconds - prev.cpu) / now.Sub(prev.at).Seconds() * 100
+		}
+		t.samples[s.Name] = cpuSample{pid: s.PID, cpu: s.CPUSeconds, at: now}
+	}
+
+	t.followSelected()
+}
+
+// followSelected switches the log tail to the selected service
+func (t *top) followSelected() {
+	if t.selected >= len(t.services) {
+		return
+	}
+	name := t.services[t.selected].Name
+	if name == t.logService {
+		return
+	}
+
+	t.closeLog()
+	t.logService = name
+	t.logLines = nil
+
+	// Connect first so no lines are lost between the two requests
+	conn, err := t.c.WebSocket("/service/ws/logs/" + url.PathEscape(name))
+	if err != nil {
+		t.appendLog("couldn't follow the log: " + err.Error())
+	}
+
+	lines := make([]string, 0)
+	if err := t.c.Do("GET", "/v2/services/"+url.PathEscape(name)+"/logs?lines=200", nil, &lines); err != nil {
+		t.appendLog("couldn't get the log: " + err.Error())
+	}
+	for _, l := range lines {
+		t.appendLog(l)
+	}
+
+	if conn == nil {
+		return
+	}
+	t.logConn = conn
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return // Closed when the selection changes
+			}
+			t.logs <- topLine{service: name, line: string(msg)}
+		}
+	}()
+}
+
+func (t *top) closeLog() {
+	if t.logConn != nil {
+		t.logConn.Close()
+		t.logConn = nil
+	}
+}
+
+func (t *top) appendLog(line string) {
+	t.logLines = append(t.logLines, line)
+	if len(t.logLines) > maxTopLogLines {
+		t.logLines = t.logLines[len(t.logLines)-maxTopLogLines:]
+	}
+}
+
+// render redraws the whole screen
+func (t *top) render() {
+	cols, rows, err := terminalSize(int(os.Stdout.Fd()))
+	if err != nil || cols <= 0 || rows <= 0 {
+		cols, rows = 80, 24
+	}
+
+	lines := make([]string, 0, rows)
+	lines = append(lines, bold+fit(fmt.Sprintf("gladius-guardian top - %s - %s", t.addr, time.Now().Format("15:04:05")), cols)+reset)
+
+	// Table, the selected row is highlighted after tabwriter has aligned it
+	var table bytes.Buffer
+	tw := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tPID\tUPTIME\tRESTARTS\tCPU\tMEM\tHEALTH")
+	for _, s := range t.services {
+		state, pid, uptime, cpu, mem := "stopped", "-", "-", "-", "-"
+		if s.Running {
+			state, pid = "running", strconv.Itoa(s.PID)
+			uptime = formatUptime(s.UptimeSeconds)
+			if p, ok := t.cpuPercent[s.Name]; ok {
+				cpu = fmt.Sprintf("%.1f%%", p)
+			}
+			if s.MemoryRSS > 0 {
+				mem = formatBytes(s.MemoryRSS)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", s.Name, state, pid, uptime, s.Restarts, cpu, mem, health(s))
+	}
+	tw.Flush()
+	for i, row := range strings.Split(strings.TrimRight(table.String(), "\n"), "\n") {
+		row = fit(row, cols)
+		switch {
+		case i == 0:
+			row = bold + row + reset
+		case i-1 == t.selected:
+			row = reverse + row + strings.Repeat(" ", cols-utf8.RuneCountInString(row)) + reset
+		}
+		lines = append(lines, row)
+	}
+
+	// The log tail gets whatever is left above the message line
+	lines = append(lines, "", bold+fit("Log: "+t.logService, cols)+reset)
+	space := rows - len(lines) - 1
+	if space > 0 {
+		start := len(t.logLines) - space
+		if start < 0 {
+			start = 0
+		}
+		for _, l := range t.logLines[start:] {
+			lines = append(lines, fit(l, cols))
+		}
+	}
+	for len(lines) < rows-1 {
+		lines = append(lines, "")
+	}
+
+	message := t.message
+	if t.refreshErr != nil {
+		message = "Couldn't refresh: " + t.refreshErr.Error()
+	}
+	lines = append(lines[:rows-1], reverse+fit(message, cols)+strings.Repeat(" ", cols-utf8.RuneCountInString(fit(message, cols)))+reset)
+
+	var b bytes.Buffer
+	b.WriteString(cursorHome)
+	for i, l := range lines {
+		b.WriteString(l)
+		b.WriteString(clearLine)
+		if i < len(lines)-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	b.WriteString(clearBelow)
+	os.Stdout.Write(b.Bytes())
+}
+
+// health is as much as the guardian knows, it doesn't run health checks
+func health(s *service) string {
+	switch {
+	case s.Running:
+		return "ok"
+	case s.LastExit != "":
+		return "exited: " + s.LastExit
+	}
+	return "-"
+}
+
+// fit cuts a line to the width of the terminal, dropping control characters
+// that would move the cursor
+func fit(s string, cols int) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+	if utf8.RuneCountInString(s) <= cols {
+		return s
+	}
+	return string([]rune(s)[:cols])
+}
+
+func formatUptime(seconds int64) string {
+	d := time.Duration(seconds) * time.Second
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), (d%(24*time.Hour))/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, (d%time.Hour)/time.Minute)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%ds", d/time.Minute, (d%time.Minute)/time.Second)
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGT"[exp])
+}
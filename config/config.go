@@ -4,21 +4,30 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/gladiusio/gladius-common/pkg/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// DefaultAllowedOrigins only lets local pages and the desktop manager talk to
+// the guardian from a browser
+var DefaultAllowedOrigins = []string{
+	"http://localhost:*",
+	"https://localhost:*",
+	"http://127.0.0.1:*",
+	"https://127.0.0.1:*",
+	"http://[::1]:*",
+	"https://[::1]:*",
+	"file://", // The Electron based Gladius manager
+}
+
+// configDir is where the config file is looked for, kept so it can be read
+// again on reload
+var configDir string
+
 // SetupConfig - Setup a config file and add some default values
 func SetupConfig(configFilePath string) {
-	viper.SetConfigName("gladius-guardian")
-	viper.AddConfigPath(configFilePath)
-
-	// Setup env variable handling
-	viper.SetEnvPrefix("GUARDIAN")
-	r := strings.NewReplacer(".", "_")
-	viper.SetEnvKeyReplacer(r)
-	viper.AutomaticEnv()
+	configDir = configFilePath
+	setupViper(viper.GetViper())
 
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -28,25 +37,93 @@ func SetupConfig(configFilePath string) {
 	// add some defaults
 	ConfigOption("NetworkdExecutable", "gladius-edged")
 	ConfigOption("ControldExecutable", "gladius-network-gateway")
+	ConfigOption("NetworkdInstances", 1) // Processes of each, told apart with {{.Instance}}
+	ConfigOption("ControldInstances", 1)
 	ConfigOption("Ports.Guardian", 7791)
 	ConfigOption("Ports.EdgeD", 8080)
 	ConfigOption("Ports.NetworkGateway", 3001)
 
-	// Get gladius base for the various services
-	base, err := utils.GetGladiusBase()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Warn("Couldn't get Gladius base")
-	}
-
 	// Add a default environment so that we can set the gladius base of our sub
-	// processes
-	ConfigOption("DefaultEnvironment", []string{"GLADIUSBASE=" + base})
+	// processes, values can use templates like {{.Base}} and {{.Ports.EdgeD}}
+	ConfigOption("DefaultEnvironment", []string{"GLADIUSBASE={{.Base}}"})
 	ConfigOption("MaxLogLines", 1000) // Max number of log lines to keep in ram for each service
+	ConfigOption("LogLevel", "info")  // debug, info, warning or error
+	ConfigOption("WatchConfig", true) // Reload the config when the file changes
+
+	// How long a start waits to see the process stay up, and how long a
+	// process gets to exit after SIGTERM before it's killed. A Timeouts.<name>
+	// section with Start and Stop overrides them for one service
+	ConfigOption("StartTimeout", "3s")
+	ConfigOption("StopTimeout", "10s")
+
+	// Where services registered through the API with persist are kept, in
+	// the Gladius base if not set. Other services go in a Services section,
+	// and commands run to completion on demand or on a schedule in a Jobs
+	// section
+	ConfigOption("ServicesFile", "")
+
+	// Shipping service and guardian logs to syslog, journald or a collector
+	ConfigOption("LogForwarding.Enabled", false)
+	ConfigOption("LogForwarding.Type", "syslog") // syslog, journald or http
+	ConfigOption("LogForwarding.Network", "")    // unix, unixgram, udp or tcp for syslog
+	ConfigOption("LogForwarding.Address", "")    // Socket path or host:port, local socket if empty
+	ConfigOption("LogForwarding.URL", "")        // Collector URL for the http type
+	ConfigOption("LogForwarding.Format", "json") // json or line (line protocol) for the http type
+	ConfigOption("LogForwarding.AppName", "gladius-guardian")
+	ConfigOption("LogForwarding.Timeout", "10s")    // Request timeout for the http type
+	ConfigOption("LogForwarding.BufferSize", 10000) // Entries kept in memory while the sink is down
+	ConfigOption("LogForwarding.BatchSize", 100)
+	ConfigOption("LogForwarding.FlushInterval", "1s")
+	ConfigOption("LogForwarding.Backpressure", "drop") // drop the oldest entries or block the services when full
+	ConfigOption("LogForwarding.GuardianLogs", true)   // Also forward the guardian's own log output
+
+	// Where the API listens, defaults to all interfaces on Ports.Guardian
+	ConfigOption("API.Listen", []string{})     // TCP addresses like "127.0.0.1:7791"
+	ConfigOption("API.UnixSocket", "")         // Path of a unix socket to also listen on
+	ConfigOption("API.UnixSocketMode", "0660") // Permissions of the unix socket
+	ConfigOption("API.TLS.CertFile", "")       // Serve TLS on the TCP listeners if set with KeyFile
+	ConfigOption("API.TLS.KeyFile", "")
+	ConfigOption("API.TLS.ClientCAFile", "") // Require client certificates signed by these CAs
+
+	// Browser origins allowed to use the API and log WebSockets, "*" allows any
+	ConfigOption("API.AllowedOrigins", DefaultAllowedOrigins)
+
+	// Request limits, 0 disables each of them
+	ConfigOption("API.MaxBodyBytes", 1<<20)           // Largest request body accepted
+	ConfigOption("RateLimit.RequestsPerSecond", 10.0) // Per token, or per address without one
+	ConfigOption("RateLimit.Burst", 30)               // Requests allowed at once before limiting
+	ConfigOption("RateLimit.ServiceCooldown", "2s")   // Minimum time between start/stop/restart of a service
 
-	// Setup logging level
-	switch loglevel := viper.GetString("LogLevel"); loglevel {
+	// API authentication, see the README for how to add tokens
+	ConfigOption("Auth.Mode", "token")  // token, or localhost to skip auth for loopback clients only
+	ConfigOption("Auth.TokensFile", "") // Optional extra file with a Tokens list, watched for changes
+
+	// Audit trail of control actions, in the Gladius base if not set
+	ConfigOption("Audit.File", "")
+
+	// Encrypted store for @secret: environment references, in the Gladius
+	// base if not set. The key file must only be readable by the guardian
+	ConfigOption("Secrets.File", "")
+	ConfigOption("Secrets.KeyFile", "")
+
+	setLogLevel()
+}
+
+// setupViper points v at the config file and the environment
+func setupViper(v *viper.Viper) {
+	v.SetConfigName("gladius-guardian")
+	v.AddConfigPath(configDir)
+
+	// Setup env variable handling
+	v.SetEnvPrefix("GUARDIAN")
+	r := strings.NewReplacer(".", "_")
+	v.SetEnvKeyReplacer(r)
+	v.AutomaticEnv()
+}
+
+// setLogLevel sets the logging level from the config
+func setLogLevel() {
+	switch loglevel := strings.ToLower(viper.GetString("LogLevel")); loglevel {
 	case "debug":
 		log.SetLevel(log.DebugLevel)
 	case "warning":
@@ -63,6 +140,27 @@ func SetupConfig(configFilePath string) {
 // ConfigOption - add a default key
 func ConfigOption(key string, defaultValue interface{}) string {
 	viper.SetDefault(key, defaultValue)
+	defaults[key] = defaultValue
 
 	return key
 }
+
+// Ports - The Ports settings for templates, by the name they're written in
+// the config and in lower case
+func Ports() map[string]int {
+	return PortsFrom(viper.GetViper())
+}
+
+// PortsFrom - The Ports settings in v, like Ports
+func PortsFrom(v *viper.Viper) map[string]int {
+	ports := make(map[string]int)
+	for _, key := range v.AllKeys() {
+		if !strings.HasPrefix(key, "ports.") {
+			continue
+		}
+		name := displayName(key)
+		ports[name[strings.Index(name, ".")+1:]] = v.GetInt(key)
+		ports[strings.TrimPrefix(key, "ports.")] = v.GetInt(key)
+	}
+	return ports
+}
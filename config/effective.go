@@ -0,0 +1,78 @@
+package config
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Where the value of a setting came from
+const (
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceDefault = "default"
+)
+
+// Setting is one setting of the running config
+type Setting struct {
+	Key    string
+	Value  interface{}
+	Source string // file, env or default
+}
+
+// EffectiveConfig is the config file, environment and defaults merged
+type EffectiveConfig struct {
+	File     string // The config file, empty if there isn't one
+	Settings []*Setting
+}
+
+// Effective - Every setting with the value the guardian is using and where
+// it came from, with secrets redacted
+func Effective() *EffectiveConfig {
+	var ec *EffectiveConfig
+	sections.Read(func() { ec = effective() })
+	return ec
+}
+
+func effective() *EffectiveConfig {
+	ec := &EffectiveConfig{
+		File:     viper.ConfigFileUsed(),
+		Settings: make([]*Setting, 0),
+	}
+
+	file := viper.New()
+	if ec.File != "" {
+		file.SetConfigFile(ec.File)
+		file.ReadInConfig()
+	}
+
+	keys := viper.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		source := SourceDefault
+		if _, ok := os.LookupEnv(envName(key)); ok {
+			source = SourceEnv
+		} else if file.IsSet(key) {
+			source = SourceFile
+		}
+		ec.Settings = append(ec.Settings, &Setting{
+			Key:    displayName(key),
+			Value:  sections.Redact(key, viper.Get(key)),
+			Source: source,
+		})
+	}
+	return ec
+}
+
+// displayName is the key as it's written in the config where it has a
+// default, viper only has the lower case version
+func displayName(key string) string {
+	for k := range defaults {
+		if strings.ToLower(k) == key {
+			return k
+		}
+	}
+	return key
+}
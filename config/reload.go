@@ -0,0 +1,110 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// defaults holds every key added with ConfigOption, so a config can be
+// checked on its own before it replaces the running one
+var defaults = make(map[string]interface{})
+
+var reloadMux sync.Mutex
+
+// Reload - Read the config file again. The new config is read and checked on
+// its own first, if it's invalid the running config isn't touched. Returns
+// the keys whose values changed
+func Reload() ([]string, error) {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+
+	path := FilePath()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %s", err)
+	}
+	v := newViper()
+	v.SetConfigFile(path)
+	if err := v.ReadConfig(bytes.NewReader(content)); err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %s", err)
+	}
+	if err := Validate(v); err != nil {
+		return nil, err
+	}
+
+	// Replace the running config with what was checked, the file could have
+	// changed again since
+	var changed []string
+	err = sections.Replace(func() error {
+		before := settings(viper.GetViper())
+		viper.SetConfigFile(path)
+		if err := viper.ReadConfig(bytes.NewReader(content)); err != nil {
+			return fmt.Errorf("couldn't read config file: %s", err)
+		}
+		setLogLevel()
+		changed = changedKeys(before, settings(viper.GetViper()))
+		return nil
+	})
+	return changed, err
+}
+
+// FilePath - The config file in use, or where it would be if there isn't one
+func FilePath() string {
+	if f := viper.ConfigFileUsed(); f != "" {
+		return f
+	}
+	return filepath.Join(configDir, "gladius-guardian.toml")
+}
+
+// readConfig reads the config file into a new viper with the same defaults
+// and environment as the running one
+func readConfig() (*viper.Viper, error) {
+	v := newViper()
+	return v, v.ReadInConfig()
+}
+
+func newViper() *viper.Viper {
+	v := viper.New()
+	setupViper(v)
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+	return v
+}
+
+// settings returns the value of every key that's set or has a default
+func settings(v *viper.Viper) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, key := range v.AllKeys() {
+		values[key] = v.Get(key)
+	}
+	return values
+}
+
+// changedKeys returns the keys that differ, named as they're written in the
+// config where they have a default
+func changedKeys(before, after map[string]interface{}) []string {
+	changed := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, values := range []map[string]interface{}{before, after} {
+		for key := range values {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if reflect.DeepEqual(before[key], after[key]) {
+				continue
+			}
+			changed = append(changed, displayName(key))
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
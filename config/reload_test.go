@@ -0,0 +1,36 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangedKeys(t *testing.T) {
+	old, ok := defaults["StopTimeout"]
+	defer func() {
+		if ok {
+			defaults["StopTimeout"] = old
+		} else {
+			delete(defaults, "StopTimeout")
+		}
+	}()
+	defaults["StopTimeout"] = "10s" // Named as written in the config
+
+	tests := []struct {
+		name          string
+		before, after map[string]interface{}
+		want          []string
+	}{
+		{"nothing", map[string]interface{}{"stoptimeout": "10s"}, map[string]interface{}{"stoptimeout": "10s"}, []string{}},
+		{"changed", map[string]interface{}{"stoptimeout": "10s"}, map[string]interface{}{"stoptimeout": "20s"}, []string{"StopTimeout"}},
+		{"added", map[string]interface{}{}, map[string]interface{}{"timeouts.edged.stop": "5s"}, []string{"timeouts.edged.stop"}},
+		{"removed", map[string]interface{}{"timeouts.edged.stop": "5s"}, map[string]interface{}{}, []string{"timeouts.edged.stop"}},
+		{"lists", map[string]interface{}{"b": []string{"X=1"}, "a": []string{"Y=1"}}, map[string]interface{}{"b": []string{"X=2"}, "a": []string{"Y=1"}}, []string{"b"}},
+		{"sorted", map[string]interface{}{"z": 1, "a": 1}, map[string]interface{}{"z": 2, "a": 2}, []string{"a", "z"}},
+	}
+	for _, test := range tests {
+		if got := changedKeys(test.before, test.after); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
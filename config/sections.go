@@ -0,0 +1,61 @@
+package config
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// Sections is what the config needs from the guardian: the Services, Hooks,
+// Restarts and Jobs sections are read into its types, it knows which values
+// are secret, and it locks the running config. main sets it so this package
+// doesn't depend on the guardian
+type Sections interface {
+	// Validate returns what's wrong with the guardian's sections of v
+	Validate(v *viper.Viper) []*Problem
+	// Check returns what depends on the machine, like executables, files and
+	// secrets that services and jobs use
+	Check(v *viper.Viper) []*Problem
+	// Redact hides the value of key if it's secret
+	Redact(key string, value interface{}) interface{}
+	// Read calls f with the running config locked for reading
+	Read(f func())
+	// Replace calls f with the running config locked for changing it
+	Replace(f func() error) error
+}
+
+// noSections is used until SetSections is called, nothing is checked or
+// redacted
+type noSections struct{}
+
+func (noSections) Validate(*viper.Viper) []*Problem                 { return nil }
+func (noSections) Check(*viper.Viper) []*Problem                    { return nil }
+func (noSections) Redact(key string, value interface{}) interface{} { return value }
+func (noSections) Read(f func())                                    { f() }
+func (noSections) Replace(f func() error) error                     { return f() }
+
+var sections Sections = noSections{}
+
+// SetSections - Set what reads, checks and locks the guardian's parts of the
+// config
+func SetSections(s Sections) {
+	sections = s
+}
+
+// Dir - Where the config file is looked for, the Gladius base
+func Dir() string {
+	return configDir
+}
+
+// SecretPaths - The secret store file and its key file
+func SecretPaths() (string, string) {
+	path := viper.GetString("Secrets.File")
+	if path == "" {
+		path = filepath.Join(configDir, "gladius-guardian-secrets.json")
+	}
+	keyPath := viper.GetString("Secrets.KeyFile")
+	if keyPath == "" {
+		keyPath = filepath.Join(configDir, "gladius-guardian-secrets.key")
+	}
+	return path, keyPath
+}
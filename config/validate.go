@@ -0,0 +1,273 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/spf13/viper"
+)
+
+// Problem is something wrong with the config, warnings are things that may
+// be fine but are worth a look
+type Problem struct {
+	Key     string `json:"key"`
+	Message string `json:"message"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return p.Key + " " + p.Message
+}
+
+// clientEnv are environment variables used by the command line client, not
+// the guardian's config
+var clientEnv = map[string]bool{"GUARDIAN_ADDR": true, "GUARDIAN_TOKEN": true}
+
+// Validate - Check the values that the guardian would otherwise only notice
+// when it uses them
+func Validate(v *viper.Viper) error {
+	var result *multierror.Error
+	for _, p := range validate(v) {
+		result = multierror.Append(result, p)
+	}
+	if result != nil {
+		result.ErrorFormat = func(errs []error) string {
+			messages := make([]string, len(errs))
+			for i, err := range errs {
+				messages[i] = err.Error()
+			}
+			return strings.Join(messages, "; ")
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// Check - Validate the config in the Gladius base, and the things that
+// depend on the machine: executables and files exist, ports are free and
+// every key is known. SetupConfig must have been called. Returns the config
+// file and what's wrong with it
+func Check() (string, []*Problem) {
+	var problems []*Problem
+	v, err := readConfig()
+	file := v.ConfigFileUsed()
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		file = FilePath()
+		problems = append(problems, &Problem{Key: file, Message: "doesn't exist, the defaults are used", Warning: true})
+	} else if err != nil {
+		return file, []*Problem{{Key: file, Message: err.Error()}}
+	}
+
+	problems = append(problems, validate(v)...)
+	problems = append(problems, unknownKeys(v)...)
+
+	executables := map[string]string{
+		"NetworkdExecutable": v.GetString("NetworkdExecutable"),
+		"ControldExecutable": v.GetString("ControldExecutable"),
+	}
+	for _, key := range sortedNames(executables) {
+		if exe := executables[key]; exe != "" {
+			if _, err := exec.LookPath(exe); err != nil {
+				problems = append(problems, &Problem{Key: key, Message: fmt.Sprintf("%q isn't an executable file or in PATH", exe)})
+			}
+		}
+	}
+
+	for _, key := range []string{"Auth.TokensFile", "API.TLS.CertFile", "API.TLS.KeyFile", "API.TLS.ClientCAFile"} {
+		if path := v.GetString(key); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				problems = append(problems, &Problem{Key: key, Message: err.Error()})
+			}
+		}
+	}
+
+	// Services, jobs and the secrets they use
+	problems = append(problems, sections.Check(v)...)
+
+	// In use is only a warning, it may be the guardian or the service itself
+	listen := v.GetStringSlice("API.Listen")
+	if len(listen) == 0 && v.GetString("API.UnixSocket") == "" {
+		listen = []string{":" + strconv.Itoa(v.GetInt("Ports.Guardian"))}
+	}
+	ports := map[string][]string{"API.Listen": listen}
+	for _, key := range []string{"Ports.EdgeD", "Ports.NetworkGateway"} {
+		ports[key] = []string{":" + strconv.Itoa(v.GetInt(key))}
+	}
+	for _, key := range []string{"API.Listen", "Ports.EdgeD", "Ports.NetworkGateway"} {
+		for _, addr := range ports[key] {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				problems = append(problems, &Problem{Key: key, Message: fmt.Sprintf("%s isn't free: %s", addr, err), Warning: true})
+				continue
+			}
+			l.Close()
+		}
+	}
+
+	return file, problems
+}
+
+// validate checks the values in v
+func validate(v *viper.Viper) []*Problem {
+	var problems []*Problem
+	fail := func(key, format string, args ...interface{}) {
+		problems = append(problems, &Problem{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+	oneOf := func(key string, values ...string) {
+		value := strings.ToLower(v.GetString(key))
+		for _, allowed := range values {
+			if value == allowed {
+				return
+			}
+		}
+		fail(key, "is %q, must be one of %s", v.GetString(key), strings.Join(values, ", "))
+	}
+
+	oneOf("LogLevel", "debug", "info", "warning", "error")
+	oneOf("Auth.Mode", "token", "localhost")
+	oneOf("LogForwarding.Type", "syslog", "journald", "http")
+	oneOf("LogForwarding.Format", "json", "line")
+	oneOf("LogForwarding.Backpressure", "drop", "block")
+
+	for _, key := range []string{"NetworkdExecutable", "ControldExecutable"} {
+		if v.GetString(key) == "" {
+			fail(key, "can't be empty")
+		}
+	}
+
+	for _, key := range []string{"Ports.Guardian", "Ports.EdgeD", "Ports.NetworkGateway"} {
+		if port := v.GetInt(key); port < 1 || port > 65535 {
+			fail(key, "must be a port between 1 and 65535")
+		}
+	}
+	for _, key := range []string{"MaxLogLines", "LogForwarding.BufferSize", "LogForwarding.BatchSize"} {
+		if v.GetInt(key) < 1 {
+			fail(key, "must be at least 1")
+		}
+	}
+	for _, key := range []string{"API.MaxBodyBytes", "RateLimit.RequestsPerSecond", "RateLimit.Burst"} {
+		if v.GetFloat64(key) < 0 {
+			fail(key, "can't be negative")
+		}
+	}
+	timeouts := []string{"StartTimeout", "StopTimeout"}
+	for name := range v.GetStringMap("Timeouts") {
+		timeouts = append(timeouts, "Timeouts."+name+".Start", "Timeouts."+name+".Stop")
+	}
+	sort.Strings(timeouts[2:])
+	for _, key := range timeouts {
+		if !v.IsSet(key) {
+			continue
+		}
+		if d, err := time.ParseDuration(v.GetString(key)); err != nil || d <= 0 {
+			fail(key, "is %q, must be a duration like 10s", v.GetString(key))
+		}
+	}
+	for _, key := range []string{"LogForwarding.Timeout", "LogForwarding.FlushInterval", "RateLimit.ServiceCooldown"} {
+		if d, err := time.ParseDuration(v.GetString(key)); err != nil || d < 0 {
+			fail(key, "is %q, must be a duration like 2s", v.GetString(key))
+		}
+	}
+
+	if _, err := strconv.ParseUint(v.GetString("API.UnixSocketMode"), 8, 32); err != nil {
+		fail("API.UnixSocketMode", "is %q, must be octal like 0660", v.GetString("API.UnixSocketMode"))
+	}
+	if (v.GetString("API.TLS.CertFile") == "") != (v.GetString("API.TLS.KeyFile") == "") {
+		fail("API.TLS", "needs both CertFile and KeyFile")
+	}
+
+	// The default environment, instances, services, hooks, restarts and jobs
+	problems = append(problems, sections.Validate(v)...)
+
+	return problems
+}
+
+// knownKey returns true for keys the guardian reads, the name is lower case
+func knownKey(key string) bool {
+	if strings.HasPrefix(key, "services.") || strings.HasPrefix(key, "jobs.") || strings.HasPrefix(key, "hooks.") || key == "auth.tokens" {
+		return true
+	}
+	if parts := strings.Split(key, "."); len(parts) == 3 && parts[0] == "timeouts" && (parts[2] == "start" || parts[2] == "stop") {
+		return true
+	}
+	if parts := strings.Split(key, "."); len(parts) == 3 && parts[0] == "restarts" {
+		switch parts[2] {
+		case "schedule", "maxmemory", "maxmemoryfor", "maxuptime", "jitter":
+			return true
+		}
+	}
+	for k := range defaults {
+		if strings.ToLower(k) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownKeys finds keys in the file and GUARDIAN_ environment variables the
+// guardian doesn't read, usually typos or settings from older versions
+func unknownKeys(v *viper.Viper) []*Problem {
+	var problems []*Problem
+	file := viper.New()
+	file.SetConfigFile(v.ConfigFileUsed())
+	if v.ConfigFileUsed() != "" && file.ReadInConfig() == nil {
+		for _, key := range file.AllKeys() {
+			if !knownKey(key) {
+				problems = append(problems, &Problem{Key: key, Message: "isn't a known setting"})
+			}
+		}
+	}
+
+	known := make(map[string]bool)
+	for k := range defaults {
+		known[envName(k)] = true
+	}
+	known[envName("Auth.Tokens")] = true
+	var unknown []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(name, "GUARDIAN_") && !known[name] && !clientEnv[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, &Problem{Key: name, Message: "isn't a known setting", Warning: true})
+	}
+	return problems
+}
+
+// envName is the environment variable that overrides a key
+func envName(key string) string {
+	return "GUARDIAN_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// Errors - Only the problems that aren't warnings, as an error
+func Errors(problems []*Problem) error {
+	n := 0
+	for _, p := range problems {
+		if !p.Warning {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return errors.New(strconv.Itoa(n) + " problem(s) in the config")
+}
+
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
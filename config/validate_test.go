@@ -0,0 +1,117 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// fakeSections reports one problem for the guardian's sections
+type fakeSections struct{ noSections }
+
+func (fakeSections) Validate(v *viper.Viper) []*Problem {
+	if v.IsSet("Services") {
+		return []*Problem{{Key: "Services.edged.Executable", Message: "can't be empty"}}
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	SetupConfig(t.TempDir())
+	SetSections(fakeSections{})
+	defer SetSections(noSections{})
+
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		want   []string // Keys with problems, in the order they're checked
+	}{
+		{"defaults", nil, []string{}},
+		{"case of choices", map[string]interface{}{"LogLevel": "DEBUG", "Auth.Mode": "Token"}, []string{}},
+		{"unknown choice", map[string]interface{}{"LogLevel": "verbose", "LogForwarding.Type": "kafka"}, []string{"LogLevel", "LogForwarding.Type"}},
+		{"empty executable", map[string]interface{}{"ControldExecutable": ""}, []string{"ControldExecutable"}},
+		{"ports", map[string]interface{}{"Ports.Guardian": 0, "Ports.EdgeD": 65536, "Ports.NetworkGateway": 443}, []string{"Ports.Guardian", "Ports.EdgeD"}},
+		{"sizes", map[string]interface{}{"MaxLogLines": 0, "LogForwarding.BatchSize": -1}, []string{"MaxLogLines", "LogForwarding.BatchSize"}},
+		{"negative limits", map[string]interface{}{"API.MaxBodyBytes": 0, "RateLimit.Burst": -1}, []string{"RateLimit.Burst"}},
+		{"timeouts", map[string]interface{}{"StartTimeout": "soon", "StopTimeout": "0s"}, []string{"StartTimeout", "StopTimeout"}},
+		{"service timeouts", map[string]interface{}{"Timeouts": map[string]interface{}{
+			"edged":   map[string]interface{}{"Start": "5s", "Stop": "-1s"},
+			"gateway": map[string]interface{}{"Start": "10"},
+		}}, []string{"Timeouts.edged.Stop", "Timeouts.gateway.Start"}},
+		{"zero cooldown", map[string]interface{}{"RateLimit.ServiceCooldown": "0s"}, []string{}},
+		{"negative durations", map[string]interface{}{"LogForwarding.Timeout": "-2s", "RateLimit.ServiceCooldown": "later"}, []string{"LogForwarding.Timeout", "RateLimit.ServiceCooldown"}},
+		{"socket mode", map[string]interface{}{"API.UnixSocketMode": "0999"}, []string{"API.UnixSocketMode"}},
+		{"cert without key", map[string]interface{}{"API.TLS.CertFile": "cert.pem"}, []string{"API.TLS"}},
+		{"sections", map[string]interface{}{"LogLevel": "verbose", "Services": map[string]interface{}{}}, []string{"LogLevel", "Services.edged.Executable"}},
+	}
+	for _, test := range tests {
+		v := newViper()
+		for key, value := range test.values {
+			v.Set(key, value)
+		}
+
+		got := make([]string, 0)
+		for _, p := range validate(v) {
+			got = append(got, p.Key)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got problems with %q, want %q", test.name, got, test.want)
+		}
+		if err := Validate(v); (err != nil) != (len(test.want) > 0) {
+			t.Errorf("%s: Validate returned %v", test.name, err)
+		}
+	}
+
+	v := newViper()
+	v.Set("LogLevel", "verbose")
+	v.Set("MaxLogLines", 0)
+	want := `LogLevel is "verbose", must be one of debug, info, warning, error; MaxLogLines must be at least 1`
+	if err := Validate(v); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		problems []*Problem
+		want     string
+	}{
+		{"none", nil, ""},
+		{"only warnings", []*Problem{{Key: "Ports.EdgeD", Warning: true}}, ""},
+		{"errors", []*Problem{{Key: "LogLevel"}, {Key: "Ports.EdgeD", Warning: true}, {Key: "MaxLogLines"}}, "2 problem(s) in the config"},
+	}
+	for _, test := range tests {
+		got := ""
+		if err := Errors(test.problems); err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestKnownKey(t *testing.T) {
+	SetupConfig(t.TempDir())
+
+	tests := []struct {
+		key   string
+		known bool
+	}{
+		{"loglevel", true},
+		{"ports.edged", true},
+		{"services.edged.executable", true},
+		{"timeouts.edged.stop", true},
+		{"timeouts.edged.restart", false},
+		{"restarts.edged.maxuptime", true},
+		{"restarts.edged.every", false},
+		{"loglevle", false},
+	}
+	for _, test := range tests {
+		if got := knownKey(test.key); got != test.known {
+			t.Errorf("%s: got known %t, want %t", test.key, got, test.known)
+		}
+	}
+}
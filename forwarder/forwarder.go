@@ -0,0 +1,291 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// GuardianService is the service name used for the guardian's own log output
+const GuardianService = "guardian"
+
+// Entry is a single log line to be shipped to a sink
+type Entry struct {
+	Time     time.Time
+	Service  string
+	Severity Severity
+	Message  string
+	Fields   map[string]string
+}
+
+// Sink is a destination that log entries can be written to, a sink should
+// return an error if the batch could not be delivered so it can be retried
+type Sink interface {
+	Write(entries []*Entry) error
+	Close() error
+}
+
+// Forwarder buffers log entries in memory and ships them to a sink in the
+// background, retrying with a backoff while the sink is unavailable
+type Forwarder struct {
+	sink          Sink
+	buffer        []*Entry
+	bufferSize    int
+	batchSize     int
+	flushInterval time.Duration
+	block         bool // Block callers instead of dropping when the buffer is full
+	dropped       uint64
+
+	mux      sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	closed   bool
+	done     chan struct{}
+}
+
+// New returns a new Forwarder that writes to the sink, it starts shipping
+// entries right away
+func New(sink Sink, bufferSize, batchSize int, flushInterval time.Duration, block bool) *Forwarder {
+	if bufferSize <= 0 {
+		bufferSize = 10000
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	f := &Forwarder{
+		sink:          sink,
+		buffer:        make([]*Entry, 0, batchSize),
+		bufferSize:    bufferSize,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		block:         block,
+		done:          make(chan struct{}),
+	}
+	f.notEmpty = sync.NewCond(&f.mux)
+	f.notFull = sync.NewCond(&f.mux)
+
+	go f.run()
+
+	return f
+}
+
+// FromConfig builds a Forwarder from the LogForwarding section of the config,
+// it returns nil if forwarding isn't enabled
+func FromConfig() (*Forwarder, error) {
+	if !viper.GetBool("LogForwarding.Enabled") {
+		return nil, nil
+	}
+
+	var sink Sink
+	var err error
+	switch sinkType := strings.ToLower(viper.GetString("LogForwarding.Type")); sinkType {
+	case "syslog":
+		sink, err = NewSyslogSink(
+			viper.GetString("LogForwarding.Network"),
+			viper.GetString("LogForwarding.Address"),
+			viper.GetString("LogForwarding.AppName"),
+		)
+	case "journald":
+		sink, err = NewJournaldSink(
+			viper.GetString("LogForwarding.Address"),
+			viper.GetString("LogForwarding.AppName"),
+		)
+	case "http":
+		sink, err = NewHTTPSink(
+			viper.GetString("LogForwarding.URL"),
+			viper.GetString("LogForwarding.Format"),
+			viper.GetDuration("LogForwarding.Timeout"),
+		)
+	default:
+		return nil, fmt.Errorf("unknown log forwarding type %q, must be one of syslog, journald or http", sinkType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block := false
+	switch mode := strings.ToLower(viper.GetString("LogForwarding.Backpressure")); mode {
+	case "block":
+		block = true
+	case "drop", "":
+	default:
+		return nil, fmt.Errorf("unknown backpressure mode %q, must be drop or block", mode)
+	}
+
+	return New(
+		sink,
+		viper.GetInt("LogForwarding.BufferSize"),
+		viper.GetInt("LogForwarding.BatchSize"),
+		viper.GetDuration("LogForwarding.FlushInterval"),
+		block,
+	), nil
+}
+
+// Forward queues a line captured from a service to be shipped
+func (f *Forwarder) Forward(serviceName, line string) {
+	f.Enqueue(&Entry{
+		Time:     time.Now(),
+		Service:  serviceName,
+		Severity: SeverityInfo,
+		Message:  line,
+	})
+}
+
+// Enqueue adds an entry to the buffer. If the buffer is full it either drops
+// the oldest entry or blocks until there is room, depending on the
+// backpressure mode
+func (f *Forwarder) Enqueue(e *Entry) {
+	f.enqueue(e, f.block)
+}
+
+func (f *Forwarder) enqueue(e *Entry, block bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.closed {
+		return
+	}
+
+	for len(f.buffer) >= f.bufferSize {
+		if !block {
+			f.buffer = f.buffer[1:]
+			f.dropped++
+			continue
+		}
+		f.notFull.Wait()
+		if f.closed {
+			return
+		}
+	}
+
+	f.buffer = append(f.buffer, e)
+	if len(f.buffer) >= f.batchSize {
+		f.notEmpty.Signal()
+	}
+}
+
+// Dropped returns how many entries have been dropped because the buffer was
+// full
+func (f *Forwarder) Dropped() uint64 {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return f.dropped
+}
+
+// Close flushes what it can before the timeout and closes the sink
+func (f *Forwarder) Close(timeout time.Duration) error {
+	f.mux.Lock()
+	if f.closed {
+		f.mux.Unlock()
+		return errors.New("forwarder already closed")
+	}
+	f.closed = true
+	f.notEmpty.Broadcast()
+	f.notFull.Broadcast()
+	f.mux.Unlock()
+
+	select {
+	case <-f.done:
+	case <-time.After(timeout):
+	}
+
+	return f.sink.Close()
+}
+
+// run ships batches from the buffer until the forwarder is closed
+func (f *Forwarder) run() {
+	defer close(f.done)
+
+	// Wake up the writer on every flush interval so partial batches are sent
+	ticker := time.NewTicker(f.flushInterval)
+	defer ticker.Stop()
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				f.mux.Lock()
+				f.notEmpty.Signal()
+				f.mux.Unlock()
+			case <-f.done:
+				return
+			}
+		}
+	}()
+
+	backoff := time.Duration(0)
+	var lastDropped uint64
+	for {
+		f.mux.Lock()
+		for len(f.buffer) == 0 && !f.closed {
+			f.notEmpty.Wait()
+		}
+		if len(f.buffer) == 0 && f.closed {
+			f.mux.Unlock()
+			return
+		}
+		n := len(f.buffer)
+		if n > f.batchSize {
+			n = f.batchSize
+		}
+		batch := make([]*Entry, n)
+		copy(batch, f.buffer[:n])
+		dropped := f.dropped
+		closed := f.closed
+		f.mux.Unlock()
+
+		if dropped != lastDropped {
+			log.WithFields(log.Fields{
+				"component": "forwarder",
+				"dropped":   dropped,
+			}).Warn("Log forwarding buffer is full, dropping oldest entries")
+			lastDropped = dropped
+		}
+
+		err := f.sink.Write(batch)
+		if err != nil {
+			if closed {
+				return // Don't keep retrying while shutting down
+			}
+
+			// Back off and retry the same batch, entries stay in the buffer
+			// until they're delivered
+			if backoff == 0 {
+				backoff = 500 * time.Millisecond
+			} else if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			log.WithFields(log.Fields{
+				"component": "forwarder",
+				"err":       err,
+				"retry_in":  backoff.String(),
+			}).Warn("Couldn't forward logs")
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		f.mux.Lock()
+		// Entries may have been dropped off the front while we were writing,
+		// so remove up to the last entry of the batch if it's still there
+		removed := 0
+		for i := 0; i < n && i < len(f.buffer); i++ {
+			if f.buffer[i] == batch[n-1] {
+				removed = i + 1
+				break
+			}
+		}
+		f.buffer = f.buffer[removed:]
+		f.notFull.Broadcast()
+		f.mux.Unlock()
+	}
+}
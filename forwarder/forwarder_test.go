@@ -0,0 +1,111 @@
+package forwarder_test
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/forwarder"
+)
+
+type fakeSink struct {
+	mux     sync.Mutex
+	fail    bool
+	written []*forwarder.Entry
+}
+
+func (s *fakeSink) Write(entries []*forwarder.Entry) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.fail {
+		return errors.New("sink down")
+	}
+	s.written = append(s.written, entries...)
+	return nil
+}
+
+func (s *fakeSink) Close() error { return nil }
+
+func (s *fakeSink) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.written)
+}
+
+func (s *fakeSink) setFail(fail bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.fail = fail
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForwarderDelivers(t *testing.T) {
+	sink := &fakeSink{}
+	f := forwarder.New(sink, 100, 10, 10*time.Millisecond, false)
+	defer f.Close(time.Second)
+
+	for i := 0; i < 25; i++ {
+		f.Forward("edged", "line")
+	}
+
+	waitFor(t, func() bool { return sink.count() == 25 })
+}
+
+func TestForwarderBuffersWhileSinkDown(t *testing.T) {
+	sink := &fakeSink{fail: true}
+	f := forwarder.New(sink, 5, 5, 10*time.Millisecond, false)
+	defer f.Close(time.Second)
+
+	for i := 0; i < 8; i++ {
+		f.Forward("edged", "line")
+	}
+	if f.Dropped() != 3 {
+		t.Errorf("expected 3 dropped entries, got %d", f.Dropped())
+	}
+
+	sink.setFail(false)
+	waitFor(t, func() bool { return sink.count() == 5 })
+}
+
+func TestFormatRFC5424(t *testing.T) {
+	e := &forwarder.Entry{
+		Time:     time.Date(2018, 11, 27, 15, 0, 0, 0, time.UTC),
+		Service:  "edged",
+		Severity: forwarder.SeverityError,
+		Message:  "something broke",
+	}
+
+	msg := string(forwarder.FormatRFC5424(e, "node1", "gladius-guardian"))
+	if !strings.HasPrefix(msg, "<27>1 2018-11-27T15:00:00.000000Z node1 gladius-guardian ") {
+		t.Errorf("unexpected header in %q", msg)
+	}
+	if !strings.HasSuffix(msg, ` edged [gladius@32473 service="edged"] something broke`) {
+		t.Errorf("unexpected message id, structured data or message in %q", msg)
+	}
+}
+
+func TestFormatLineProtocol(t *testing.T) {
+	e := &forwarder.Entry{
+		Time:     time.Unix(0, 42),
+		Service:  "network gateway",
+		Severity: forwarder.SeverityInfo,
+		Message:  `said "hi"`,
+	}
+
+	line := forwarder.FormatLineProtocol(e)
+	expected := `guardian_log,service=network\ gateway,severity=info message="said \"hi\"" 42`
+	if line != expected {
+		t.Errorf("expected %q, got %q", expected, line)
+	}
+}
@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Hook is a logrus hook that forwards the guardian's own log output
+type Hook struct {
+	f *Forwarder
+}
+
+// NewHook returns a logrus hook that ships entries through f
+func NewHook(f *Forwarder) *Hook {
+	return &Hook{f: f}
+}
+
+// Levels returns all levels, filtering is left to the logger's level
+func (h *Hook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire queues the logrus entry to be forwarded
+func (h *Hook) Fire(entry *log.Entry) error {
+	// Don't forward the forwarder's own complaints, if the sink is down they
+	// would just pile up in the buffer
+	if entry.Data["component"] == "forwarder" {
+		return nil
+	}
+
+	fields := make(map[string]string, len(entry.Data))
+	for k, v := range entry.Data {
+		fields[k] = fmt.Sprint(v)
+	}
+
+	// Never block here, logrus holds its lock while firing hooks and the
+	// forwarder logs through it too
+	h.f.enqueue(&Entry{
+		Time:     entry.Time,
+		Service:  GuardianService,
+		Severity: severityFromLevel(entry.Level),
+		Message:  entry.Message,
+		Fields:   fields,
+	}, false)
+	return nil
+}
+
+func severityFromLevel(level log.Level) Severity {
+	switch level {
+	case log.PanicLevel:
+		return SeverityEmergency
+	case log.FatalLevel:
+		return SeverityCritical
+	case log.ErrorLevel:
+		return SeverityError
+	case log.WarnLevel:
+		return SeverityWarning
+	case log.InfoLevel:
+		return SeverityInfo
+	default:
+		return SeverityDebug
+	}
+}
@@ -0,0 +1,136 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HTTPSink posts batches of entries to a remote collector, either as
+// newline delimited JSON or as InfluxDB style line protocol
+type HTTPSink struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+type jsonEntry struct {
+	Time     string            `json:"time"`
+	Service  string            `json:"service"`
+	Severity string            `json:"severity"`
+	Message  string            `json:"message"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+// NewHTTPSink returns a sink that posts to rawURL, format is "json" or "line"
+func NewHTTPSink(rawURL, format string, timeout time.Duration) (*HTTPSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid log forwarding URL %q", rawURL)
+	}
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "line" {
+		return nil, fmt.Errorf("unsupported log forwarding format %q, must be json or line", format)
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &HTTPSink{
+		url:    rawURL,
+		format: format,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Write posts the whole batch in a single request
+func (h *HTTPSink) Write(entries []*Entry) error {
+	var body bytes.Buffer
+	contentType := "application/x-ndjson"
+
+	if h.format == "line" {
+		contentType = "text/plain; charset=utf-8"
+		for _, e := range entries {
+			body.WriteString(FormatLineProtocol(e))
+			body.WriteByte('\n')
+		}
+	} else {
+		enc := json.NewEncoder(&body)
+		for _, e := range entries {
+			err := enc.Encode(jsonEntry{
+				Time:     e.Time.UTC().Format(time.RFC3339Nano),
+				Service:  e.Service,
+				Severity: e.Severity.String(),
+				Message:  e.Message,
+				Fields:   e.Fields,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	resp, err := h.client.Post(h.url, contentType, &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("log collector returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// Close is a no-op, the client has nothing to clean up
+func (h *HTTPSink) Close() error {
+	return nil
+}
+
+var (
+	lineTagEscaper   = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	lineFieldEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// FormatLineProtocol formats an entry as a single line protocol point in the
+// guardian_log measurement, tagged by service and severity
+func FormatLineProtocol(e *Entry) string {
+	var b strings.Builder
+
+	b.WriteString("guardian_log,service=")
+	b.WriteString(lineTagEscaper.Replace(e.Service))
+	b.WriteString(",severity=")
+	b.WriteString(e.Severity.String())
+
+	b.WriteString(" message=\"")
+	b.WriteString(lineFieldEscaper.Replace(e.Message))
+	b.WriteString("\"")
+
+	// Keep field order stable so lines are reproducible
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(",")
+		b.WriteString(lineTagEscaper.Replace(k))
+		b.WriteString("=\"")
+		b.WriteString(lineFieldEscaper.Replace(e.Fields[k]))
+		b.WriteString("\"")
+	}
+
+	b.WriteString(" ")
+	b.WriteString(fmt.Sprintf("%d", e.Time.UnixNano()))
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultJournaldSocket is where systemd-journald listens for native protocol
+// messages
+const defaultJournaldSocket = "/run/systemd/journal/socket"
+
+// JournaldSink writes entries to journald using its native protocol, so each
+// line carries the service name as a field that can be queried with
+// `journalctl GLADIUS_SERVICE=edged`
+type JournaldSink struct {
+	address    string
+	identifier string
+	conn       *net.UnixConn
+	mux        sync.Mutex
+}
+
+// NewJournaldSink returns a sink for the journald socket at address, the
+// default socket is used if address is empty
+func NewJournaldSink(address, identifier string) (*JournaldSink, error) {
+	if address == "" {
+		address = defaultJournaldSocket
+	}
+	if identifier == "" {
+		identifier = "gladius-guardian"
+	}
+
+	return &JournaldSink{address: address, identifier: identifier}, nil
+}
+
+// Write sends each entry as a journal message
+func (j *JournaldSink) Write(entries []*Entry) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if j.conn == nil {
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: j.address, Net: "unixgram"})
+		if err != nil {
+			return fmt.Errorf("couldn't connect to journald at %s: %s", j.address, err)
+		}
+		j.conn = conn
+	}
+
+	for _, e := range entries {
+		j.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := j.conn.Write(j.encode(e)); err != nil {
+			j.conn.Close()
+			j.conn = nil
+			return fmt.Errorf("couldn't write to journald: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the journald socket
+func (j *JournaldSink) Close() error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if j.conn == nil {
+		return nil
+	}
+	err := j.conn.Close()
+	j.conn = nil
+	return err
+}
+
+// encode serializes an entry in the journal native protocol
+func (j *JournaldSink) encode(e *Entry) []byte {
+	var b bytes.Buffer
+
+	writeJournalField(&b, "MESSAGE", e.Message)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(int(e.Severity)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", j.identifier)
+	writeJournalField(&b, "SYSLOG_TIMESTAMP", e.Time.UTC().Format(time.RFC3339Nano))
+	writeJournalField(&b, "GLADIUS_SERVICE", e.Service)
+	for k, v := range e.Fields {
+		writeJournalField(&b, "GLADIUS_"+journalFieldName(k), v)
+	}
+
+	return b.Bytes()
+}
+
+// writeJournalField writes a single KEY=VALUE pair, values containing new
+// lines use the length prefixed binary form
+func writeJournalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+
+	b.WriteString(key)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName converts a field name to the upper case, alphanumeric and
+// underscore form journald requires
+func journalFieldName(k string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, k)
+}
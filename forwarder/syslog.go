@@ -0,0 +1,209 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity is a syslog severity level (RFC 5424 section 6.2.1)
+type Severity int
+
+// Syslog severities we map log levels to
+const (
+	SeverityEmergency Severity = 0
+	SeverityAlert     Severity = 1
+	SeverityCritical  Severity = 2
+	SeverityError     Severity = 3
+	SeverityWarning   Severity = 4
+	SeverityNotice    Severity = 5
+	SeverityInfo      Severity = 6
+	SeverityDebug     Severity = 7
+)
+
+// String returns the lower case name of the severity
+func (s Severity) String() string {
+	switch s {
+	case SeverityEmergency:
+		return "emergency"
+	case SeverityAlert:
+		return "alert"
+	case SeverityCritical:
+		return "critical"
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	case SeverityNotice:
+		return "notice"
+	case SeverityInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
+// facilityDaemon is the syslog facility used for everything we send
+const facilityDaemon = 3
+
+// SyslogSink writes RFC 5424 formatted messages to a syslog daemon over a
+// unix socket, UDP or TCP
+type SyslogSink struct {
+	network  string
+	address  string
+	appName  string
+	hostname string
+	conn     net.Conn
+	mux      sync.Mutex
+}
+
+// NewSyslogSink returns a sink for the syslog daemon at address. An empty
+// network and address will use the local /dev/log socket
+func NewSyslogSink(network, address, appName string) (*SyslogSink, error) {
+	if network == "" && address == "" {
+		network, address = "unixgram", "/dev/log"
+	}
+	switch network {
+	case "unix", "unixgram", "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q, must be one of unix, unixgram, udp or tcp", network)
+	}
+	if address == "" {
+		return nil, fmt.Errorf("syslog address required for network %s", network)
+	}
+	if appName == "" {
+		appName = "gladius-guardian"
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &SyslogSink{
+		network:  network,
+		address:  address,
+		appName:  appName,
+		hostname: hostname,
+	}, nil
+}
+
+// Write sends each entry as a separate syslog message, reconnecting if the
+// connection was lost
+func (s *SyslogSink) Write(entries []*Entry) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("couldn't connect to syslog at %s: %s", s.address, err)
+		}
+		s.conn = conn
+	}
+
+	for _, e := range entries {
+		msg := FormatRFC5424(e, s.hostname, s.appName)
+
+		// Stream transports need framing, use octet counting (RFC 6587)
+		if s.network == "tcp" || s.network == "unix" {
+			msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := s.conn.Write(msg); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("couldn't write to syslog: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the connection to the syslog daemon
+func (s *SyslogSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// FormatRFC5424 formats an entry as an RFC 5424 syslog message, the service
+// name is used as the MSGID and any fields go in a structured data element
+func FormatRFC5424(e *Entry, hostname, appName string) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s ",
+		facilityDaemon*8+int(e.Severity),
+		e.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		syslogHeaderField(hostname, 255),
+		syslogHeaderField(appName, 48),
+		os.Getpid(),
+		syslogHeaderField(e.Service, 32),
+	)
+
+	// Structured data, we use the private enterprise number reserved for
+	// documentation since we don't have one of our own
+	b.WriteString("[gladius@32473 service=\"")
+	b.WriteString(escapeSDValue(e.Service))
+	b.WriteString("\"")
+	for k, v := range e.Fields {
+		b.WriteString(" ")
+		b.WriteString(sdName(k))
+		b.WriteString("=\"")
+		b.WriteString(escapeSDValue(v))
+		b.WriteString("\"")
+	}
+	b.WriteString("] ")
+
+	b.WriteString(e.Message)
+	return b.Bytes()
+}
+
+// syslogHeaderField makes a value safe for the header, which only allows
+// printable US-ASCII without spaces
+func syslogHeaderField(v string, maxLen int) string {
+	if v == "" {
+		return "-"
+	}
+	v = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, v)
+	if len(v) > maxLen {
+		v = v[:maxLen]
+	}
+	return v
+}
+
+// sdName makes a structured data parameter name out of a field name
+func sdName(k string) string {
+	k = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, k)
+	if len(k) > 32 {
+		k = k[:32]
+	}
+	return k
+}
+
+var sdValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func escapeSDValue(v string) string {
+	return sdValueEscaper.Replace(v)
+}
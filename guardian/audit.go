@@ -0,0 +1,299 @@
+package guardian
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditEntry is a single control action in the audit log
+type AuditEntry struct {
+	Time       time.Time       `json:"time"`
+	RemoteAddr string          `json:"remote_addr,omitempty"`
+	Identity   string          `json:"identity"`
+	Action     string          `json:"action"`
+	Service    string          `json:"service,omitempty"`
+	Request    json.RawMessage `json:"request,omitempty"` // Body with secrets redacted
+	Status     int             `json:"status,omitempty"`
+	Success    bool            `json:"success"`
+	Error      string          `json:"error,omitempty"`
+	Operation  string          `json:"operation,omitempty"` // ID of the operation the request started
+}
+
+// AuditLog is an append only JSON lines file of every control action
+type AuditLog struct {
+	path string
+	file *os.File
+	mux  sync.Mutex
+}
+
+// NewAuditLog opens (or creates) the audit log at path
+func NewAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: f}, nil
+}
+
+// Record appends an entry and syncs it to disk
+func (a *AuditLog) Record(e *AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Couldn't encode audit entry")
+		return
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if _, err := a.file.Write(append(line, '\n')); err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"action": e.Action,
+			"err":    err,
+		}).Error("Couldn't write to the audit log")
+	}
+}
+
+// AuditQuery filters entries read back from the log, empty fields match
+// everything
+type AuditQuery struct {
+	Service  string
+	Identity string
+	Action   string
+	Since    time.Time
+	Limit    int // Newest entries are kept if there are more than this
+}
+
+// Query reads the log back and returns the matching entries oldest first
+func (a *AuditLog) Query(q *AuditQuery) ([]*AuditEntry, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]*AuditEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			continue // Skip a torn line rather than failing the whole query
+		}
+		if (q.Service != "" && e.Service != q.Service) ||
+			(q.Identity != "" && e.Identity != q.Identity) ||
+			(q.Action != "" && e.Action != q.Action) ||
+			e.Time.Before(q.Since) {
+			continue
+		}
+		entries = append(entries, e)
+		if q.Limit > 0 && len(entries) > q.Limit {
+			entries = entries[1:]
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// Close closes the underlying file
+func (a *AuditLog) Close() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	return a.file.Close()
+}
+
+// auditResponseWriter keeps the status and the start of the body so the
+// result can be recorded
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len() < 64*1024 {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditIdentityKey holds where AuthMiddleware leaves the identity it found,
+// the audit middleware runs before it and can't see the request it passes on
+const auditIdentityKey contextKey = "audit_identity"
+
+// noteIdentity lets the audit middleware know who made the request
+func noteIdentity(r *http.Request, id *Identity) {
+	if slot, ok := r.Context().Value(auditIdentityKey).(**Identity); ok {
+		*slot = id
+	}
+}
+
+// AuditMiddleware records every request that can change something. It goes
+// before AuthMiddleware and PermissionMiddleware so requests that fail to
+// authenticate or are denied are recorded too
+func AuditMiddleware(a *AuditLog) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, _ := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			var id *Identity
+			aw := &auditResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditIdentityKey, &id)))
+
+			e := &AuditEntry{
+				RemoteAddr: r.RemoteAddr,
+				Action:     r.Method + " " + r.URL.Path,
+				Service:    mux.Vars(r)["service_name"],
+				Request:    RedactJSON(body),
+				Status:     aw.status,
+				Success:    aw.status < 400,
+			}
+			if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+				e.Action = route.GetName()
+			}
+			e.Identity = "unauthenticated"
+			if id != nil {
+				e.Identity = id.Name
+			}
+
+			if aw.status == http.StatusAccepted {
+				e.Operation = strings.TrimPrefix(aw.Header().Get("Location"), "/service/operations/")
+			}
+
+			// Our handlers always answer with a Response, use its error
+			resp := &Response{}
+			if json.Unmarshal(aw.body.Bytes(), resp) == nil {
+				e.Success = e.Success && resp.Success
+				e.Error = resp.Error
+			}
+
+			a.Record(e)
+		})
+	}
+}
+
+// SetAuditLog - Record how operations that were answered before they
+// finished end, the request itself is recorded by AuditMiddleware
+func (gg *GladiusGuardian) SetAuditLog(a *AuditLog) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	gg.auditLog = a
+}
+
+// auditOperation records the outcome of the operation when it finishes, for
+// the request r that was answered with 202
+func (gg *GladiusGuardian) auditOperation(r *http.Request, op *Operation) {
+	gg.mux.Lock()
+	a := gg.auditLog
+	gg.mux.Unlock()
+	if a == nil {
+		return
+	}
+
+	e := &AuditEntry{
+		RemoteAddr: r.RemoteAddr,
+		Identity:   "unauthenticated",
+		Action:     r.Method + " " + r.URL.Path,
+		Service:    op.Service,
+		Operation:  op.ID,
+	}
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+		e.Action = route.GetName()
+	}
+	if id := IdentityFromRequest(r); id != nil {
+		e.Identity = id.Name
+	}
+
+	go func() {
+		finished, ok := gg.operations.Wait(op.ID, 0)
+		if !ok {
+			return // Forgotten before it could be waited on
+		}
+		e.Status = http.StatusOK
+		e.Success = finished.err == nil
+		if finished.err != nil {
+			e.Status = ServiceErrorStatus(finished.err)
+			e.Error = finished.Error
+		}
+		a.Record(e)
+	}()
+}
+
+// GetAuditLogHandler - Query the audit log, filtered by the service,
+// identity, action, since (RFC 3339) and limit query parameters
+func GetAuditLogHandler(a *AuditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query()
+		q := &AuditQuery{
+			Service:  v.Get("service"),
+			Identity: v.Get("identity"),
+			Action:   v.Get("action"),
+			Limit:    100,
+		}
+		if since := v.Get("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				ErrorHandler(w, r, "Couldn't parse since, must be RFC 3339", err, http.StatusBadRequest)
+				return
+			}
+			q.Since = t
+		}
+		if limit := v.Get("limit"); limit != "" {
+			l, err := strconv.Atoi(limit)
+			if err != nil || l < 0 {
+				ErrorHandler(w, r, "Couldn't parse limit, must be a positive number", err, http.StatusBadRequest)
+				return
+			}
+			q.Limit = l
+		}
+
+		entries, err := a.Query(q)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't read audit log", err, http.StatusInternalServerError)
+			return
+		}
+		ResponseHandler(w, r, "Got audit log", true, nil, entries)
+	}
+}
@@ -0,0 +1,73 @@
+package guardian_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+)
+
+func TestAuditRecordsEveryAction(t *testing.T) {
+	r, audit := apiRouter(t, guardian.AuthModeToken, guardian.NewRateLimiter(0, 0, 0))
+
+	serve(t, r, []apiRequest{
+		{"10.0.0.1", "guess", "POST", "/v2/services/edged/start", http.StatusUnauthorized},
+		{"10.0.0.1", "viewer-token", "POST", "/v2/services/edged/start", http.StatusForbidden},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/edged/start", http.StatusOK},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/broken/start", http.StatusConflict},
+		{"10.0.0.1", "operator-token", "GET", "/v2/services", http.StatusOK}, // Reads aren't audited
+	})
+
+	entries, err := audit.Query(&guardian.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		identity, service string
+		status            int
+		success           bool
+	}{
+		{"unauthenticated", "edged", http.StatusUnauthorized, false},
+		{"viewer", "edged", http.StatusForbidden, false},
+		{"operator", "edged", http.StatusOK, true},
+		{"operator", "broken", http.StatusConflict, false},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Identity != w.identity || e.Service != w.service || e.Status != w.status || e.Success != w.success || e.Action != "v2_start_service" {
+			t.Errorf("entry %d: got %+v, want %+v", i, e, w)
+		}
+	}
+	if entries[3].Error == "" {
+		t.Error("the failed request's error wasn't recorded")
+	}
+
+	entries, err = audit.Query(&guardian.AuditQuery{Identity: "operator", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Service != "broken" {
+		t.Errorf("got %+v for the newest operator entry", entries)
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	tests := []struct {
+		body, want string
+	}{
+		{``, ``},
+		{`{"running": true}`, `{"running":true}`},
+		{`{"password": "hunter2", "name": "edged"}`, `{"name":"edged","password":"[REDACTED]"}`},
+		{`{"environment_vars": ["API_TOKEN=abc", "PORT=1"]}`, `{"environment_vars":["API_TOKEN=[REDACTED]","PORT=1"]}`},
+		{`{"nested": {"secret_key": 1}}`, `{"nested":{"secret_key":"[REDACTED]"}}`},
+		{`not json`, `"[REDACTED] (not JSON)"`},
+	}
+	for _, test := range tests {
+		if got := string(guardian.RedactJSON([]byte(test.body))); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.body, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package guardian
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Auth modes
+const (
+	// AuthModeToken requires a valid bearer token on every request
+	AuthModeToken = "token"
+	// AuthModeLocalhost skips authentication for loopback clients and rejects
+	// everyone else, only for deployments that never expose the API
+	AuthModeLocalhost = "localhost"
+)
+
+type contextKey string
+
+const identityKey contextKey = "identity"
+
+// Identity is who made a request and what they're allowed to do
+type Identity struct {
+	Name        string       `json:"name"`
+	Role        string       `json:"role"`
+	Permissions []Permission `json:"permissions,omitempty"` // Narrows the role if set
+	Services    []string     `json:"services,omitempty"`    // Services it can act on, all if empty
+}
+
+// APIToken is a hashed bearer token from the config
+type APIToken struct {
+	Name        string       `mapstructure:"name" json:"name"`
+	Hash        string       `mapstructure:"hash" json:"hash"` // sha256:<hex> of the token
+	Role        string       `mapstructure:"role" json:"role"`
+	Permissions []Permission `mapstructure:"permissions" json:"permissions"`
+	Services    []string     `mapstructure:"services" json:"services"`
+}
+
+// Authenticator checks bearer tokens against the hashes in the config, the
+// tokens are re-read whenever the config or tokens file changes so they can
+// be rotated without a restart
+type Authenticator struct {
+	mode       string
+	tokens     []*APIToken
+	sources    []string // Files the tokens are read from
+	modTimes   map[string]time.Time
+	mux        sync.Mutex
+	lastStated time.Time
+}
+
+// NewAuthenticator returns an Authenticator setup from the Auth section of
+// the config
+func NewAuthenticator() (*Authenticator, error) {
+	mode := strings.ToLower(viper.GetString("Auth.Mode"))
+	if mode != AuthModeToken && mode != AuthModeLocalhost {
+		return nil, fmt.Errorf("unknown auth mode %q, must be %s or %s", mode, AuthModeToken, AuthModeLocalhost)
+	}
+
+	a := &Authenticator{
+		mode:     mode,
+		modTimes: make(map[string]time.Time),
+	}
+	if f := viper.ConfigFileUsed(); f != "" {
+		a.sources = append(a.sources, f)
+	}
+	if f := viper.GetString("Auth.TokensFile"); f != "" {
+		a.sources = append(a.sources, f)
+	}
+
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	if mode == AuthModeToken && len(a.tokens) == 0 {
+		log.Warn("No API tokens configured, every API request will be rejected until one is added")
+	}
+	if mode == AuthModeLocalhost {
+		log.Warn("API authentication is disabled for localhost, remote requests will be rejected")
+	}
+
+	return a, nil
+}
+
+// Reload re-reads the tokens from the config and tokens file
+func (a *Authenticator) Reload() error {
+	// Start with anything that came from the environment or defaults
+	tokens := make([]*APIToken, 0)
+	var configFile string
+	var err error
+	ReadConfig(func() {
+		configFile = viper.ConfigFileUsed()
+		err = viper.UnmarshalKey("Auth.Tokens", &tokens)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't parse Auth.Tokens: %s", err)
+	}
+
+	modTimes := make(map[string]time.Time)
+	for _, source := range a.sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("couldn't read tokens from %s: %s", source, err)
+		}
+		modTimes[source] = info.ModTime()
+
+		// The main config was already read by viper, but it may have changed
+		// since then so read it again on its own
+		v := viper.New()
+		v.SetConfigFile(source)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("couldn't read tokens from %s: %s", source, err)
+		}
+		key := "Tokens" // A standalone tokens file only holds the list
+		if source == configFile {
+			key = "Auth.Tokens"
+		}
+		fileTokens := make([]*APIToken, 0)
+		if err := v.UnmarshalKey(key, &fileTokens); err != nil {
+			return fmt.Errorf("couldn't parse tokens in %s: %s", source, err)
+		}
+		if source == configFile {
+			tokens = fileTokens // Replaces what viper read at startup
+		} else {
+			tokens = append(tokens, fileTokens...)
+		}
+	}
+
+	for _, t := range tokens {
+		if _, err := decodeTokenHash(t.Hash); err != nil {
+			return fmt.Errorf("invalid hash for token %q: %s", t.Name, err)
+		}
+		if err := t.validate(); err != nil {
+			return err
+		}
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.tokens = tokens
+	a.modTimes = modTimes
+
+	return nil
+}
+
+// reloadIfChanged reloads the tokens if one of the source files changed,
+// files are checked at most once a second
+func (a *Authenticator) reloadIfChanged() {
+	a.mux.Lock()
+	if time.Since(a.lastStated) < time.Second {
+		a.mux.Unlock()
+		return
+	}
+	a.lastStated = time.Now()
+	changed := false
+	for _, source := range a.sources {
+		info, err := os.Stat(source)
+		if err == nil && !info.ModTime().Equal(a.modTimes[source]) {
+			changed = true
+		}
+	}
+	a.mux.Unlock()
+
+	if changed {
+		if err := a.Reload(); err != nil {
+			// Keep the old tokens rather than locking everyone out
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't reload API tokens, keeping the previous ones")
+			return
+		}
+		log.Info("Reloaded API tokens")
+	}
+}
+
+// Authenticate returns the identity for the request or an error if it isn't
+// allowed
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if a.mode == AuthModeLocalhost {
+		if !isLocalAddr(r.RemoteAddr) {
+			return nil, errors.New("authentication is disabled so only localhost clients are allowed")
+		}
+		return &Identity{Name: "localhost", Role: RoleAdmin}, nil
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+
+	a.reloadIfChanged()
+
+	sum := sha256.Sum256([]byte(token))
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for _, t := range a.tokens {
+		expected, _ := decodeTokenHash(t.Hash)
+		if subtle.ConstantTimeCompare(sum[:], expected) == 1 {
+			return &Identity{
+				Name:        t.Name,
+				Role:        t.Role,
+				Permissions: t.Permissions,
+				Services:    t.Services,
+			}, nil
+		}
+	}
+
+	return nil, errors.New("invalid bearer token")
+}
+
+// publicRoutes are the names of routes anyone can load, the dashboard page
+// and its assets hold no data and ask for a token themselves
+var publicRoutes = map[string]bool{
+	"index":           true,
+	"dashboard_asset": true,
+}
+
+// AuthMiddleware rejects any request that doesn't authenticate and stores the
+// identity in the request context for the handlers
+func AuthMiddleware(a *Authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := a.Authenticate(r)
+			if err != nil && isPublicRoute(r) {
+				id, err = &Identity{Name: "anonymous", Role: RoleViewer}, nil
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"remote_addr": r.RemoteAddr,
+					"endpoint":    r.URL.Path,
+					"err":         err,
+				}).Debug("Rejected unauthenticated request")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="gladius-guardian"`)
+				ErrorHandler(w, r, "Unauthorized", err, http.StatusUnauthorized)
+				return
+			}
+
+			noteIdentity(r, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, id)))
+		})
+	}
+}
+
+func isPublicRoute(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	return route != nil && publicRoutes[route.GetName()]
+}
+
+// IdentityFromRequest returns who made the request, or nil if the request
+// didn't go through the auth middleware
+func IdentityFromRequest(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey).(*Identity)
+	return id
+}
+
+// HashToken returns the string to put in the config for a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func decodeTokenHash(h string) ([]byte, error) {
+	if !strings.HasPrefix(h, "sha256:") {
+		return nil, errors.New("hash must be in the form sha256:<hex>")
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(h, "sha256:"))
+	if err != nil || len(b) != sha256.Size {
+		return nil, errors.New("hash must be a hex encoded sha256 sum")
+	}
+	return b, nil
+}
+
+// bearerToken gets the token from the Authorization header. Browsers can't
+// set headers on a WebSocket upgrade so a token query parameter is accepted
+// for those
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// isLocalAddr returns true for loopback clients and for clients on the unix
+// socket, which have no remote address
+func isLocalAddr(remoteAddr string) bool {
+	if remoteAddr == "" || remoteAddr == "@" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
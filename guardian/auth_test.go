@@ -0,0 +1,150 @@
+package guardian_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/spf13/viper"
+)
+
+func TestHashToken(t *testing.T) {
+	hash := guardian.HashToken("operator-token")
+	if !strings.HasPrefix(hash, "sha256:") || len(hash) != len("sha256:")+64 {
+		t.Errorf("got %q, want sha256: and 64 hex digits", hash)
+	}
+	if guardian.HashToken("operator-token") != hash {
+		t.Error("hashing the same token twice gave different hashes")
+	}
+	if guardian.HashToken("operator-token2") == hash {
+		t.Error("different tokens have the same hash")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	viper.Set("Auth.TokensFile", "")
+	viper.Set("Auth.Tokens", []map[string]interface{}{
+		{"name": "admin", "hash": guardian.HashToken("admin-token"), "role": guardian.RoleAdmin},
+		{"name": "operator", "hash": guardian.HashToken("operator-token"), "role": guardian.RoleOperator},
+		{"name": "viewer", "hash": guardian.HashToken("viewer-token")}, // Viewer if left out
+	})
+
+	tests := []struct {
+		name       string
+		mode       string
+		remoteAddr string
+		header     string // Authorization
+		query      string
+		websocket  bool
+		wantName   string // Empty if it should be rejected
+		wantRole   string
+	}{
+		{"admin token", guardian.AuthModeToken, "10.0.0.1:40000", "Bearer admin-token", "", false, "admin", guardian.RoleAdmin},
+		{"operator token", guardian.AuthModeToken, "10.0.0.1:40000", "Bearer operator-token", "", false, "operator", guardian.RoleOperator},
+		{"default role", guardian.AuthModeToken, "10.0.0.1:40000", "Bearer viewer-token", "", false, "viewer", guardian.RoleViewer},
+		{"wrong token", guardian.AuthModeToken, "10.0.0.1:40000", "Bearer guess", "", false, "", ""},
+		{"no token", guardian.AuthModeToken, "10.0.0.1:40000", "", "", false, "", ""},
+		{"not a bearer token", guardian.AuthModeToken, "10.0.0.1:40000", "Basic admin-token", "", false, "", ""},
+		{"localhost needs a token", guardian.AuthModeToken, "127.0.0.1:40000", "", "", false, "", ""},
+
+		// Browsers can't set headers on WebSockets, only they can use the query
+		{"websocket query", guardian.AuthModeToken, "10.0.0.1:40000", "", "operator-token", true, "operator", guardian.RoleOperator},
+		{"query without websocket", guardian.AuthModeToken, "10.0.0.1:40000", "", "operator-token", false, "", ""},
+		{"websocket wrong query", guardian.AuthModeToken, "10.0.0.1:40000", "", "guess", true, "", ""},
+
+		{"loopback", guardian.AuthModeLocalhost, "127.0.0.1:40000", "", "", false, "localhost", guardian.RoleAdmin},
+		{"loopback v6", guardian.AuthModeLocalhost, "[::1]:40000", "", "", false, "localhost", guardian.RoleAdmin},
+		{"unix socket", guardian.AuthModeLocalhost, "", "", "", false, "localhost", guardian.RoleAdmin},
+		{"abstract unix socket", guardian.AuthModeLocalhost, "@", "", "", false, "localhost", guardian.RoleAdmin},
+		{"remote", guardian.AuthModeLocalhost, "10.0.0.1:40000", "Bearer admin-token", "", false, "", ""},
+	}
+	for _, test := range tests {
+		viper.Set("Auth.Mode", test.mode)
+		auth, err := guardian.NewAuthenticator()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := "/service/ws/logs/edged"
+		if test.query != "" {
+			path += "?token=" + test.query
+		}
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if test.websocket {
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+		}
+
+		id, err := auth.Authenticate(r)
+		if test.wantName == "" {
+			if err == nil {
+				t.Errorf("%s: got %+v, want it rejected", test.name, id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if id.Name != test.wantName || id.Role != test.wantRole {
+			t.Errorf("%s: got %s with role %s, want %s with role %s", test.name, id.Name, id.Role, test.wantName, test.wantRole)
+		}
+	}
+}
+
+func TestUnknownRoleIsRejected(t *testing.T) {
+	viper.Set("Auth.Mode", guardian.AuthModeToken)
+	viper.Set("Auth.TokensFile", "")
+	viper.Set("Auth.Tokens", []map[string]interface{}{
+		{"name": "root", "hash": guardian.HashToken("root-token"), "role": "root"},
+	})
+	if _, err := guardian.NewAuthenticator(); err == nil {
+		t.Error("a token with an unknown role was accepted")
+	}
+
+	viper.Set("Auth.Tokens", []map[string]interface{}{
+		{"name": "viewer", "hash": guardian.HashToken("viewer-token"), "role": guardian.RoleViewer, "permissions": []string{"stop"}},
+	})
+	if _, err := guardian.NewAuthenticator(); err == nil {
+		t.Error("a viewer token with the stop permission was accepted")
+	}
+}
+
+func TestTokenQueryIsNotEchoed(t *testing.T) {
+	r, _ := apiRouter(t, guardian.AuthModeToken, guardian.NewRateLimiter(0, 0, 0))
+
+	tests := []struct {
+		path, token string
+		want        int
+	}{
+		{"/v2/services?token=viewer-token&verbose=1", "viewer-token", http.StatusOK},
+		{"/v2/services?token=guess", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.RemoteAddr = "10.0.0.1:40000"
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.path, w.Code, test.want)
+		}
+
+		resp := &guardian.Response{}
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(resp.Endpoint, "token") || !strings.HasPrefix(resp.Endpoint, "/v2/services") {
+			t.Errorf("%s: got endpoint %q, want it without the token", test.path, resp.Endpoint)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package guardian
+
+import "net/http"
+
+// ConfigSetting is one setting of the config the guardian is running with
+type ConfigSetting struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source" description:"file, env or default"`
+}
+
+// EffectiveConfig is the config file, environment and defaults merged
+type EffectiveConfig struct {
+	File     string           `json:"file" description:"The config file, empty if there isn't one"`
+	Settings []*ConfigSetting `json:"settings"`
+}
+
+// GetConfigHandler - The settings the guardian is running with and where
+// each one came from, secrets are redacted
+func GetConfigHandler(effective func() *EffectiveConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got config", true, nil, effective())
+	}
+}
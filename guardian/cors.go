@@ -0,0 +1,144 @@
+package guardian
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OriginPolicy decides which browser origins can use the API. Entries are
+// exact origins like "https://example.com", origins with a wildcard port like
+// "http://localhost:*", or "*" to allow everything
+type OriginPolicy struct {
+	allowAll bool
+	exact    map[string]bool
+	anyPort  map[string]bool // scheme://host
+	mux      sync.RWMutex
+}
+
+// NewOriginPolicy returns a policy allowing the given origins
+func NewOriginPolicy(origins []string) *OriginPolicy {
+	p := &OriginPolicy{}
+	p.Update(origins)
+	return p
+}
+
+// Update replaces the allowed origins, used when the config is reloaded
+func (p *OriginPolicy) Update(origins []string) {
+	allowAll := false
+	exact := make(map[string]bool)
+	anyPort := make(map[string]bool)
+	for _, o := range origins {
+		o = strings.ToLower(strings.TrimSpace(o))
+		switch {
+		case o == "*":
+			allowAll = true
+		case strings.HasSuffix(o, ":*"):
+			anyPort[strings.TrimSuffix(o, ":*")] = true
+		case o != "":
+			exact[o] = true
+		}
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.allowAll, p.exact, p.anyPort = allowAll, exact, anyPort
+}
+
+// Allowed returns true if a browser page from origin may use the API
+func (p *OriginPolicy) Allowed(origin string) bool {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	if p.allowAll {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" {
+		return false
+	}
+	if u.Port() != "" {
+		if _, err := strconv.Atoi(u.Port()); err != nil {
+			return false
+		}
+	}
+	host := u.Hostname()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6
+	}
+	return p.anyPort[u.Scheme+"://"+host]
+}
+
+// CheckOrigin is used by the WebSocket upgrader, requests without an origin
+// aren't from a browser so they're allowed, and neither are pages the
+// guardian served itself
+func (p *OriginPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || sameOrigin(origin, r) || p.Allowed(origin)
+}
+
+// sameOrigin returns true if origin is the guardian itself, under whatever
+// host name or address the dashboard was opened with
+func sameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return strings.EqualFold(u.Scheme, scheme) && strings.EqualFold(u.Host, r.Host)
+}
+
+// CORSHandler wraps the whole router so preflight requests are answered
+// before routing and authentication. Requests from origins that aren't
+// allowed are rejected outright, otherwise a page could still trigger
+// actions even if it can't read the response. The guardian's own dashboard
+// is always allowed
+func CORSHandler(p *OriginPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || sameOrigin(origin, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !p.Allowed(origin) {
+			log.WithFields(log.Fields{
+				"origin":      origin,
+				"remote_addr": r.RemoteAddr,
+				"endpoint":    r.URL.Path,
+			}).Info("Rejected request from disallowed origin")
+			ErrorHandler(w, r, "Forbidden", errors.New("origin "+origin+" is not allowed"), http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+		// Answer preflight requests here, mux wouldn't match them
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+package guardian_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	p := guardian.NewOriginPolicy([]string{"http://localhost:*", "http://[::1]:*", "https://manager.example.com", "file://"})
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"http://localhost:3000", true},
+		{"http://LOCALHOST:3000", true},
+		{"http://localhost", true}, // Any port includes the default one
+		{"https://localhost:3000", false},
+		{"http://localhost:abc", false},
+		{"http://[::1]:8080", true},
+		{"https://manager.example.com", true},
+		{"https://manager.example.com:8443", false},
+		{"https://evil.example.com", false},
+		{"file://", true},
+		{"null", false},
+	}
+	for _, test := range tests {
+		if got := p.Allowed(test.origin); got != test.allowed {
+			t.Errorf("%s: got allowed %t, want %t", test.origin, got, test.allowed)
+		}
+	}
+
+	p.Update([]string{"*"})
+	if !p.Allowed("https://evil.example.com") {
+		t.Error("* didn't allow every origin")
+	}
+	p.Update(nil)
+	if p.Allowed("http://localhost:3000") {
+		t.Error("an empty policy allowed an origin")
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	p := guardian.NewOriginPolicy([]string{"http://localhost:*"})
+	h := guardian.CORSHandler(p, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name, method, host, origin string
+		tls                        bool
+		want                       int
+		wantAllowOrigin            bool
+	}{
+		{"no origin", "POST", "10.0.0.5:7791", "", false, http.StatusOK, false},
+		{"allowed origin", "POST", "10.0.0.5:7791", "http://localhost:3000", false, http.StatusOK, true},
+		{"other origin", "POST", "10.0.0.5:7791", "https://evil.example.com", false, http.StatusForbidden, false},
+		{"dashboard by address", "POST", "10.0.0.5:7791", "http://10.0.0.5:7791", false, http.StatusOK, false},
+		{"dashboard by host name", "PUT", "node1.lan:7791", "http://Node1.lan:7791", false, http.StatusOK, false},
+		{"dashboard over TLS", "POST", "node1.lan:7791", "https://node1.lan:7791", true, http.StatusOK, false},
+		{"other port", "POST", "node1.lan:7791", "http://node1.lan:8080", false, http.StatusForbidden, false},
+		{"other scheme", "POST", "node1.lan:7791", "https://node1.lan:7791", false, http.StatusForbidden, false},
+		{"preflight", "OPTIONS", "10.0.0.5:7791", "http://localhost:3000", false, http.StatusNoContent, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/v2/services/edged/start", nil)
+		r.Host = test.host
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin") != ""; got != test.wantAllowOrigin {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q", test.name, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+
+	// The log WebSockets check the same way
+	r := httptest.NewRequest("GET", "/service/ws/logs/edged", nil)
+	r.Host = "node1.lan:7791"
+	r.Header.Set("Origin", "http://node1.lan:7791")
+	if !p.CheckOrigin(r) {
+		t.Error("a WebSocket from the dashboard was refused")
+	}
+	r.Header.Set("Origin", "https://evil.example.com")
+	if p.CheckOrigin(r) {
+		t.Error("a WebSocket from another origin was allowed")
+	}
+}
@@ -0,0 +1,64 @@
+package guardian_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2019, time.January, 16, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2019, time.January, 16, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2019, time.January, 16, 10, 15, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2019, time.January, 16, 10, 25, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2019, time.January, 17, 2, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2019, time.January, 16, 13, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2019, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2019, time.January, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2019, time.January, 18, 0, 0, 0, 0, time.UTC)}, // Either day matches
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2019, time.January, 16, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2019, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2019, time.January, 16, 10, 9, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		s, err := guardian.ParseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(test.want) {
+			t.Errorf("%q: got %s, want %s", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@every soon",
+		"@every 10ms",
+		"@sometimes",
+	} {
+		if _, err := guardian.ParseSchedule(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package guardian
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var dashboardAssets = map[string]struct {
+	contentType string
+	body        string
+}{
+	"app.js":  {"application/javascript; charset=utf-8", dashboardJS},
+	"app.css": {"text/css; charset=utf-8", dashboardCSS},
+}
+
+// DashboardAssetHandler - Serve the scripts and styles of the dashboard
+func DashboardAssetHandler(w http.ResponseWriter, r *http.Request) {
+	asset, ok := dashboardAssets[mux.Vars(r)["asset"]]
+	if !ok {
+		ErrorHandler(w, r, "No such asset", nil, http.StatusNotFound)
+		return
+	}
+	setDashboardHeaders(w, r)
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Write([]byte(asset.body))
+}
+
+// serveDashboard writes the dashboard page
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	setDashboardHeaders(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+// setDashboardHeaders only lets the page load its own assets and talk to the
+// guardian that served it
+func setDashboardHeaders(w http.ResponseWriter, r *http.Request) {
+	connect := "'self'"
+	if !strings.ContainsAny(r.Host, " ;,'\"") {
+		connect += " ws://" + r.Host + " wss://" + r.Host
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; connect-src "+connect+"; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+}
+
+// wantsHTML is true for browsers navigating to a page
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
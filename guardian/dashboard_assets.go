@@ -0,0 +1,431 @@
+package guardian
+
+// The dashboard is kept in the binary so it works on a node with nothing else
+// installed. It only uses the public API, with the token from the page
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Gladius Guardian</title>
+<link rel="stylesheet" href="/dashboard/app.css">
+</head>
+<body>
+<header>
+    <h1>Gladius Guardian <span id="guardian-version"></span></h1>
+    <span id="connection" class="badge">connecting</span>
+    <form id="login" hidden>
+        <input type="password" id="token" placeholder="API token" autocomplete="off">
+        <button type="submit">Use token</button>
+    </form>
+</header>
+
+<main>
+    <section>
+        <h2>Services</h2>
+        <table id="services">
+            <thead>
+                <tr><th>Name</th><th>State</th><th>PID</th><th>Uptime</th><th>Restarts</th><th>CPU time</th><th>Memory</th><th>Last exit</th><th></th></tr>
+            </thead>
+            <tbody></tbody>
+        </table>
+        <p id="message"></p>
+    </section>
+
+    <section class="columns">
+        <div>
+            <h2>Versions</h2>
+            <table id="versions"><tbody><tr><td>Checking...</td></tr></tbody></table>
+        </div>
+        <div>
+            <h2>Activity</h2>
+            <ul id="events"></ul>
+        </div>
+    </section>
+
+    <section>
+        <h2>Logs</h2>
+        <div class="toolbar">
+            <select id="log-service"></select>
+            <input type="search" id="log-filter" placeholder="Filter">
+            <label><input type="checkbox" id="log-regex"> Regex</label>
+            <label><input type="checkbox" id="log-pause"> Pause</label>
+            <span id="log-count"></span>
+        </div>
+        <pre id="log"></pre>
+    </section>
+</main>
+<script src="/dashboard/app.js"></script>
+</body>
+</html>
+`
+
+const dashboardCSS = `* { box-sizing: border-box; }
+body { margin: 0; font: 14px/1.4 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #222; background: #f4f5f7; }
+header { display: flex; align-items: center; gap: 1em; padding: 0.6em 1.2em; background: #1f2633; color: #fff; }
+header h1 { font-size: 1.2em; margin: 0; flex: 1; }
+header h1 span { font-weight: normal; opacity: 0.7; font-size: 0.8em; }
+main { padding: 1em 1.2em; }
+section { background: #fff; border-radius: 4px; padding: 0.8em 1em; margin-bottom: 1em; box-shadow: 0 1px 2px rgba(0, 0, 0, 0.1); }
+h2 { font-size: 1em; margin: 0 0 0.6em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.35em 0.6em; border-bottom: 1px solid #eee; white-space: nowrap; }
+td.exit { white-space: normal; color: #a33; }
+button { cursor: pointer; margin-right: 0.3em; }
+.badge { padding: 0.15em 0.6em; border-radius: 1em; font-size: 0.85em; background: #666; }
+.badge.ok, .state.running { background: #2e7d32; color: #fff; }
+.badge.error, .state.exited { background: #c62828; color: #fff; }
+.state { padding: 0.1em 0.5em; border-radius: 3px; background: #ddd; }
+.columns { display: flex; gap: 2em; }
+.columns > div { flex: 1; min-width: 0; }
+#events { list-style: none; margin: 0; padding: 0; max-height: 14em; overflow: auto; font-size: 0.9em; }
+#events li { padding: 0.2em 0; border-bottom: 1px solid #f0f0f0; }
+#events time { color: #888; margin-right: 0.5em; }
+#message { min-height: 1.4em; margin: 0.5em 0 0; color: #555; }
+#message.error { color: #c62828; }
+.toolbar { display: flex; gap: 0.8em; align-items: center; margin-bottom: 0.5em; }
+#log-filter { flex: 1; }
+#log-count { color: #888; }
+#log { height: 26em; overflow: auto; margin: 0; padding: 0.5em; background: #111; color: #ddd; font: 12px/1.4 Menlo, Consolas, monospace; white-space: pre-wrap; word-break: break-all; }
+.update { color: #c62828; font-weight: bold; }
+`
+
+const dashboardJS = `(function () {
+    "use strict";
+
+    var maxLogLines = 2000;
+    var token = sessionStorage.getItem("guardianToken") || "";
+    var services = [];
+    var logLines = [];
+    var logSocket = null;
+    var eventSocket = null;
+    var lastEventID = 0;
+
+    function $(id) {
+        return document.getElementById(id);
+    }
+
+    function el(tag, text, className) {
+        var e = document.createElement(tag);
+        if (text !== undefined) {
+            e.textContent = text;
+        }
+        if (className) {
+            e.className = className;
+        }
+        return e;
+    }
+
+    // api calls the guardian and resolves with the response field
+    function api(method, path, body) {
+        var headers = {};
+        if (token) {
+            headers["Authorization"] = "Bearer " + token;
+        }
+        if (body) {
+            headers["Content-Type"] = "application/json";
+        }
+        return fetch(path, {
+            method: method,
+            headers: headers,
+            body: body ? JSON.stringify(body) : undefined
+        }).then(function (res) {
+            if (res.status === 401) {
+                $("login").hidden = false;
+            }
+            return res.json().then(function (data) {
+                if (!res.ok || !data.success) {
+                    throw new Error(data.error || data.message || res.statusText);
+                }
+                return data.response;
+            });
+        });
+    }
+
+    // Browsers can't set headers on WebSockets, so the token goes in the URL
+    function socketURL(path) {
+        var url = (location.protocol === "https:" ? "wss://" : "ws://") + location.host + path;
+        if (token) {
+            url += (path.indexOf("?") < 0 ? "?" : "&") + "token=" + encodeURIComponent(token);
+        }
+        return url;
+    }
+
+    function showMessage(text, isError) {
+        $("message").textContent = text;
+        $("message").className = isError ? "error" : "";
+    }
+
+    function formatUptime(seconds) {
+        if (!seconds) {
+            return "-";
+        }
+        var d = Math.floor(seconds / 86400), h = Math.floor(seconds % 86400 / 3600), m = Math.floor(seconds % 3600 / 60);
+        if (d > 0) {
+            return d + "d " + h + "h";
+        }
+        if (h > 0) {
+            return h + "h " + m + "m";
+        }
+        return m + "m " + (seconds % 60) + "s";
+    }
+
+    function formatBytes(b) {
+        if (!b) {
+            return "-";
+        }
+        var units = ["B", "KiB", "MiB", "GiB"], i = 0;
+        while (b >= 1024 && i < units.length - 1) {
+            b /= 1024;
+            i++;
+        }
+        return b.toFixed(i ? 1 : 0) + " " + units[i];
+    }
+
+    // Services
+
+    function loadServices() {
+        return api("GET", "/v2/services").then(function (list) {
+            services = list;
+            renderServices();
+            updateLogServices();
+        }).catch(function (err) {
+            showMessage("Couldn't load services: " + err.message, true);
+        });
+    }
+
+    function renderServices() {
+        var body = $("services").tBodies[0];
+        body.innerHTML = "";
+        services.forEach(function (s) {
+            var tr = el("tr");
+            var state = s.running ? "running" : (s.last_exit ? "exited" : "stopped");
+            tr.appendChild(el("td", s.name));
+            var stateCell = el("td");
+            stateCell.appendChild(el("span", state, "state " + state));
+            tr.appendChild(stateCell);
+            tr.appendChild(el("td", s.running ? String(s.pid) : "-"));
+            tr.appendChild(el("td", s.running ? formatUptime(s.uptime_seconds) : "-"));
+            tr.appendChild(el("td", String(s.restarts || 0)));
+            tr.appendChild(el("td", s.cpu_seconds ? s.cpu_seconds.toFixed(1) + "s" : "-"));
+            tr.appendChild(el("td", formatBytes(s.memory_rss_bytes)));
+            tr.appendChild(el("td", s.last_exit || "", "exit"));
+
+            var actions = el("td");
+            ["start", "stop", "restart"].forEach(function (action) {
+                var b = el("button", action);
+                b.disabled = (action === "start" && s.running) || (action === "stop" && !s.running);
+                b.onclick = function () {
+                    act(s.name, action);
+                };
+                actions.appendChild(b);
+            });
+            tr.appendChild(actions);
+            body.appendChild(tr);
+        });
+    }
+
+    // act starts an operation, its result arrives on the event stream
+    function act(name, action) {
+        showMessage(action + " of " + name + " requested...");
+        api("POST", "/v2/services/" + encodeURIComponent(name) + "/" + action + "?async=true").catch(function (err) {
+            showMessage(action + " of " + name + " failed: " + err.message, true);
+        });
+    }
+
+    // Events
+
+    function connectEvents() {
+        var path = "/service/ws/events" + (lastEventID ? "?since=" + lastEventID : "");
+        eventSocket = new WebSocket(socketURL(path));
+        eventSocket.onopen = function () {
+            $("connection").textContent = "live";
+            $("connection").className = "badge ok";
+        };
+        eventSocket.onclose = function () {
+            $("connection").textContent = "disconnected";
+            $("connection").className = "badge error";
+            setTimeout(connectEvents, 3000);
+        };
+        eventSocket.onmessage = function (msg) {
+            var e = JSON.parse(msg.data);
+            lastEventID = e.id;
+            addEvent(e);
+
+            if (e.type === "operation") {
+                var op = e.data;
+                if (op.status === "succeeded") {
+                    showMessage(op.action + " of " + op.service + " succeeded");
+                } else if (op.status === "failed") {
+                    showMessage(op.action + " of " + op.service + " failed: " + op.error, true);
+                }
+                if (op.status !== "succeeded" && op.status !== "failed") {
+                    return;
+                }
+            }
+            loadServices();
+        };
+    }
+
+    function addEvent(e) {
+        var li = el("li");
+        li.appendChild(el("time", new Date(e.time).toLocaleTimeString()));
+        li.appendChild(document.createTextNode(e.message));
+        var list = $("events");
+        list.insertBefore(li, list.firstChild);
+        while (list.children.length > 100) {
+            list.removeChild(list.lastChild);
+        }
+    }
+
+    // Versions
+
+    function loadVersions() {
+        api("GET", "/version").then(function (v) {
+            $("guardian-version").textContent = "v" + v.version;
+        }).catch(function () {});
+
+        var body = $("versions").tBodies[0];
+        api("GET", "/service/version/all").then(function (versions) {
+            body.innerHTML = "";
+            Object.keys(versions).sort().forEach(function (name) {
+                var tr = el("tr");
+                tr.appendChild(el("td", name));
+                var status = versions[name];
+                if (status < 0) {
+                    tr.appendChild(el("td", "update available", "update"));
+                } else if (status > 0) {
+                    tr.appendChild(el("td", "newer than the release"));
+                } else {
+                    tr.appendChild(el("td", "up to date"));
+                }
+                body.appendChild(tr);
+            });
+        }).catch(function (err) {
+            body.innerHTML = "";
+            var tr = el("tr");
+            tr.appendChild(el("td", "Couldn't check versions: " + err.message));
+            body.appendChild(tr);
+        });
+    }
+
+    // Logs
+
+    function updateLogServices() {
+        var select = $("log-service");
+        var current = select.value;
+        var names = services.map(function (s) {
+            return s.name;
+        });
+        if (select.options.length === names.length) {
+            return;
+        }
+        select.innerHTML = "";
+        names.forEach(function (name) {
+            select.appendChild(el("option", name));
+        });
+        select.value = names.indexOf(current) >= 0 ? current : names[0];
+        followLog();
+    }
+
+    function followLog() {
+        var name = $("log-service").value;
+        if (logSocket) {
+            logSocket.onclose = null;
+            logSocket.close();
+        }
+        logLines = [];
+        if (!name) {
+            renderLog();
+            return;
+        }
+
+        // Connect first so no lines are lost between the two requests
+        logSocket = new WebSocket(socketURL("/service/ws/logs/" + encodeURIComponent(name)));
+        logSocket.onmessage = function (msg) {
+            addLogLine(msg.data);
+        };
+        api("GET", "/v2/services/" + encodeURIComponent(name) + "/logs?lines=500").then(function (lines) {
+            logLines = lines.concat(logLines);
+            renderLog();
+        }).catch(function (err) {
+            addLogLine("Couldn't load the log: " + err.message);
+        });
+    }
+
+    function addLogLine(line) {
+        logLines.push(line);
+        if (logLines.length > maxLogLines) {
+            logLines.splice(0, logLines.length - maxLogLines);
+        }
+        if (!$("log-pause").checked) {
+            renderLog();
+        }
+    }
+
+    function logMatcher() {
+        var filter = $("log-filter").value;
+        if (!filter) {
+            return function () {
+                return true;
+            };
+        }
+        if ($("log-regex").checked) {
+            try {
+                var re = new RegExp(filter, "i");
+                return function (line) {
+                    return re.test(line);
+                };
+            } catch (err) {
+                return function () {
+                    return false;
+                };
+            }
+        }
+        filter = filter.toLowerCase();
+        return function (line) {
+            return line.toLowerCase().indexOf(filter) >= 0;
+        };
+    }
+
+    function renderLog() {
+        var log = $("log");
+        var atBottom = log.scrollTop >= log.scrollHeight - log.clientHeight - 2;
+        var shown = logLines.filter(logMatcher());
+        log.textContent = shown.join("\n");
+        $("log-count").textContent = shown.length + " of " + logLines.length + " lines";
+        if (atBottom) {
+            log.scrollTop = log.scrollHeight;
+        }
+    }
+
+    // Setup
+
+    $("login").onsubmit = function (e) {
+        e.preventDefault();
+        token = $("token").value;
+        sessionStorage.setItem("guardianToken", token);
+        $("login").hidden = true;
+        if (eventSocket) {
+            eventSocket.onclose = null;
+            eventSocket.close();
+        }
+        start();
+    };
+    $("log-service").onchange = followLog;
+    $("log-filter").oninput = renderLog;
+    $("log-regex").onchange = renderLog;
+    $("log-pause").onchange = renderLog;
+
+    function start() {
+        loadServices();
+        loadVersions();
+        connectEvents();
+        followLog();
+    }
+
+    start();
+    setInterval(loadServices, 5000); // For uptime and memory
+})();
+`
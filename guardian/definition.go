@@ -0,0 +1,298 @@
+package guardian
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Where a service was registered from
+const (
+	SourceBuiltin = "builtin" // Registered in main.go
+	SourceConfig  = "config"  // The Services section of the config
+	SourceAPI     = "api"     // POST /service/register
+)
+
+var serviceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ServiceDefinition describes a supervised program. Services in the Services
+// section of the config and ones registered through the API have the same
+// fields
+type ServiceDefinition struct {
+	Name            string          `json:"name" description:"Letters, digits, _, . and -"`
+	Executable      string          `json:"executable" description:"Path of the program, or a name looked up in PATH"`
+	Args            []string        `json:"args,omitempty" description:"Command line arguments"`
+	EnvironmentVars []string        `json:"environment_vars,omitempty" description:"KEY=VALUE pairs added to the default environment, a VALUE of @file:path or @secret:name is read when the service starts"`
+	Instances       int             `json:"instances,omitempty" description:"How many processes to run, 1 if left out. Templates can use {{.Instance}} to tell them apart"`
+	PreStart        *HookDefinition `json:"pre_start,omitempty" description:"Run before each instance starts, the start fails if it does"`
+	PostStop        *HookDefinition `json:"post_stop,omitempty" description:"Run after each instance stops or exits"`
+}
+
+// Validate checks the name, executable, args, environment, instances and
+// hooks
+func (def *ServiceDefinition) Validate() []FieldError {
+	var errs []FieldError
+	switch {
+	case def.Name == "all":
+		errs = append(errs, FieldError{Field: "name", Message: "all is reserved"})
+	case !serviceNamePattern.MatchString(def.Name):
+		errs = append(errs, FieldError{Field: "name", Message: "must be letters, digits, _, . and -"})
+	}
+	if def.Executable == "" {
+		errs = append(errs, FieldError{Field: "executable", Message: "is required"})
+	}
+	if def.Instances != 0 {
+		errs = append(errs, validateInstances("instances", def.Instances)...)
+	}
+	if def.PreStart != nil {
+		errs = append(errs, def.PreStart.Validate("pre_start")...)
+	}
+	if def.PostStop != nil {
+		errs = append(errs, def.PostStop.Validate("post_stop")...)
+	}
+	errs = append(errs, ValidateTemplates("args", def.Args)...)
+	return append(errs, ValidateEnv("environment_vars", def.EnvironmentVars)...)
+}
+
+// RegisterRequest is the body of POST /service/register
+type RegisterRequest struct {
+	Name            string          `json:"name" description:"Letters, digits, _, . and -"`
+	Executable      string          `json:"executable" description:"Path of the program, or a name looked up in PATH"`
+	Args            []string        `json:"args,omitempty" description:"Command line arguments"`
+	EnvironmentVars []string        `json:"environment_vars,omitempty" description:"KEY=VALUE pairs added to the default environment, a VALUE of @file:path or @secret:name is read when the service starts"`
+	Instances       int             `json:"instances,omitempty" description:"How many processes to run, 1 if left out. Templates can use {{.Instance}} to tell them apart"`
+	PreStart        *HookDefinition `json:"pre_start,omitempty" description:"Run before each instance starts, the start fails if it does"`
+	PostStop        *HookDefinition `json:"post_stop,omitempty" description:"Run after each instance stops or exits"`
+	Persist         bool            `json:"persist,omitempty" description:"Save it to the services file so it's registered again when the guardian restarts"`
+}
+
+// Validate checks the service definition
+func (req *RegisterRequest) Validate() []FieldError {
+	return req.definition().Validate()
+}
+
+func (req *RegisterRequest) definition() *ServiceDefinition {
+	return &ServiceDefinition{
+		Name:            req.Name,
+		Executable:      req.Executable,
+		Args:            req.Args,
+		EnvironmentVars: req.EnvironmentVars,
+		Instances:       req.Instances,
+		PreStart:        req.PreStart,
+		PostStop:        req.PostStop,
+	}
+}
+
+// servicesFile keeps the services registered through the API with persist
+// set, so they're registered again when the guardian starts
+type servicesFile struct {
+	Services []*ServiceDefinition `json:"services"`
+}
+
+var servicesFileMux sync.Mutex
+
+// LoadPersistedServices - Register the services saved in the file at path,
+// and save services registered with persist there from now on
+func (gg *GladiusGuardian) LoadPersistedServices(path string) error {
+	gg.mux.Lock()
+	gg.servicesFile = path
+	gg.mux.Unlock()
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f := &servicesFile{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return err
+	}
+
+	for _, def := range f.Services {
+		if errs := def.Validate(); len(errs) > 0 {
+			log.WithFields(log.Fields{
+				"service_name": def.Name,
+				"err":          errs[0].Field + " " + errs[0].Message,
+			}).Warn("Skipping invalid saved service")
+			continue
+		}
+		if err := gg.Register(def, SourceAPI, true); err != nil {
+			log.WithFields(log.Fields{
+				"service_name": def.Name,
+				"err":          err,
+			}).Warn("Skipping saved service")
+		}
+	}
+	return nil
+}
+
+// savePersistedServices writes every service registered with persist to the
+// services file
+func (gg *GladiusGuardian) savePersistedServices() error {
+	servicesFileMux.Lock()
+	defer servicesFileMux.Unlock()
+
+	gg.mux.Lock()
+	path := gg.servicesFile
+	f := &servicesFile{Services: make([]*ServiceDefinition, 0)}
+	for name, settings := range gg.registeredServices {
+		if settings.source != SourceAPI || !settings.persist {
+			continue
+		}
+		f.Services = append(f.Services, &ServiceDefinition{
+			Name:            name,
+			Executable:      settings.execName,
+			Args:            settings.args,
+			EnvironmentVars: settings.env,
+			Instances:       settings.instances,
+			PreStart:        settings.preStart,
+			PostStop:        settings.postStop,
+		})
+	}
+	gg.mux.Unlock()
+
+	if path == "" {
+		return nil
+	}
+	sort.Slice(f.Services, func(i, j int) bool { return f.Services[i].Name < f.Services[j].Name })
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(b, '\n'), 0600)
+}
+
+// SyncConfigServices - Register the services from the config, and remove
+// ones that were taken out of it unless they're running
+func (gg *GladiusGuardian) SyncConfigServices(defs []*ServiceDefinition) {
+	wanted := make(map[string]bool)
+	for _, def := range defs {
+		wanted[def.Name] = true
+		if err := gg.Register(def, SourceConfig, false); err != nil {
+			log.WithFields(log.Fields{
+				"service_name": def.Name,
+				"err":          err,
+			}).Warn("Couldn't register service from the config")
+		}
+	}
+
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+	for name, settings := range gg.registeredServices {
+		if settings.source != SourceConfig || wanted[name] {
+			continue
+		}
+		if err := gg.removeService(name); err != nil {
+			settings.removed = true
+			log.WithFields(log.Fields{
+				"service_name": name,
+			}).Warn("Service was taken out of the config but is still running, it will be removed once it stops")
+		}
+	}
+}
+
+// UnregisterService - Remove a service registered through the API, a running
+// one is stopped first if stop is set
+func (gg *GladiusGuardian) UnregisterService(name string, stop bool) error {
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
+	if !ok {
+		gg.mux.Unlock()
+		return &ServiceError{Service: name, Err: ErrServiceNotFound}
+	}
+	if settings.source != SourceAPI {
+		gg.mux.Unlock()
+		return &ServiceError{Service: name, Err: ErrServiceFixed}
+	}
+	if stop && gg.running(name) {
+		if err := gg.stopServiceInternal(name, 0); err != nil {
+			gg.mux.Unlock()
+			return err
+		}
+	}
+	err := gg.removeService(name)
+	gg.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if settings.persist {
+		return gg.savePersistedServices()
+	}
+	return nil
+}
+
+// removeService forgets a stopped service, the lock must be held
+func (gg *GladiusGuardian) removeService(name string) error {
+	if gg.running(name) {
+		return &ServiceError{Service: name, Err: ErrServiceRunning}
+	}
+
+	for _, conn := range gg.serviceWebSockets[name] {
+		conn.Close()
+	}
+	delete(gg.registeredServices, name)
+	delete(gg.instances, name)
+	delete(gg.serviceLogs, name)
+	delete(gg.serviceWebSockets, name)
+	if m := gg.maintenance[name]; m != nil {
+		gg.clearMaintenance(name, m, "cleared")
+	}
+	gg.events.Publish(EventServiceRemoved, name, "Removed "+name, nil)
+	return nil
+}
+
+// RegisterServiceHandler - Add a service at runtime
+func RegisterServiceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &RegisterRequest{}
+		if err := decodeJSONBody(w, r, req); err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+
+		if err := gg.Register(req.definition(), SourceAPI, req.Persist); err != nil {
+			ErrorHandler(w, r, "Couldn't register service", err, ServiceErrorStatus(err))
+			return
+		}
+		if req.Persist {
+			if err := gg.savePersistedServices(); err != nil {
+				ErrorHandler(w, r, "Registered service but couldn't save it", err, http.StatusInternalServerError)
+				return
+			}
+		}
+		gg.events.Publish(EventServiceRegistered, req.Name, "Registered "+req.Name, req.definition())
+
+		status, err := gg.GetServiceStatus(req.Name)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't get service", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Registered service", true, nil, status)
+	}
+}
+
+// UnregisterServiceHandler - Remove a service registered through the API,
+// with ?stop=true to stop it first if it's running
+func UnregisterServiceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["service_name"]
+		stop, _ := strconv.ParseBool(r.URL.Query().Get("stop"))
+		if err := gg.UnregisterService(name, stop); err != nil {
+			ErrorHandler(w, r, "Couldn't remove service", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Removed service", true, nil, nil)
+	}
+}
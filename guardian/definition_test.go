@@ -0,0 +1,119 @@
+package guardian_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+)
+
+// savedServices is the names in the services file at path
+func savedServices(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := struct {
+		Services []*guardian.ServiceDefinition `json:"services"`
+	}{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, def := range f.Services {
+		names = append(names, def.Name)
+	}
+	return names
+}
+
+func TestRegisterPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	gg := guardian.New()
+	gg.RegisterService("edged", "edged", nil, 1)
+	if err := gg.LoadPersistedServices(path); err != nil {
+		t.Fatalf("loading a services file that doesn't exist yet: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"saved", `{"name": "saved", "executable": "sleep", "args": ["60"], "persist": true}`, http.StatusOK},
+		{"not saved", `{"name": "temporary", "executable": "sleep"}`, http.StatusOK},
+		{"taken name", `{"name": "edged", "executable": "sleep", "persist": true}`, http.StatusConflict},
+		{"invalid", `{"name": "all", "executable": "sleep", "persist": true}`, http.StatusBadRequest},
+	}
+	h := guardian.RegisterServiceHandler(gg)
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/service/register", strings.NewReader(test.body)))
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+	if got := savedServices(t, path); !reflect.DeepEqual(got, []string{"saved"}) {
+		t.Fatalf("saved %v, want just the service registered with persist", got)
+	}
+
+	// A new guardian registers it again, and can't have it registered twice
+	restarted := guardian.New()
+	if err := restarted.LoadPersistedServices(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.ServiceNames(); !reflect.DeepEqual(got, []string{"saved"}) {
+		t.Errorf("registered %v after a restart, want [saved]", got)
+	}
+	if err := restarted.Register(&guardian.ServiceDefinition{Name: "saved", Executable: "sleep"}, guardian.SourceAPI, true); !errors.Is(err, guardian.ErrServiceExists) {
+		t.Errorf("registering a saved service again: got %v", err)
+	}
+
+	// Removing it takes it out of the file, and only API services can go
+	if err := restarted.UnregisterService("saved", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := savedServices(t, path); len(got) != 0 {
+		t.Errorf("saved %v after removing the service", got)
+	}
+	if err := gg.UnregisterService("edged", false); !errors.Is(err, guardian.ErrServiceFixed) {
+		t.Errorf("removing a built in service: got %v", err)
+	}
+}
+
+func TestLoadPersistedServices(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", `{"services": []}`, []string{}, false},
+		{"valid", `{"services": [{"name": "a", "executable": "sleep"}, {"name": "b", "executable": "sleep", "instances": 2}]}`, []string{"a", "b"}, false},
+		{"invalid ones are skipped", `{"services": [{"name": "a", "executable": "sleep"}, {"name": "all", "executable": "sleep"}, {"name": "b"}]}`, []string{"a"}, false},
+		{"duplicates are skipped", `{"services": [{"name": "a", "executable": "sleep"}, {"name": "a", "executable": "true"}]}`, []string{"a"}, false},
+		{"broken", `{"services": [`, []string{}, true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "services.json")
+		if err := ioutil.WriteFile(path, []byte(test.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		gg := guardian.New()
+		err := gg.LoadPersistedServices(path)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if got := gg.ServiceNames(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: registered %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package guardian
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/updater"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// Actions a plan step can take
+const (
+	PlanStart   = "start"
+	PlanStop    = "stop"
+	PlanRestart = "restart"
+	PlanNone    = "none"
+)
+
+// DesiredStateRequest is the body of PUT /service/desired
+type DesiredStateRequest struct {
+	Services   map[string]*DesiredService `json:"services" required:"true" description:"Desired state of services by name, unlisted services are left alone unless stop_others is set"`
+	StopOthers bool                       `json:"stop_others,omitempty" description:"Stop running services that aren't listed"`
+	DryRun     bool                       `json:"dry_run,omitempty" description:"Only return the plan, the same as ?dry_run=true"`
+	Async      bool                       `json:"async,omitempty" description:"Answer with an operation straight away instead of waiting"`
+}
+
+// DesiredService is the desired state of one service
+type DesiredService struct {
+	Running         *bool    `json:"running,omitempty" description:"Whether the service should be running, true if left out"`
+	EnvironmentVars []string `json:"environment_vars,omitempty" description:"KEY=VALUE pairs added to the default environment"`
+	Args            []string `json:"args,omitempty" description:"Command line arguments, the registered ones if left out"`
+	Version         string   `json:"version,omitempty" description:"Version the service should report, checked but never installed"`
+}
+
+// Validate checks every listed service
+func (req *DesiredStateRequest) Validate() []FieldError {
+	var errs []FieldError
+	for _, name := range sortedKeys(req.Services) {
+		field := "services." + name
+		ds := req.Services[name]
+		if ds == nil {
+			errs = append(errs, FieldError{Field: field, Message: "must be an object"})
+			continue
+		}
+		if name == "all" || name == "" {
+			errs = append(errs, FieldError{Field: field, Message: "must name a single service"})
+		}
+		errs = append(errs, ValidateEnv(field+".environment_vars", ds.EnvironmentVars)...)
+	}
+	return errs
+}
+
+func (ds *DesiredService) running() bool {
+	return ds.Running == nil || *ds.Running
+}
+
+// PlanStep is what applying the desired state does to one service
+type PlanStep struct {
+	Service  string   `json:"service"`
+	Action   string   `json:"action" description:"start, stop, restart or none"`
+	Reasons  []string `json:"reasons,omitempty"`
+	Warnings []string `json:"warnings,omitempty" description:"Differences the guardian can't fix, like the version"`
+	Error    string   `json:"error,omitempty"`
+
+	permission Permission
+	env        []string
+	args       []string
+}
+
+// DesiredStateResult is the plan, and after applying it the new status of
+// the services
+type DesiredStateResult struct {
+	DryRun   bool                      `json:"dry_run"`
+	Plan     []*PlanStep               `json:"plan"`
+	Services map[string]*serviceStatus `json:"services,omitempty"`
+}
+
+// PlanDesiredState - Work out what has to change to get to the desired
+// state, unknown services are an error
+func (gg *GladiusGuardian) PlanDesiredState(req *DesiredStateRequest) ([]*PlanStep, error) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	var unknown []string
+	for _, name := range sortedKeys(req.Services) {
+		if _, ok := gg.registeredServices[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		fields := make([]FieldError, len(unknown))
+		for i, name := range unknown {
+			fields[i] = FieldError{Field: "services." + name, Message: "is not a registered service"}
+		}
+		return nil, &APIError{Code: CodeValidation, Message: "request body is invalid", Fields: fields}
+	}
+
+	names := make([]string, 0, len(gg.registeredServices))
+	for name := range gg.registeredServices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	steps := make([]*PlanStep, 0, len(names))
+	for _, name := range names {
+		running := gg.running(name)
+		ds, listed := req.Services[name]
+		step := &PlanStep{Service: name, Action: PlanNone}
+
+		switch {
+		case !listed && !req.StopOthers:
+			step.Reasons = append(step.Reasons, "not listed")
+		case !listed || !ds.running():
+			if running {
+				step.Action, step.permission = PlanStop, PermissionStop
+				step.Reasons = append(step.Reasons, "running but should be stopped")
+			}
+		case !running:
+			step.Action, step.permission = PlanStart, PermissionStart
+			step.Reasons = append(step.Reasons, "stopped but should be running")
+		default:
+			started := gg.instance(name, 0).started
+			env, args, err := gg.expand(name, 0, gg.environment(name, ds.EnvironmentVars), gg.desiredArgs(name, ds))
+			if err != nil {
+				step.Reasons = append(step.Reasons, err.Error())
+			} else {
+				step.Reasons = startedDifferently(started, env, args)
+			}
+			if len(step.Reasons) > 0 {
+				step.Action, step.permission = PlanRestart, PermissionRestart
+			}
+		}
+		if len(step.Reasons) == 0 {
+			step.Reasons = append(step.Reasons, "already as desired")
+		}
+
+		if listed && ds.running() {
+			step.env = ds.EnvironmentVars
+			step.args = gg.desiredArgs(name, ds)
+		}
+		steps = append(steps, step)
+	}
+
+	// Stop before starting so services don't overlap
+	sort.SliceStable(steps, func(i, j int) bool {
+		return planOrder(steps[i].Action) < planOrder(steps[j].Action)
+	})
+	return steps, nil
+}
+
+// desiredArgs are the requested args or the registered ones, the lock must
+// be held
+func (gg *GladiusGuardian) desiredArgs(name string, ds *DesiredService) []string {
+	if ds.Args != nil {
+		return ds.Args
+	}
+	return gg.registeredServices[name].args
+}
+
+// ApplyPlan - Take every step of the plan, carrying on past failures
+func (gg *GladiusGuardian) ApplyPlan(steps []*PlanStep, progress func(string)) error {
+	var result *multierror.Error
+	for _, step := range steps {
+		if step.Action == PlanNone {
+			continue
+		}
+		progress(step.Action + " " + step.Service)
+
+		var err error
+		switch step.Action {
+		case PlanStart:
+			err = gg.startInstances(step.Service, step.env, step.args, 0)
+		case PlanStop:
+			err = gg.StopService(step.Service, 0)
+		case PlanRestart:
+			err = gg.restartServiceInternal(step.Service, step.env, step.args, 0)
+		}
+		if err != nil {
+			step.Error = err.Error()
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// checkVersions adds a warning to the steps of running services that don't
+// report the desired version
+func checkVersions(gg *GladiusGuardian, req *DesiredStateRequest, steps []*PlanStep) {
+	for _, step := range steps {
+		ds, ok := req.Services[step.Service]
+		if !ok || ds.Version == "" || !ds.running() || step.Error != "" {
+			continue
+		}
+		if status, err := gg.GetServiceStatus(step.Service); err != nil || !status.Running {
+			continue
+		}
+
+		have, err := updater.GetVersion(step.Service)
+		if err != nil {
+			step.Warnings = append(step.Warnings, "couldn't get the running version: "+err.Error())
+			continue
+		}
+		if strings.TrimPrefix(have, "v") != strings.TrimPrefix(ds.Version, "v") {
+			step.Warnings = append(step.Warnings, fmt.Sprintf("running version %s but %s is desired, the guardian can't install versions", have, ds.Version))
+		}
+	}
+}
+
+// startedDifferently returns why a running service doesn't match the desired
+// env and args
+func startedDifferently(started *serviceSettings, env, args []string) []string {
+	if started == nil {
+		return []string{"unknown how it was started"}
+	}
+	var reasons []string
+	if !reflect.DeepEqual(started.env, env) {
+		reasons = append(reasons, "environment_vars changed")
+	}
+	if len(started.args) != 0 || len(args) != 0 {
+		if !reflect.DeepEqual(started.args, args) {
+			reasons = append(reasons, "args changed")
+		}
+	}
+	return reasons
+}
+
+func planOrder(action string) int {
+	switch action {
+	case PlanStop:
+		return 0
+	case PlanRestart:
+		return 1
+	case PlanStart:
+		return 2
+	}
+	return 3
+}
+
+func sortedKeys(m map[string]*DesiredService) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DesiredStateHandler - Compute the changes needed to reach the desired
+// state and make them, or only return them with dry_run. Every service that's
+// changed is subject to the limiter's cooldown
+func DesiredStateHandler(gg *GladiusGuardian, limiter *RateLimiter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &DesiredStateRequest{}
+		if err := decodeJSONBody(w, r, req); err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		dryRun = dryRun || req.DryRun
+
+		steps, err := gg.PlanDesiredState(req)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't plan desired state", err, http.StatusBadRequest)
+			return
+		}
+
+		if dryRun {
+			checkVersions(gg, req, steps)
+			ResponseHandler(w, r, "Planned desired state, nothing was changed", true, nil, &DesiredStateResult{DryRun: true, Plan: steps})
+			return
+		}
+
+		// The route only needs read, the real check is per service and step
+		if id := IdentityFromRequest(r); id != nil {
+			for _, step := range steps {
+				if step.Action == PlanNone {
+					continue
+				}
+				if err := id.Allowed(step.permission, step.Service); err != nil {
+					ErrorHandler(w, r, "Forbidden", err, http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+		release, ok := planCooldown(limiter, w, r, steps)
+		if !ok {
+			return
+		}
+
+		runOperation(gg, w, r, req.Async || wantsAsync(r), "apply", "all", func(progress func(string)) (interface{}, error) {
+			err := gg.ApplyPlan(steps, progress)
+			release()
+			checkVersions(gg, req, steps)
+			services, _ := gg.GetServicesStatus("all")
+			return &DesiredStateResult{Plan: steps, Services: services}, err
+		}, func(op *Operation) {
+			if op.err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				writeResponse(w, r, Response{
+					Message:  "Applied desired state with errors, see the plan",
+					Error:    op.Error,
+					Code:     CodeInternal,
+					Response: op.Result,
+					Endpoint: endpoint(r),
+				})
+				return
+			}
+			ResponseHandler(w, r, "Applied desired state", true, nil, op.Result)
+		})
+	}
+}
+
+// planCooldown takes the cooldown of every service the plan changes, or
+// answers with a 429 if one of them was changed too recently. The returned
+// func gives it back for the services whose step failed
+func planCooldown(limiter *RateLimiter, w http.ResponseWriter, r *http.Request, steps []*PlanStep) (func(), bool) {
+	if limiter == nil {
+		return func() {}, true
+	}
+	if _, cooldown := limiter.limits(); cooldown <= 0 {
+		return func() {}, true
+	}
+
+	var services []string
+	for _, step := range steps {
+		if step.Action != PlanNone {
+			services = append(services, step.Service)
+		}
+	}
+	ok, service, wait, previous := limiter.allowOperations(services, time.Now())
+	if !ok {
+		_, cooldown := limiter.limits()
+		tooManyRequests(w, r, fmt.Errorf("%s was changed less than %s ago", service, cooldown), wait)
+		return nil, false
+	}
+	return func() {
+		for _, step := range steps {
+			if step.Error != "" {
+				limiter.releaseOperation(step.Service, previous[step.Service])
+			}
+		}
+	}, true
+}
@@ -0,0 +1,216 @@
+package guardian
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types published on the event stream
+const (
+	EventServiceStarted    = "service_started"
+	EventServiceStopped    = "service_stopped"
+	EventServiceExited     = "service_exited"     // Exited without being stopped
+	EventServiceRegistered = "service_registered" // Registered through the API
+	EventServiceRemoved    = "service_removed"
+	EventServiceScaled     = "service_scaled"     // The number of instances changed
+	EventServiceRestarting = "service_restarting" // Its restart policy is restarting it, the data says why
+	EventJobStarted        = "job_started"
+	EventJobFinished       = "job_finished"    // Succeeded or failed, the run says which
+	EventJobSkipped        = "job_skipped"     // A scheduled run was due while the last one was still running
+	EventHookFailed        = "hook_failed"     // A pre-start or post-stop hook failed
+	EventMaintenanceOn     = "maintenance_on"  // Supervision of a service, or every service, is paused
+	EventMaintenanceOff    = "maintenance_off" // Cleared or expired
+	EventOperation         = "operation"       // An operation changed status
+	EventConfigReloaded    = "config_reloaded"
+	EventConfigRejected    = "config_rejected" // The config was invalid and not reloaded
+)
+
+// Event is something that happened in the guardian
+type Event struct {
+	ID      uint64      `json:"id"`
+	Time    time.Time   `json:"time"`
+	Type    string      `json:"type"`
+	Service string      `json:"service,omitempty"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// EventBus fans events out to subscribers and keeps the most recent ones so
+// clients can catch up
+type EventBus struct {
+	mux         sync.Mutex
+	nextID      uint64
+	recent      []*Event
+	maxRecent   int
+	subscribers map[chan *Event]struct{}
+}
+
+// NewEventBus returns an EventBus that remembers the last maxRecent events
+func NewEventBus(maxRecent int) *EventBus {
+	return &EventBus{
+		nextID:      1,
+		maxRecent:   maxRecent,
+		subscribers: make(map[chan *Event]struct{}),
+	}
+}
+
+// Publish sends an event to every subscriber, subscribers that aren't keeping
+// up miss events rather than blocking the guardian
+func (eb *EventBus) Publish(eventType, service, message string, data interface{}) *Event {
+	eb.mux.Lock()
+	defer eb.mux.Unlock()
+
+	e := &Event{
+		ID:      eb.nextID,
+		Time:    time.Now(),
+		Type:    eventType,
+		Service: service,
+		Message: message,
+		Data:    data,
+	}
+	eb.nextID++
+
+	eb.recent = append(eb.recent, e)
+	if len(eb.recent) > eb.maxRecent {
+		eb.recent = eb.recent[len(eb.recent)-eb.maxRecent:]
+	}
+
+	for ch := range eb.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"event":        eventType,
+		"service_name": service,
+	}).Debug(message)
+
+	return e
+}
+
+// Subscribe returns a channel receiving every new event, call Unsubscribe
+// when done with it
+func (eb *EventBus) Subscribe() chan *Event {
+	eb.mux.Lock()
+	defer eb.mux.Unlock()
+
+	ch := make(chan *Event, 100)
+	eb.subscribers[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe stops sending events to ch and closes it
+func (eb *EventBus) Unsubscribe(ch chan *Event) {
+	eb.mux.Lock()
+	defer eb.mux.Unlock()
+
+	if _, ok := eb.subscribers[ch]; ok {
+		delete(eb.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Since returns the remembered events with an ID greater than id
+func (eb *EventBus) Since(id uint64) []*Event {
+	eb.mux.Lock()
+	defer eb.mux.Unlock()
+
+	events := make([]*Event, 0)
+	for _, e := range eb.recent {
+		if e.ID > id {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// GetEventsHandler - Get recent events, after the since query parameter if
+// given
+func GetEventsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since, err := sinceParam(r)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse since, must be an event ID", err, http.StatusBadRequest)
+			return
+		}
+		ResponseHandler(w, r, "Got events", true, nil, gg.events.Since(since))
+	}
+}
+
+// GetEventsWebSocketHandler - Stream events as JSON messages, events after
+// the since query parameter are sent first
+func GetEventsWebSocketHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since, err := sinceParam(r)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse since, must be an event ID", err, http.StatusBadRequest)
+			return
+		}
+
+		u := upgrader
+		u.CheckOrigin = gg.originPolicy.CheckOrigin
+		conn, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			log.Warn(err)
+			return
+		}
+		defer conn.Close()
+
+		// Subscribe before catching up so nothing is missed in between
+		ch := gg.events.Subscribe()
+		defer gg.events.Unsubscribe(ch)
+
+		// We don't expect messages, but reading notices when the client goes
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		last := since
+		if since > 0 {
+			for _, e := range gg.events.Since(since) {
+				if err := conn.WriteJSON(e); err != nil {
+					return
+				}
+				last = e.ID
+			}
+		}
+
+		for {
+			select {
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				if e.ID <= last {
+					continue // Already sent while catching up
+				}
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if err := conn.WriteJSON(e); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}
+}
+
+func sinceParam(r *http.Request) (uint64, error) {
+	s := r.URL.Query().Get("since")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
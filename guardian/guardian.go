@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,77 +13,274 @@ import (
 	"github.com/gorilla/websocket"
 	multierror "github.com/hashicorp/go-multierror"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true }, // So we can run locally
 }
 
-// New returns a new GladiusGuardian object with the specified spawn timeout
+// New returns a new GladiusGuardian object
 func New() *GladiusGuardian {
+	events := NewEventBus(1000)
 	return &GladiusGuardian{
 		mux:                &sync.Mutex{},
 		registeredServices: make(map[string]*serviceSettings),
-		services:           make(map[string]*exec.Cmd),
+		instances:          make(map[string][]*instance),
+		timeouts:           make(map[string]*timeoutOverride),
+		jobs:               make(map[string]*job),
+		restartPolicies:    make(map[string]*restartPolicy),
+		maintenance:        make(map[string]*maintenance),
 		serviceLogs:        make(map[string]*FixedSizeLog),
 		serviceWebSockets:  make(map[string][]*websocket.Conn),
+		originPolicy:       NewOriginPolicy(nil), // No browser origins until main sets the configured ones
+		events:             events,
+		operations:         newOperationStore(events, 100),
 	}
 }
 
 // GladiusGuardian manages the various gladius processes
 type GladiusGuardian struct {
 	mux                *sync.Mutex
-	spawnTimeout       *time.Duration
 	registeredServices map[string]*serviceSettings
-	services           map[string]*exec.Cmd
-	serviceLogs        map[string]*FixedSizeLog
+	instances          map[string][]*instance      // The processes of each service
+	timeouts           map[string]*timeoutOverride // Set through the API, "" for every service
+	jobs               map[string]*job
+	restartPolicies    map[string]*restartPolicy // From the Restarts section of the config
+	maintenance        map[string]*maintenance   // By service, "" for every service
+	serviceLogs        map[string]*FixedSizeLog  // Lines from every instance
 	serviceWebSockets  map[string][]*websocket.Conn
+	servicesFile       string // Where services registered with persist are saved
+	secrets            *SecretStore
+	templateValues     *templateValues
+	logForwarder       LogForwarder
+	originPolicy       *OriginPolicy
+	events             *EventBus
+	operations         *operationStore
+	auditLog           *AuditLog // Where operations answered with 202 record how they ended
+}
+
+// LogForwarder receives every line captured from a service so it can be
+// shipped somewhere outside of the guardian
+type LogForwarder interface {
+	Forward(serviceName, line string)
 }
 
 type serviceSettings struct {
-	env      []string
-	execName string
+	env       []string
+	args      []string
+	execName  string
+	instances int             // How many processes to run
+	preStart  *HookDefinition // Run before each instance starts
+	postStop  *HookDefinition // Run after each instance stops
+	source    string          // builtin, config or api
+	persist   bool            // Saved to the services file
+	removed   bool            // Taken out of the config while running, removed once stopped
+}
+
+// Errors for operations on services, use ServiceErrorStatus to get the HTTP
+// status code for them
+var (
+	ErrServiceNotFound = errors.New("service is not registered")
+	ErrServiceRunning  = errors.New("service is already running")
+	ErrServiceStopped  = errors.New("service is not running")
+	ErrServiceExists   = errors.New("a service with that name is already registered")
+	ErrServiceFixed    = errors.New("service wasn't registered through the API")
+)
+
+// ServiceError is an error from an operation on a service
+type ServiceError struct {
+	Service string
+	Err     error
+}
+
+func (e *ServiceError) Error() string {
+	return e.Service + ": " + e.Err.Error()
+}
+
+func (e *ServiceError) Unwrap() error {
+	return e.Err
+}
+
+// ServiceErrorStatus returns the HTTP status code for an error from starting,
+// stopping or getting a service. Errors from several services only get a
+// status other than 500 if they all agree on it
+func ServiceErrorStatus(err error) int {
+	var merr *multierror.Error
+	if errors.As(err, &merr) && len(merr.Errors) > 0 {
+		status := ServiceErrorStatus(merr.Errors[0])
+		for _, e := range merr.Errors[1:] {
+			if ServiceErrorStatus(e) != status {
+				return http.StatusInternalServerError
+			}
+		}
+		return status
+	}
+
+	for _, target := range []error{ErrServiceNotFound, ErrNoInstance, ErrJobNotFound} {
+		if errors.Is(err, target) {
+			return http.StatusNotFound
+		}
+	}
+	for _, target := range []error{ErrServiceRunning, ErrServiceStopped, ErrServiceExists, ErrServiceFixed, ErrJobRunning} {
+		if errors.Is(err, target) {
+			return http.StatusConflict
+		}
+	}
+	return http.StatusInternalServerError
 }
 
 type serviceStatus struct {
-	Running  bool     `json:"running"`
-	PID      int      `json:"pid"`
-	Env      []string `json:"environment_vars"`
-	Location string   `json:"executable_location"`
+	Name          string            `json:"name"`
+	Running       bool              `json:"running" description:"Whether any instance is running"`
+	PID           int               `json:"pid" description:"Process ID of the first running instance"`
+	Env           []string          `json:"environment_vars"`
+	Args          []string          `json:"args,omitempty"`
+	Location      string            `json:"executable_location"`
+	Source        string            `json:"source" description:"Where it was registered from: builtin, config or api"`
+	StartedAt     *time.Time        `json:"started_at,omitempty"`
+	UptimeSeconds int64             `json:"uptime_seconds,omitempty"`
+	Restarts      int               `json:"restarts" description:"Times instances were started again after their first start"`
+	LastExit      string            `json:"last_exit,omitempty" description:"Why the first instance that did last exited without being stopped"`
+	CPUSeconds    float64           `json:"cpu_seconds,omitempty" description:"CPU time used by every instance, Linux only"`
+	MemoryRSS     uint64            `json:"memory_rss_bytes,omitempty" description:"Resident memory of every instance, Linux only"`
+	StartTimeout  string            `json:"start_timeout" description:"How long a start waits to see the process stay up"`
+	StopTimeout   string            `json:"stop_timeout" description:"How long the process gets to exit after SIGTERM before it's killed"`
+	Instances     int               `json:"instances" description:"How many processes it runs"`
+	Replicas      []*instanceStatus `json:"replicas,omitempty" description:"Each instance, for services with more than one"`
+	PreStart      *HookDefinition   `json:"pre_start,omitempty" description:"Run before each instance starts"`
+	PostStop      *HookDefinition   `json:"post_stop,omitempty" description:"Run after each instance stops or exits"`
+	NextRestart   *time.Time        `json:"next_restart,omitempty" description:"When its restart policy's schedule restarts it next"`
+	Maintenance   *Maintenance      `json:"maintenance,omitempty" description:"The maintenance mode it's in, its own or the global one"`
 }
 
-func newServiceStatus(p *exec.Cmd) *serviceStatus {
-	if p != nil {
-		return &serviceStatus{
-			Running:  true,
-			PID:      p.Process.Pid,
-			Env:      p.Env,
-			Location: p.Path,
+// newServiceStatus builds the status of a registered service, the lock must
+// be held
+func (gg *GladiusGuardian) newServiceStatus(name string) *serviceStatus {
+	status := &serviceStatus{
+		Name:      name,
+		Running:   false,
+		Instances: gg.instanceCount(name),
+	}
+	if settings := gg.registeredServices[name]; settings != nil {
+		status.Source = settings.source
+		status.PreStart = settings.preStart
+		status.PostStop = settings.postStop
+	}
+	if rp := gg.restartPolicies[name]; rp != nil && !rp.nextRestart.IsZero() {
+		next := rp.nextRestart
+		status.NextRestart = &next
+	}
+	if m := gg.inMaintenance(name); m != nil {
+		copied := *m
+		status.Maintenance = &copied
+	}
+	status.StartTimeout = gg.startTimeout(name).String()
+	status.StopTimeout = gg.stopTimeout(name).String()
+
+	var first *instance
+	for _, inst := range gg.instances[name] {
+		is := inst.status()
+		status.Restarts += is.Restarts
+		status.CPUSeconds += is.CPUSeconds
+		status.MemoryRSS += is.MemoryRSS
+		if status.LastExit == "" {
+			status.LastExit = is.LastExit
 		}
+		if first == nil && inst.cmd != nil {
+			first = inst
+		}
+		if status.Instances > 1 || len(gg.instances[name]) > 1 {
+			status.Replicas = append(status.Replicas, is)
+		}
+	}
+	if first == nil {
+		return status
+	}
+
+	status.Running = true
+	status.PID = first.cmd.Process.Pid
+	if first.started != nil {
+		// Secret references are never resolved here, and plain secrets are hidden
+		status.Env = RedactEnv(first.started.env)
 	}
-	return &serviceStatus{
-		Running: false,
+	status.Args = first.cmd.Args[1:]
+	status.Location = first.cmd.Path
+	startedAt := first.startedAt
+	status.StartedAt = &startedAt
+	status.UptimeSeconds = int64(time.Since(startedAt) / time.Second)
+	return status
+}
+
+// RegisterService - Add a service to the guardian, env is added to the
+// default environment
+func (gg *GladiusGuardian) RegisterService(name, execLocation string, env []string, instances int) {
+	def := &ServiceDefinition{Name: name, Executable: execLocation, EnvironmentVars: env, Instances: instances}
+	if err := gg.Register(def, SourceBuiltin, false); err != nil {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"err":          err,
+		}).Warn("Couldn't register service")
 	}
 }
 
-// RegisterService - Add a service to the guardian
-func (gg *GladiusGuardian) RegisterService(name, execLocation string, env []string) {
+// Register - Add a service, or update one registered from the same source
+// after a config reload. A running process is left alone and picks up the
+// new settings on its next start
+func (gg *GladiusGuardian) Register(def *ServiceDefinition, source string, persist bool) error {
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
 
+	settings := &serviceSettings{
+		env:       def.EnvironmentVars,
+		args:      def.Args,
+		execName:  def.Executable,
+		instances: def.Instances,
+		preStart:  def.PreStart,
+		postStop:  def.PostStop,
+		source:    source,
+		persist:   persist,
+	}
+	if old, ok := gg.registeredServices[def.Name]; ok {
+		if old.source != source || source == SourceAPI {
+			return &ServiceError{Service: def.Name, Err: ErrServiceExists}
+		}
+		gg.registeredServices[def.Name] = settings
+		return nil
+	}
+
 	log.WithFields(log.Fields{
-		"service_name":     name,
-		"exec_location":    execLocation,
-		"environment_vars": strings.Join(env, ", "),
+		"service_name":     def.Name,
+		"exec_location":    def.Executable,
+		"environment_vars": strings.Join(RedactEnv(def.EnvironmentVars), ", "),
+		"source":           source,
 	}).Debug("Registered new service")
-	gg.registeredServices[name] = &serviceSettings{env: env, execName: execLocation}
-	gg.services[name] = nil // So it's still returned when we list services
+	gg.registeredServices[def.Name] = settings
 
 	// Start websocket watcher
-	gg.serviceWebSockets[name] = make([]*websocket.Conn, 0)
+	gg.serviceWebSockets[def.Name] = make([]*websocket.Conn, 0)
+	return nil
+}
+
+// SetMaxLogLines - Change how many lines are kept for each service, the
+// existing logs are trimmed if they're over the new size
+func (gg *GladiusGuardian) SetMaxLogLines(n int) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	for _, fsl := range gg.serviceLogs {
+		fsl.Resize(n)
+	}
+	for _, instances := range gg.instances {
+		for _, inst := range instances {
+			if inst.logs != nil {
+				inst.logs.Resize(n)
+			}
+		}
+	}
+	for _, j := range gg.jobs {
+		j.logs.Resize(n)
+	}
 }
 
 func (gg *GladiusGuardian) updateWebsocketLog(serviceName, logLine string) {
@@ -93,46 +291,144 @@ func (gg *GladiusGuardian) updateWebsocketLog(serviceName, logLine string) {
 	}
 }
 
-// SetTimeout - Set the timeout for starting processes
-func (gg *GladiusGuardian) SetTimeout(t *time.Duration) {
+// SetLogForwarder - Ship every captured service line to f as well as the
+// in memory logs
+func (gg *GladiusGuardian) SetLogForwarder(f LogForwarder) {
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
 
-	gg.spawnTimeout = t
+	gg.logForwarder = f
 }
 
-// GetServicesStatus - Get the status of the service
-func (gg *GladiusGuardian) GetServicesStatus(name string) map[string]*serviceStatus {
+// SetOriginPolicy - Set which browser origins can open log WebSockets
+func (gg *GladiusGuardian) SetOriginPolicy(p *OriginPolicy) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	gg.originPolicy = p
+}
+
+// Events - Get the event stream of the guardian
+func (gg *GladiusGuardian) Events() *EventBus {
+	return gg.events
+}
+
+// GetServicesStatus - Get the status of the service, or of every service if
+// the name is all
+func (gg *GladiusGuardian) GetServicesStatus(name string) (map[string]*serviceStatus, error) {
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
 
 	if name == "all" || name == "" {
 		services := make(map[string]*serviceStatus)
-		for serviceName, service := range gg.services {
-			services[serviceName] = newServiceStatus(service)
+		for serviceName := range gg.registeredServices {
+			services[serviceName] = gg.newServiceStatus(serviceName)
 		}
-		return services
+		return services, nil
+	}
+
+	if _, ok := gg.registeredServices[name]; !ok {
+		return nil, &ServiceError{Service: name, Err: ErrServiceNotFound}
 	}
 
 	services := make(map[string]*serviceStatus)
-	services[name] = newServiceStatus(gg.services[name])
-	return services
+	services[name] = gg.newServiceStatus(name)
+	return services, nil
 }
 
-// StopService - Stop a service
-func (gg *GladiusGuardian) StopService(name string) error {
+// GetServiceStatus - Get the status of a single service
+func (gg *GladiusGuardian) GetServiceStatus(name string) (*serviceStatus, error) {
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
 
+	if _, ok := gg.registeredServices[name]; !ok {
+		return nil, &ServiceError{Service: name, Err: ErrServiceNotFound}
+	}
+	return gg.newServiceStatus(name), nil
+}
+
+// ServiceNames - Get the names of every registered service, sorted
+func (gg *GladiusGuardian) ServiceNames() []string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	return gg.serviceNames()
+}
+
+// serviceNames is ServiceNames with the lock held
+func (gg *GladiusGuardian) serviceNames() []string {
+	names := make([]string, 0, len(gg.registeredServices))
+	for name := range gg.registeredServices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetLogs - Get the most recent lines logged by a service, all of them if
+// lines is 0. Only the lines of one instance if index isn't negative
+func (gg *GladiusGuardian) GetLogs(name string, index, lines int) ([]string, error) {
+	gg.mux.Lock()
+	_, ok := gg.registeredServices[name]
+	fsl := gg.serviceLogs[name]
+	if ok && index >= 0 {
+		if index >= len(gg.instances[name]) {
+			gg.mux.Unlock()
+			return nil, &ServiceError{Service: name, Err: ErrNoInstance}
+		}
+		fsl = gg.instances[name][index].logs
+	}
+	gg.mux.Unlock()
+
+	if !ok {
+		return nil, &ServiceError{Service: name, Err: ErrServiceNotFound}
+	}
+	if fsl == nil {
+		return []string{}, nil
+	}
+
+	logLines := fsl.LogLines()
+	if lines > 0 && len(logLines) > lines {
+		logLines = logLines[len(logLines)-lines:]
+	}
+	return logLines, nil
+}
+
+// GetAllLogs - Get the logs of every service that has logged something
+func (gg *GladiusGuardian) GetAllLogs() map[string][]string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	logs := make(map[string][]string)
+	for name, fsl := range gg.serviceLogs {
+		logs[name] = fsl.LogLines()
+	}
+	return logs
+}
+
+// StopService - Stop a service, giving it timeout to exit or its own stop
+// timeout if 0. It returns once the post-stop hooks are done too
+func (gg *GladiusGuardian) StopService(name string, timeout time.Duration) error {
+	gg.mux.Lock()
+
 	if name == "all" || name == "" {
 		var result *multierror.Error
-		for sName := range gg.registeredServices {
-			err := gg.stopServiceInternal(sName)
+		names := gg.serviceNames()
+		for _, sName := range names {
+			// The lock is let go while each one stops, it could be gone
+			if _, ok := gg.registeredServices[sName]; !ok {
+				continue
+			}
+			err := gg.stopServiceInternal(sName, timeout)
 			if err != nil {
-				result = multierror.Append(result, fmt.Errorf("error stopping service %s: %s", sName, err))
+				result = multierror.Append(result, fmt.Errorf("error stopping service %s: %w", sName, err))
 			}
-			continue
 		}
+		gg.mux.Unlock()
+		for _, sName := range names {
+			gg.waitPostStop(sName, -1)
+		}
+
 		err := result.ErrorOrNil()
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -142,91 +438,247 @@ func (gg *GladiusGuardian) StopService(name string) error {
 		return result.ErrorOrNil()
 	}
 
-	return gg.stopServiceInternal(name)
+	err := gg.stopServiceInternal(name, timeout)
+	gg.mux.Unlock()
+	gg.waitPostStop(name, -1)
+	return err
 }
 
-// StartService - Start a service
-func (gg *GladiusGuardian) StartService(name string, env []string) error {
+// StartService - Start a service, waiting timeout for it to come up or its
+// own start timeout if 0
+func (gg *GladiusGuardian) StartService(name string, env []string, timeout time.Duration) error {
 	if name == "all" || name == "" {
 		var result *multierror.Error
-		for sName := range gg.registeredServices {
-			err := gg.startServiceInternal(sName, env)
+		for _, sName := range gg.ServiceNames() {
+			err := gg.startInstances(sName, env, nil, timeout)
 			if err != nil {
-				result = multierror.Append(result, fmt.Errorf("error starting service %s: %s", sName, err))
+				result = multierror.Append(result, fmt.Errorf("error starting service %s: %w", sName, err))
 			}
 		}
 		return result.ErrorOrNil()
 	}
 
-	return gg.startServiceInternal(name, env)
+	return gg.startInstances(name, env, nil, timeout)
 }
 
-func (gg *GladiusGuardian) startServiceInternal(name string, env []string) error {
+// RestartService - Stop a service if it's running and start it again, with
+// timeout used for both if it isn't 0
+func (gg *GladiusGuardian) RestartService(name string, env []string, timeout time.Duration) error {
+	return gg.restartServiceInternal(name, env, nil, timeout)
+}
+
+func (gg *GladiusGuardian) restartServiceInternal(name string, env, args []string, timeout time.Duration) error {
 	gg.mux.Lock()
-	defer gg.mux.Unlock()
+	err := gg.stopServiceInternal(name, timeout)
+	gg.mux.Unlock()
+	if err != nil && ServiceErrorStatus(err) != http.StatusConflict {
+		return err // Not running is fine, anything else isn't
+	}
 
-	serviceSettings, ok := gg.registeredServices[name]
+	return gg.startInstances(name, env, args, timeout)
+}
+
+// startInstance starts an instance of the service with env added to its
+// environment, and the args, or the registered ones if nil. It waits timeout,
+// or the service's start timeout if 0, to see the process stay up. The
+// pre-start hook runs first and a failing one stops the start
+func (gg *GladiusGuardian) startInstance(name string, index int, env, args []string, timeout time.Duration) error {
+	// Cleanup after the last process has to be done before the next one
+	gg.waitPostStop(name, index)
+
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
 	if !ok {
-		return errors.New("attempted to start unregistered service")
+		gg.mux.Unlock()
+		return &ServiceError{Service: name, Err: ErrServiceNotFound}
 	}
 
-	if gg.services[name] != nil {
-		return fmt.Errorf("can't start %s because it's already running", name)
+	inst := gg.instance(name, index)
+	if inst.running() {
+		gg.mux.Unlock()
+		return &ServiceError{Service: name, Err: ErrServiceRunning}
 	}
 
-	if len(env) == 0 {
-		env = viper.GetStringSlice("DefaultEnvironment")
+	extraEnv, extraArgs := env, args
+	if args == nil {
+		args = settings.args
+	}
+	env, args, err := gg.expand(name, index, gg.environment(name, env), args)
+	if err != nil {
+		gg.mux.Unlock()
+		return &ServiceError{Service: name, Err: err}
 	}
 
-	if err := gg.checkTimeout(); err != nil {
-		return err
+	if timeout <= 0 {
+		timeout = gg.startTimeout(name)
+	}
+
+	// Don't hold the lock while waiting out the timeout so status, logs and
+	// other services keep working
+	inst.starting = true
+	gg.mux.Unlock()
+
+	// Secrets are only read now and only the process sees them, everything
+	// else keeps the references
+	resolved, secrets, err := gg.resolveEnv(env)
+	if err != nil {
+		gg.mux.Lock()
+		inst.starting = false
+		gg.mux.Unlock()
+		return &ServiceError{Service: name, Err: err}
 	}
+	gg.mux.Lock()
+	inst.secrets = secrets
+	gg.mux.Unlock()
+
+	if settings.preStart != nil {
+		if err := gg.runHook(name, index, HookPreStart, settings.preStart, resolved, secrets); err != nil {
+			gg.mux.Lock()
+			inst.starting = false
+			gg.mux.Unlock()
+			return &ServiceError{Service: name, Err: err}
+		}
+	}
+
+	p, exited, err := gg.spawnProcess(name, inst, settings.execName, args, resolved, timeout)
 
-	p, err := gg.spawnProcess(name, serviceSettings.execName, serviceSettings.env, gg.spawnTimeout)
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+	inst.starting = false
 	if err != nil {
 		return err
 	}
 
-	gg.services[name] = p
+	inst.cmd = p
+	inst.exited = exited
+	inst.started = &serviceSettings{env: env, args: args, execName: settings.execName, postStop: settings.postStop}
+	inst.extraEnv, inst.extraArgs = extraEnv, extraArgs
+	inst.starts++
+	inst.startedAt = time.Now()
 	log.WithFields(log.Fields{
-		"service_name":     name,
-		"exec_location":    serviceSettings.execName,
-		"environment_vars": strings.Join(env, ", "),
+		"service_name":     gg.label(name, index),
+		"exec_location":    settings.execName,
+		"environment_vars": strings.Join(RedactEnv(env), ", "),
+		"args":             strings.Join(args, " "),
 	}).Debug("Started service")
+	gg.events.Publish(EventServiceStarted, name, "Started "+gg.label(name, index), gg.newServiceStatus(name))
 	return nil
 }
 
-func (gg *GladiusGuardian) stopServiceInternal(name string) error {
+// environment is what a service is started with, the default environment
+// then the service's own and then extra, with later entries winning. The lock
+// must be held
+func (gg *GladiusGuardian) environment(name string, extra []string) []string {
+	env := append([]string{}, configStrings("DefaultEnvironment")...)
+	if settings, ok := gg.registeredServices[name]; ok {
+		env = append(env, settings.env...)
+	}
+	return append(env, extra...)
+}
+
+// stopServiceInternal stops every running instance of the service. The lock
+// must be held, it's let go while they stop, see stopInstances
+func (gg *GladiusGuardian) stopServiceInternal(name string, timeout time.Duration) error {
 	serviceSettings, ok := gg.registeredServices[name]
 	if !ok {
-		return errors.New("attempted to stop unregistered service")
+		return &ServiceError{Service: name, Err: ErrServiceNotFound}
 	}
 
-	service := gg.services[name]
-	if service == nil {
-		return errors.New("service is not running so can not stop")
+	var running []*instance
+	for _, inst := range gg.instances[name] {
+		if inst.cmd != nil && !inst.stopping {
+			running = append(running, inst)
+		}
+	}
+	if len(running) == 0 {
+		return &ServiceError{Service: name, Err: ErrServiceStopped}
 	}
 
-	err := killProcess(gg, name)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"service_name":     name,
-			"exec_location":    serviceSettings.execName,
-			"environment_vars": strings.Join(serviceSettings.env, ", "),
-			"err":              err,
-		}).Warn("Couldn't kill service")
-		return errors.New("couldn't kill service, error was: " + err.Error())
+	if err := gg.stopInstances(name, running, timeout); err != nil {
+		return err
+	}
+	gg.trimInstances(name)
+	if serviceSettings.removed && !gg.running(name) {
+		gg.removeService(name)
 	}
 
 	return nil
 }
 
+// processExited is called by the spawn code when an instance's process is
+// gone, whether it was stopped or exited on its own. The post-stop hook runs
+// once it's been recorded
+func (gg *GladiusGuardian) processExited(name string, inst *instance, p *exec.Cmd, exited chan struct{}, err error) {
+	gg.mux.Lock()
+	done := inst.pendingPostStop()
+	hook, env := gg.postStopHook(name, inst)
+
+	// If it's being stopped stopInstances records it, otherwise it exited on
+	// its own
+	if inst.cmd == p && !inst.stopping {
+		inst.cmd = nil
+		reason := "exit status 0"
+		if err != nil {
+			reason = err.Error()
+		}
+		inst.lastExit = reason
+		label := gg.label(name, inst.index)
+		gg.events.Publish(EventServiceExited, name, label+" exited on its own: "+reason, nil)
+		gg.trimInstances(name)
+		if settings := gg.registeredServices[name]; settings != nil && settings.removed && !gg.running(name) {
+			gg.removeService(name)
+		}
+	}
+	gg.mux.Unlock()
+
+	// Closed once the post-stop hook is pending so a stop waiting on it can
+	// wait for the hook too
+	close(exited)
+
+	if hook != nil {
+		gg.runPostStop(name, inst, hook, env)
+	}
+
+	gg.mux.Lock()
+	inst.postStop = nil
+	close(done)
+	gg.trimInstances(name)
+	gg.mux.Unlock()
+}
+
+// postStopHook returns the post-stop hook to run for the instance and the
+// environment it was started with. The service's current hook wins over the
+// one it was started with, which is only used once it's been removed. The
+// lock must be held
+func (gg *GladiusGuardian) postStopHook(name string, inst *instance) (*HookDefinition, []string) {
+	var hook *HookDefinition
+	if settings, ok := gg.registeredServices[name]; ok {
+		hook = settings.postStop
+	} else if inst.started != nil {
+		hook = inst.started.postStop
+	}
+	if hook == nil {
+		return nil, nil
+	}
+
+	if inst.started != nil {
+		return hook, inst.started.env
+	}
+	env, _, err := gg.expand(name, inst.index, gg.environment(name, nil), nil)
+	if err != nil {
+		return hook, gg.environment(name, nil)
+	}
+	return hook, env
+}
+
 // AddLogClient - Add logging client
 func (gg *GladiusGuardian) AddLogClient(serviceName string, w http.ResponseWriter, r *http.Request) {
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	u := upgrader
+	u.CheckOrigin = gg.originPolicy.CheckOrigin
+	conn, err := u.Upgrade(w, r, nil)
 	if err != nil {
 		log.Warn(err)
 		return
@@ -234,19 +686,3 @@ func (gg *GladiusGuardian) AddLogClient(serviceName string, w http.ResponseWrite
 
 	gg.serviceWebSockets[serviceName] = append(gg.serviceWebSockets[serviceName], conn)
 }
-
-// AppendToLog - Add string to the service logs
-func (gg *GladiusGuardian) AppendToLog(serviceName, line string) {
-	if gg.serviceLogs[serviceName] == nil {
-		gg.serviceLogs[serviceName] = NewFixedSizeLog(viper.GetInt("MaxLogLines"))
-	}
-	gg.serviceLogs[serviceName].Append(line) // Add to our internal fixed size log
-	gg.updateWebsocketLog(serviceName, line)
-}
-
-func (gg *GladiusGuardian) checkTimeout() error {
-	if gg.spawnTimeout == nil {
-		return errors.New("spawn timeout not set, please set it before a process is spawned")
-	}
-	return nil
-}
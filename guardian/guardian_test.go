@@ -0,0 +1,35 @@
+package guardian_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+func TestServiceErrorStatus(t *testing.T) {
+	notFound := &guardian.ServiceError{Service: "edged", Err: guardian.ErrServiceNotFound}
+	running := &guardian.ServiceError{Service: "edged", Err: guardian.ErrServiceRunning}
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"plain", guardian.ErrJobNotFound, http.StatusNotFound},
+		{"service error", notFound, http.StatusNotFound},
+		{"wrapped", fmt.Errorf("error starting service edged: %w", running), http.StatusConflict},
+		{"unknown", errors.New("exec format error"), http.StatusInternalServerError},
+		{"all agree", multierror.Append(nil, running, fmt.Errorf("x: %w", guardian.ErrServiceRunning)), http.StatusConflict},
+		{"disagree", multierror.Append(nil, running, errors.New("exec format error")), http.StatusInternalServerError},
+		{"wrapped multi", fmt.Errorf("start: %w", multierror.Append(nil, notFound)), http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if got := guardian.ServiceErrorStatus(test.err); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
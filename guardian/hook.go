@@ -0,0 +1,169 @@
+package guardian
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of hook
+const (
+	HookPreStart = "pre-start" // Before each instance starts, failing stops the start
+	HookPostStop = "post-stop" // After each instance stops or exits
+)
+
+// DefaultHookTimeout is how long a hook runs before it's killed if it doesn't
+// have a timeout
+const DefaultHookTimeout = 30 * time.Second
+
+// hookOutputLines is how many of the last lines of a failed hook go in the
+// error
+const hookOutputLines = 20
+
+// HookDefinition is a command run before a service starts or after it stops
+type HookDefinition struct {
+	Executable string   `json:"executable" description:"Path of the program, or a name looked up in PATH"`
+	Args       []string `json:"args,omitempty" description:"Command line arguments, templates are filled in like the service's"`
+	Timeout    string   `json:"timeout,omitempty" description:"Kill it if it takes longer, like 1m. 30s if left out"`
+}
+
+// ServiceHooks are the hooks of a built in service, from its Hooks section in
+// the config
+type ServiceHooks struct {
+	PreStart *HookDefinition
+	PostStop *HookDefinition
+}
+
+// Validate checks the executable, timeout and args of the hook in field
+func (hook *HookDefinition) Validate(field string) []FieldError {
+	var errs []FieldError
+	if hook.Executable == "" {
+		errs = append(errs, FieldError{Field: field + ".executable", Message: "is required"})
+	}
+	if hook.Timeout != "" {
+		if d, err := time.ParseDuration(hook.Timeout); err != nil || d <= 0 {
+			errs = append(errs, FieldError{Field: field + ".timeout", Message: "must be a positive duration like 1m"})
+		}
+	}
+	return append(errs, ValidateTemplates(field+".args", hook.Args)...)
+}
+
+func (hook *HookDefinition) timeout() time.Duration {
+	if d, err := time.ParseDuration(hook.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return DefaultHookTimeout
+}
+
+// HookError is returned when a hook fails, with the last lines it wrote
+type HookError struct {
+	Hook   string
+	Err    error
+	Output []string
+}
+
+func (e *HookError) Error() string {
+	msg := e.Hook + " hook failed: " + e.Err.Error()
+	if len(e.Output) > 0 {
+		msg += ", output:\n" + strings.Join(e.Output, "\n")
+	}
+	return msg
+}
+
+// SetServiceHooks - Set the hooks of a service, for the built in services
+// that don't have a definition to put them in
+func (gg *GladiusGuardian) SetServiceHooks(name string, hooks *ServiceHooks) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	settings, ok := gg.registeredServices[name]
+	if !ok {
+		return
+	}
+	settings.preStart, settings.postStop = nil, nil
+	if hooks != nil {
+		settings.preStart, settings.postStop = hooks.PreStart, hooks.PostStop
+	}
+}
+
+// runHook runs a hook for an instance of the service with the instance's
+// environment, its output goes to the service's log. env must already be
+// resolved, secrets are scrubbed from the output
+func (gg *GladiusGuardian) runHook(name string, index int, kind string, hook *HookDefinition, env, secrets []string) error {
+	gg.mux.Lock()
+	_, args, err := gg.expand(name, index, nil, hook.Args)
+	label := gg.label(name, index)
+	gg.mux.Unlock()
+	if err != nil {
+		return &HookError{Hook: kind, Err: err}
+	}
+
+	env = append(append([]string{}, env...),
+		"GUARDIAN_HOOK="+kind,
+		"GUARDIAN_SERVICE="+name,
+		"GUARDIAN_INSTANCE="+strconv.Itoa(index),
+	)
+
+	var output []string
+	_, err = runToCompletion(hook.Executable, args, env, hook.timeout(), func(line string) {
+		line = redactSecrets(line, secrets)
+		gg.appendLog(name, index, kind+": "+line)
+		output = append(output, line)
+		if len(output) > hookOutputLines {
+			output = output[1:]
+		}
+	})
+	if err == nil {
+		return nil
+	}
+
+	gg.appendLog(name, index, fmt.Sprintf("%s: %s", kind, err))
+	log.WithFields(log.Fields{
+		"service_name": label,
+		"hook":         kind,
+		"err":          err,
+	}).Warn("Hook failed")
+	gg.events.Publish(EventHookFailed, name, kind+" hook of "+label+" failed: "+err.Error(), nil)
+	return &HookError{Hook: kind, Err: err, Output: output}
+}
+
+// runPostStop runs the post-stop hook after an instance's process is gone,
+// with the environment it was started with. The lock must not be held
+func (gg *GladiusGuardian) runPostStop(name string, inst *instance, hook *HookDefinition, env []string) {
+	resolved, secrets, err := gg.resolveEnv(env)
+	if err != nil {
+		gg.appendLog(name, inst.index, HookPostStop+": "+err.Error())
+		return
+	}
+	gg.runHook(name, inst.index, HookPostStop, hook, resolved, secrets)
+}
+
+// pendingPostStop returns the channel closed once the post-stop hook of the
+// instance's last process is done, creating it if there isn't one. The lock
+// must be held
+func (inst *instance) pendingPostStop() chan struct{} {
+	if inst.postStop == nil {
+		inst.postStop = make(chan struct{})
+	}
+	return inst.postStop
+}
+
+// waitPostStop waits for the post-stop hooks still running for the service's
+// instances, or just the one at index if it isn't negative
+func (gg *GladiusGuardian) waitPostStop(name string, index int) {
+	gg.mux.Lock()
+	var pending []chan struct{}
+	for _, inst := range gg.instances[name] {
+		if inst.postStop != nil && (index < 0 || inst.index == index) {
+			pending = append(pending, inst.postStop)
+		}
+	}
+	gg.mux.Unlock()
+
+	for _, ch := range pending {
+		<-ch
+	}
+}
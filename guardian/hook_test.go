@@ -0,0 +1,93 @@
+// +build linux darwin
+
+package guardian_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/spf13/viper"
+)
+
+func TestHooks(t *testing.T) {
+	viper.Set("MaxLogLines", 100)
+
+	tests := []struct {
+		name         string
+		preStart     []string // Args of the hook, fail or hang to make it fail
+		postStop     []string
+		wantStartErr string // In the hook's error
+		wantTrace    []string
+	}{
+		{"in order", []string{"ok"}, []string{"ok"}, "", []string{"pre-start 0", "run 0", "post-stop 0"}},
+		{"no hooks", nil, nil, "", []string{"run 0"}},
+		{"failed pre-start", []string{"fail"}, []string{"ok"}, "not ready", []string{"pre-start 0"}},
+		{"pre-start timeout", []string{"hang"}, nil, "pre-start hook failed", []string{"pre-start 0"}},
+		{"failed post-stop", nil, []string{"fail"}, "", []string{"run 0", "post-stop 0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			trace := filepath.Join(dir, "trace")
+			service := filepath.Join(dir, "service.sh")
+			hook := filepath.Join(dir, "hook.sh")
+			scripts := map[string]string{
+				service: "#!/bin/sh\necho \"run $1\" >> " + trace + "\nexec sleep 60\n",
+				hook: "#!/bin/sh\necho \"$GUARDIAN_HOOK $GUARDIAN_INSTANCE\" >> " + trace + "\n" +
+					"case \"$1\" in\nfail) echo not ready; exit 1;;\nhang) exec sleep 5;;\nesac\n",
+			}
+			for path, script := range scripts {
+				if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			def := &guardian.ServiceDefinition{Name: "hooked", Executable: service, Args: []string{"{{.Instance}}"}}
+			if test.preStart != nil {
+				def.PreStart = &guardian.HookDefinition{Executable: hook, Args: test.preStart, Timeout: "200ms"}
+			}
+			if test.postStop != nil {
+				def.PostStop = &guardian.HookDefinition{Executable: hook, Args: test.postStop}
+			}
+			gg := guardian.New()
+			if err := gg.Register(def, guardian.SourceAPI, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := gg.SetServiceTimeouts("hooked", 50*time.Millisecond, 2*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			defer gg.StopService("all", 0)
+
+			err := gg.StartService("hooked", nil, 0)
+			if test.wantStartErr != "" {
+				var hookErr *guardian.HookError
+				if !errors.As(err, &hookErr) || hookErr.Hook != guardian.HookPreStart || !strings.Contains(err.Error(), test.wantStartErr) {
+					t.Fatalf("got %v, want a pre-start hook error with %q", err, test.wantStartErr)
+				}
+				if status, _ := gg.GetServiceStatus("hooked"); status.Running {
+					t.Error("the service started after its pre-start hook failed")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			// The stop waits for the post-stop hook, which can't fail it
+			if err := gg.StopService("hooked", 0); err != nil && test.wantStartErr == "" {
+				t.Errorf("stopping: %s", err)
+			}
+
+			b, err := ioutil.ReadFile(trace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"); !reflect.DeepEqual(got, test.wantTrace) {
+				t.Errorf("ran %q, want %q", got, test.wantTrace)
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+package guardian
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	multierror "github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxInstances is the most processes one service can run
+const MaxInstances = 64
+
+// ErrNoInstance is returned for an instance index the service doesn't have
+var ErrNoInstance = errors.New("service doesn't have that instance")
+
+// instance is one process of a service, services have one unless they're
+// scaled up
+type instance struct {
+	index     int
+	cmd       *exec.Cmd        // nil when it isn't running
+	exited    chan struct{}    // Closed when the process exits
+	started   *serviceSettings // What the process was started with
+	extraEnv  []string         // What the last start added to the environment
+	extraArgs []string         // The args the last start asked for, nil for the registered ones
+	starting  bool             // Waiting out the start timeout
+	stopping  bool             // Being stopped by stopInstances
+	secrets   []string         // Values scrubbed from its output
+	logs      *FixedSizeLog
+	starts    int
+	startedAt time.Time
+	lastExit  string        // Why it last exited on its own
+	postStop  chan struct{} // Closed when the post-stop hook of the last process is done
+}
+
+func (inst *instance) running() bool {
+	return inst.cmd != nil || inst.starting
+}
+
+// instanceStatus is the status of one instance of a service
+type instanceStatus struct {
+	Index         int        `json:"index"`
+	Running       bool       `json:"running"`
+	PID           int        `json:"pid"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	UptimeSeconds int64      `json:"uptime_seconds,omitempty"`
+	Restarts      int        `json:"restarts" description:"Times it was started again after the first start"`
+	LastExit      string     `json:"last_exit,omitempty" description:"Why it last exited without being stopped"`
+	CPUSeconds    float64    `json:"cpu_seconds,omitempty" description:"CPU time used by the process, Linux only"`
+	MemoryRSS     uint64     `json:"memory_rss_bytes,omitempty" description:"Resident memory of the process, Linux only"`
+}
+
+func (inst *instance) status() *instanceStatus {
+	status := &instanceStatus{Index: inst.index, LastExit: inst.lastExit}
+	if inst.starts > 1 {
+		status.Restarts = inst.starts - 1
+	}
+	if inst.cmd == nil {
+		return status
+	}
+	status.Running = true
+	status.PID = inst.cmd.Process.Pid
+	startedAt := inst.startedAt
+	status.StartedAt = &startedAt
+	status.UptimeSeconds = int64(time.Since(startedAt) / time.Second)
+	if cpu, rss, err := processUsage(status.PID); err == nil {
+		status.CPUSeconds = cpu
+		status.MemoryRSS = rss
+	}
+	return status
+}
+
+// instance returns the instance, creating it if the service doesn't have it
+// yet. The lock must be held
+func (gg *GladiusGuardian) instance(name string, index int) *instance {
+	for len(gg.instances[name]) <= index {
+		gg.instances[name] = append(gg.instances[name], &instance{index: len(gg.instances[name])})
+	}
+	return gg.instances[name][index]
+}
+
+// running returns true if any instance of the service is running or
+// starting, the lock must be held
+func (gg *GladiusGuardian) running(name string) bool {
+	for _, inst := range gg.instances[name] {
+		if inst.running() {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceCount is how many instances the service runs, the lock must be held
+func (gg *GladiusGuardian) instanceCount(name string) int {
+	if settings := gg.registeredServices[name]; settings != nil && settings.instances > 1 {
+		return settings.instances
+	}
+	return 1
+}
+
+// label names an instance in logs and events, services with one instance
+// are just their name
+func (gg *GladiusGuardian) label(name string, index int) string {
+	if index == 0 && gg.instanceCount(name) == 1 {
+		return name
+	}
+	return name + "[" + strconv.Itoa(index) + "]"
+}
+
+// startInstances starts the instances that aren't running in parallel,
+// returning ErrServiceRunning if they all are
+func (gg *GladiusGuardian) startInstances(name string, env, args []string, timeout time.Duration) error {
+	gg.mux.Lock()
+	if _, ok := gg.registeredServices[name]; !ok {
+		gg.mux.Unlock()
+		return &ServiceError{Service: name, Err: ErrServiceNotFound}
+	}
+	var indexes []int
+	for i := 0; i < gg.instanceCount(name); i++ {
+		if !gg.instance(name, i).running() {
+			indexes = append(indexes, i)
+		}
+	}
+	gg.mux.Unlock()
+
+	if len(indexes) == 0 {
+		return &ServiceError{Service: name, Err: ErrServiceRunning}
+	}
+	if len(indexes) == 1 {
+		return gg.startInstance(name, indexes[0], env, args, timeout)
+	}
+
+	errs := make([]error, len(indexes))
+	var wg sync.WaitGroup
+	for i, index := range indexes {
+		wg.Add(1)
+		go func(i, index int) {
+			defer wg.Done()
+			errs[i] = gg.startInstance(name, index, env, args, timeout)
+		}(i, index)
+	}
+	wg.Wait()
+
+	var result *multierror.Error
+	for _, err := range errs {
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// stopInstances asks the running instances to exit and kills the ones still
+// running after timeout, or the service's stop timeout if 0. The lock must be
+// held when it's called and is held again when it returns, but it's let go
+// while waiting for the processes to exit so status, logs and the output of
+// the exiting processes keep working. Instances another call is already
+// stopping are left to it
+func (gg *GladiusGuardian) stopInstances(name string, instances []*instance, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = gg.stopTimeout(name)
+	}
+	execName := ""
+	if settings := gg.registeredServices[name]; settings != nil {
+		execName = settings.execName
+	}
+
+	type target struct {
+		inst   *instance
+		cmd    *exec.Cmd
+		exited chan struct{}
+		label  string
+		err    error
+	}
+	var targets []*target
+	deadline := time.Now().Add(timeout)
+	for _, inst := range instances {
+		if inst.cmd == nil || inst.stopping {
+			continue
+		}
+		inst.stopping = true
+		t := &target{inst: inst, cmd: inst.cmd, exited: inst.exited, label: gg.label(name, inst.index)}
+		targets = append(targets, t)
+		if err := terminateProcess(gg, name, t.cmd); err != nil {
+			log.WithFields(log.Fields{
+				"service_name": t.label,
+				"err":          err,
+			}).Warn("Couldn't ask service to exit, killing it")
+			deadline = time.Now()
+		}
+	}
+
+	// Don't hold the lock while the processes exit, they need it to log
+	gg.mux.Unlock()
+	for _, t := range targets {
+		select {
+		case <-t.exited:
+			continue
+		case <-time.After(time.Until(deadline)):
+		}
+
+		if err := killProcess(gg, name, t.cmd); err != nil {
+			log.WithFields(log.Fields{
+				"service_name":  t.label,
+				"exec_location": execName,
+				"err":           err,
+			}).Warn("Couldn't kill service")
+			t.err = errors.New("couldn't kill service, error was: " + err.Error())
+			continue
+		}
+		log.WithFields(log.Fields{
+			"service_name": t.label,
+			"timeout":      timeout.String(),
+		}).Warn("Killed service that didn't exit in time")
+
+		// Wait for it to actually go away so it can be started again right away
+		select {
+		case <-t.exited:
+		case <-time.After(10 * time.Second):
+			t.err = errors.New("killed service but it didn't exit within 10 seconds")
+		}
+	}
+	gg.mux.Lock()
+
+	var result *multierror.Error
+	for _, t := range targets {
+		t.inst.stopping = false
+		if t.err != nil {
+			result = multierror.Append(result, t.err)
+			continue
+		}
+		// processExited left this to us, and has marked the post-stop hook
+		// pending before the process counted as exited
+		if t.inst.cmd == t.cmd {
+			t.inst.cmd = nil
+		}
+		gg.events.Publish(EventServiceStopped, name, "Stopped "+t.label, nil)
+	}
+	return result.ErrorOrNil()
+}
+
+// Scale - Set how many instances of a service run. If it's running the extra
+// instances are started or the highest ones stopped straight away, otherwise
+// the new number is used on the next start
+func (gg *GladiusGuardian) Scale(name string, n int) error {
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
+	if !ok {
+		gg.mux.Unlock()
+		return &ServiceError{Service: name, Err: ErrServiceNotFound}
+	}
+	running := gg.running(name)
+	settings.instances = n
+
+	// New instances are started the way the first one was
+	first := gg.instance(name, 0)
+	env, args := first.extraEnv, first.extraArgs
+
+	var extra []*instance
+	for i := len(gg.instances[name]) - 1; i >= n; i-- {
+		if inst := gg.instances[name][i]; inst.cmd != nil {
+			extra = append(extra, inst)
+		}
+	}
+	err := gg.stopInstances(name, extra, 0)
+	gg.trimInstances(name)
+	gg.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	gg.events.Publish(EventServiceScaled, name, fmt.Sprintf("Scaled %s to %d", name, n), nil)
+	if settings.persist {
+		if err := gg.savePersistedServices(); err != nil {
+			return err
+		}
+	}
+	if !running {
+		return nil
+	}
+	if err := gg.startInstances(name, env, args, 0); err != nil && ServiceErrorStatus(err) != http.StatusConflict {
+		return err // All of them running is fine, anything else isn't
+	}
+	return nil
+}
+
+// trimInstances forgets the stopped instances above the service's count once
+// their post-stop hooks are done, the lock must be held
+func (gg *GladiusGuardian) trimInstances(name string) {
+	instances, ok := gg.instances[name]
+	if !ok {
+		return // Removed
+	}
+	for len(instances) > gg.instanceCount(name) {
+		last := instances[len(instances)-1]
+		if last.running() || last.postStop != nil {
+			break
+		}
+		instances = instances[:len(instances)-1]
+	}
+	gg.instances[name] = instances
+}
+
+// appendLog adds a line from an instance to its own log and to the service's,
+// where it's prefixed with the instance for services with more than one
+func (gg *GladiusGuardian) appendLog(name string, index int, line string) {
+	gg.mux.Lock()
+	inst := gg.instance(name, index)
+	if inst.logs == nil {
+		inst.logs = NewFixedSizeLog(configInt("MaxLogLines"))
+	}
+	if gg.serviceLogs[name] == nil {
+		gg.serviceLogs[name] = NewFixedSizeLog(configInt("MaxLogLines"))
+	}
+	line = redactSecrets(line, inst.secrets)
+	instanceLog, fsl := inst.logs, gg.serviceLogs[name]
+	if label := gg.label(name, index); label != name {
+		line = label + " " + line
+	}
+	forwarder := gg.logForwarder
+	gg.mux.Unlock()
+
+	instanceLog.Append(line)
+	fsl.Append(line) // Add to our internal fixed size log
+	gg.updateWebsocketLog(name, line)
+	if forwarder != nil {
+		forwarder.Forward(name, line)
+	}
+}
+
+// ScaleRequest is the body of POST /v2/services/{service_name}/scale
+type ScaleRequest struct {
+	Instances *int `json:"instances" required:"true" description:"How many processes of the service to run"`
+	Async     bool `json:"async,omitempty" description:"Answer with an operation straight away instead of waiting"`
+}
+
+// Validate checks the number of instances is in range
+func (req *ScaleRequest) Validate() []FieldError {
+	return validateInstances("instances", *req.Instances)
+}
+
+func validateInstances(field string, n int) []FieldError {
+	if n < 1 || n > MaxInstances {
+		return []FieldError{{Field: field, Message: fmt.Sprintf("must be between 1 and %d", MaxInstances)}}
+	}
+	return nil
+}
+
+// V2ScaleServiceHandler - POST /v2/services/{service_name}/scale
+func V2ScaleServiceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sn := mux.Vars(r)["service_name"]
+		req := &ScaleRequest{}
+		if err := decodeJSONBody(w, r, req); err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+
+		runOperation(gg, w, r, req.Async || wantsAsync(r), "scale", sn, func(progress func(string)) (interface{}, error) {
+			progress(fmt.Sprintf("scaling %s to %d", sn, *req.Instances))
+			if err := gg.Scale(sn, *req.Instances); err != nil {
+				return nil, err
+			}
+			return gg.GetServiceStatus(sn)
+		}, func(op *Operation) {
+			if op.err != nil {
+				ErrorHandler(w, r, "Couldn't scale service", op.err, ServiceErrorStatus(op.err))
+				return
+			}
+			ResponseHandler(w, r, "Scaled service", true, nil, op.Result)
+		})
+	}
+}
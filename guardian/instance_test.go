@@ -0,0 +1,218 @@
+// +build linux darwin
+
+package guardian_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+func TestScaleAndStop(t *testing.T) {
+	exec := filepath.Join(t.TempDir(), "sleeper.sh")
+	if err := ioutil.WriteFile(exec, []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	gg := guardian.New()
+	gg.RegisterService("sleeper", exec, nil, 2)
+	if err := gg.SetServiceTimeouts("sleeper", 100*time.Millisecond, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer gg.StopService("all", 0)
+
+	running := func() []int {
+		t.Helper()
+		status, err := gg.GetServiceStatus("sleeper")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pids []int
+		for _, replica := range status.Replicas {
+			if replica.Running {
+				pids = append(pids, replica.PID)
+			}
+		}
+		if len(status.Replicas) == 0 && status.Running {
+			pids = append(pids, status.PID)
+		}
+		return pids
+	}
+
+	if err := gg.StartService("sleeper", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if pids := running(); len(pids) != 2 || pids[0] == pids[1] {
+		t.Fatalf("got PIDs %v after starting 2 instances", pids)
+	}
+	if err := gg.StartService("sleeper", nil, 0); guardian.ServiceErrorStatus(err) != http.StatusConflict {
+		t.Errorf("starting a running service: got %v, want a conflict", err)
+	}
+
+	steps := []struct {
+		instances int
+		want      int
+	}{
+		{3, 3},
+		{1, 1},
+		{2, 2},
+	}
+	for _, step := range steps {
+		if err := gg.Scale("sleeper", step.instances); err != nil {
+			t.Fatalf("scaling to %d: %s", step.instances, err)
+		}
+		if pids := running(); len(pids) != step.want {
+			t.Errorf("scaled to %d: got %d running", step.instances, len(pids))
+		}
+	}
+
+	if err := gg.StopService("sleeper", 0); err != nil {
+		t.Fatal(err)
+	}
+	if pids := running(); len(pids) != 0 {
+		t.Errorf("got PIDs %v after stopping", pids)
+	}
+	if err := gg.StopService("sleeper", 0); guardian.ServiceErrorStatus(err) != http.StatusConflict {
+		t.Errorf("stopping a stopped service: got %v, want a conflict", err)
+	}
+	if err := gg.Scale("missing", 2); guardian.ServiceErrorStatus(err) != http.StatusNotFound {
+		t.Errorf("scaling a missing service: got %v, want not found", err)
+	}
+}
+
+func TestAsyncOperationIsAuditedWhenItEnds(t *testing.T) {
+	exec := filepath.Join(t.TempDir(), "crasher.sh")
+	if err := ioutil.WriteFile(exec, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("MaxLogLines", 100)
+	viper.Set("Auth.Mode", guardian.AuthModeLocalhost)
+	auth, err := guardian.NewAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := guardian.NewAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	gg := guardian.New()
+	gg.SetAuditLog(audit)
+	gg.RegisterService("crasher", exec, nil, 1)
+	if err := gg.SetServiceTimeouts("crasher", 500*time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.Use(guardian.APIMiddleware(1<<20, guardian.NewRateLimiter(0, 0, 0), audit, auth)...)
+	r.HandleFunc("/v2/services/{service_name}/start", guardian.V2ServiceActionHandler(gg, "start")).Methods("POST").Name("v2_start_service")
+
+	req := httptest.NewRequest("POST", "/v2/services/crasher/start?async=true", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want 202", w.Code)
+	}
+
+	var entries []*guardian.AuditEntry
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if entries, err = audit.Query(&guardian.AuditQuery{}); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 2 {
+			break
+		}
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d audit entries, want the request and how it ended", len(entries))
+	}
+	accepted, ended := entries[0], entries[1]
+	if accepted.Status != http.StatusAccepted || !accepted.Success || accepted.Operation == "" {
+		t.Errorf("request entry: got %+v", accepted)
+	}
+	if ended.Operation != accepted.Operation || ended.Identity != "localhost" || ended.Action != "v2_start_service" || ended.Service != "crasher" {
+		t.Errorf("outcome entry doesn't match the request: got %+v", ended)
+	}
+	if ended.Success || ended.Status < 400 || ended.Error == "" {
+		t.Errorf("outcome entry of a failed start: got %+v", ended)
+	}
+}
+
+func TestDesiredStateCooldown(t *testing.T) {
+	sleep, err := osexec.LookPath("sleep")
+	if err != nil {
+		t.Skip("no sleep to run")
+	}
+
+	gg := guardian.New()
+	gg.RegisterService("sleeper", sleep, nil, 1)
+	gg.RegisterService("broken", filepath.Join(t.TempDir(), "missing"), nil, 1)
+	if err := gg.SetServiceTimeouts("", 100*time.Millisecond, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer gg.StopService("all", 0)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/service/desired", guardian.DesiredStateHandler(gg, guardian.NewRateLimiter(0, 0, time.Minute))).Methods("PUT").Name("desired")
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"services": {"sleeper": {"args": ["60"]}}}`, http.StatusOK},
+		{`{"services": {"sleeper": {"args": ["60"]}}}`, http.StatusOK}, // Nothing to change
+		{`{"services": {"sleeper": {"running": false}}}`, http.StatusTooManyRequests},
+		{`{"services": {"broken": {}}}`, http.StatusInternalServerError},
+		{`{"services": {"broken": {}}}`, http.StatusInternalServerError}, // Failed steps don't start the cooldown
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("PUT", "/service/desired", strings.NewReader(test.body)))
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.body, w.Code, test.want)
+		}
+	}
+}
+
+func TestScaleStartsLikeTheFirstInstance(t *testing.T) {
+	dir := t.TempDir()
+	exec := filepath.Join(dir, "marker.sh")
+	out := filepath.Join(dir, "started")
+	script := "#!/bin/sh\necho \"$MARK\" >> " + out + "\nexec sleep 60\n"
+	if err := ioutil.WriteFile(exec, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	gg := guardian.New()
+	gg.RegisterService("marker", exec, nil, 1)
+	if err := gg.SetServiceTimeouts("marker", 100*time.Millisecond, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer gg.StopService("all", 0)
+
+	if err := gg.StartService("marker", []string{"MARK=extra"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := gg.Scale("marker", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	started, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "extra\nextra\nextra\n"; string(started) != want {
+		t.Errorf("got instances started with %q, want %q", started, want)
+	}
+}
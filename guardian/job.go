@@ -0,0 +1,566 @@
+package guardian
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Statuses of a job run
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// What started a job run
+const (
+	TriggerSchedule = "schedule"
+	TriggerAPI      = "api"
+)
+
+// maxJobRuns is how many finished runs are kept for each job
+const maxJobRuns = 50
+
+// Errors for running jobs, ServiceErrorStatus knows them too
+var (
+	ErrJobNotFound = errors.New("job is not configured")
+	ErrJobRunning  = errors.New("job is already running")
+)
+
+// JobDefinition describes a command run to completion, on demand through the
+// API or on a schedule. Jobs come from the Jobs section of the config
+type JobDefinition struct {
+	Name            string   `json:"name" description:"Letters, digits, _, . and -"`
+	Executable      string   `json:"executable" description:"Path of the program, or a name looked up in PATH"`
+	Args            []string `json:"args,omitempty" description:"Command line arguments"`
+	EnvironmentVars []string `json:"environment_vars,omitempty" description:"KEY=VALUE pairs added to the default environment, a VALUE of @file:path or @secret:name is read when the job runs"`
+	Schedule        string   `json:"schedule,omitempty" description:"Cron expression like 0 3 * * *, @daily or @every 1h. Only run through the API if left out"`
+	Timeout         string   `json:"timeout,omitempty" description:"Kill a run that takes longer, like 10m. No limit if left out"`
+}
+
+// Validate checks the name, executable, schedule, timeout, args and
+// environment
+func (def *JobDefinition) Validate() []FieldError {
+	var errs []FieldError
+	if !serviceNamePattern.MatchString(def.Name) {
+		errs = append(errs, FieldError{Field: "name", Message: "must be letters, digits, _, . and -"})
+	}
+	if def.Executable == "" {
+		errs = append(errs, FieldError{Field: "executable", Message: "is required"})
+	}
+	if def.Schedule != "" {
+		if _, err := ParseSchedule(def.Schedule); err != nil {
+			errs = append(errs, FieldError{Field: "schedule", Message: err.Error()})
+		}
+	}
+	if def.Timeout != "" {
+		if d, err := time.ParseDuration(def.Timeout); err != nil || d <= 0 {
+			errs = append(errs, FieldError{Field: "timeout", Message: "must be a positive duration like 10m"})
+		}
+	}
+	errs = append(errs, ValidateTemplates("args", def.Args)...)
+	return append(errs, ValidateEnv("environment_vars", def.EnvironmentVars)...)
+}
+
+// JobRun is one run of a job
+type JobRun struct {
+	ID              int        `json:"id" description:"Counts up from 1 for each job, since the guardian started"`
+	Job             string     `json:"job"`
+	Trigger         string     `json:"trigger" description:"schedule or api"`
+	Status          string     `json:"status" description:"running, succeeded or failed"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds,omitempty"`
+	ExitCode        *int       `json:"exit_code,omitempty" description:"Left out if the process couldn't start or was killed"`
+	Error           string     `json:"error,omitempty"`
+
+	done chan struct{} // Closed when it finishes
+}
+
+// JobStatus is a job's definition and what it's doing
+type JobStatus struct {
+	Name       string     `json:"name"`
+	Executable string     `json:"executable"`
+	Args       []string   `json:"args,omitempty"`
+	Schedule   string     `json:"schedule,omitempty"`
+	Timeout    string     `json:"timeout,omitempty"`
+	Running    bool       `json:"running"`
+	NextRun    *time.Time `json:"next_run,omitempty" description:"When the schedule runs it next"`
+	LastRun    *JobRun    `json:"last_run,omitempty" description:"The run in progress, or the last one to finish"`
+}
+
+// job is a configured job and its runs
+type job struct {
+	def      *JobDefinition
+	schedule *Schedule
+	timeout  time.Duration
+	stop     chan struct{} // Closed to stop scheduling it
+	current  *JobRun       // The run in progress
+	runs     []*JobRun     // Finished runs, oldest first
+	runCount int
+	nextRun  time.Time
+	logs     *FixedSizeLog
+}
+
+// SyncJobs - Make the jobs match the Jobs section of the config. Changed
+// jobs are rescheduled, removed ones stop being scheduled but a run in
+// progress finishes
+func (gg *GladiusGuardian) SyncJobs(defs []*JobDefinition) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, def := range defs {
+		if errs := def.Validate(); len(errs) > 0 {
+			log.WithFields(log.Fields{
+				"job": def.Name,
+				"err": errs[0].Field + " " + errs[0].Message,
+			}).Warn("Skipping invalid job from the config")
+			continue
+		}
+		wanted[def.Name] = true
+
+		j, ok := gg.jobs[def.Name]
+		if ok && reflect.DeepEqual(j.def, def) {
+			continue
+		}
+		if !ok {
+			j = &job{logs: NewFixedSizeLog(configInt("MaxLogLines"))}
+			gg.jobs[def.Name] = j
+		}
+		if j.stop != nil {
+			close(j.stop)
+		}
+
+		// Validate checked these parse
+		j.def = def
+		j.schedule, j.timeout, j.stop, j.nextRun = nil, 0, nil, time.Time{}
+		if def.Timeout != "" {
+			j.timeout, _ = time.ParseDuration(def.Timeout)
+		}
+		if def.Schedule != "" {
+			j.schedule, _ = ParseSchedule(def.Schedule)
+			j.stop = make(chan struct{})
+			go gg.scheduleJob(def.Name, j, j.schedule, j.stop)
+		}
+	}
+
+	for name, j := range gg.jobs {
+		if wanted[name] {
+			continue
+		}
+		if j.stop != nil {
+			close(j.stop)
+		}
+		delete(gg.jobs, name)
+	}
+}
+
+// scheduleJob runs the job each time the schedule fires until stop is
+// closed. A run still going when the next one is due makes it skip that one
+func (gg *GladiusGuardian) scheduleJob(name string, j *job, schedule *Schedule, stop chan struct{}) {
+	for {
+		next := schedule.Next(time.Now())
+		gg.mux.Lock()
+		j.nextRun = next
+		gg.mux.Unlock()
+		if next.IsZero() {
+			log.WithFields(log.Fields{
+				"job": name,
+			}).Warn("Job's schedule never fires")
+			return
+		}
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-stop:
+			return
+		}
+		select {
+		case <-stop:
+			return // Changed while we were waking up
+		default:
+		}
+
+		gg.mux.Lock()
+		paused := gg.maintenance[""] != nil
+		gg.mux.Unlock()
+		if paused {
+			log.WithFields(log.Fields{
+				"job": name,
+			}).Info("Skipped scheduled job run, the guardian is in maintenance mode")
+			gg.events.Publish(EventJobSkipped, name, "Skipped scheduled run of "+name+", the guardian is in maintenance mode", nil)
+			continue
+		}
+
+		_, err := gg.RunJob(name, TriggerSchedule, false)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrJobRunning) {
+			log.WithFields(log.Fields{
+				"job": name,
+			}).Warn("Skipped scheduled job run, the last one is still running")
+			gg.events.Publish(EventJobSkipped, name, "Skipped scheduled run of "+name+", the last one is still running", nil)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"job": name,
+			"err": err,
+		}).Warn("Couldn't run scheduled job")
+	}
+}
+
+// RunJob - Start a run of the job, waiting for it to finish if wait is set.
+// Only one run of a job happens at a time, ErrJobRunning is returned if
+// there's one already
+func (gg *GladiusGuardian) RunJob(name, trigger string, wait bool) (*JobRun, error) {
+	gg.mux.Lock()
+	j, ok := gg.jobs[name]
+	if !ok {
+		gg.mux.Unlock()
+		return nil, &ServiceError{Service: name, Err: ErrJobNotFound}
+	}
+	if j.current != nil {
+		gg.mux.Unlock()
+		return nil, &ServiceError{Service: name, Err: ErrJobRunning}
+	}
+
+	env := append(append([]string{}, configStrings("DefaultEnvironment")...), j.def.EnvironmentVars...)
+	env, args, err := gg.expand(name, 0, env, j.def.Args)
+	if err != nil {
+		gg.mux.Unlock()
+		return nil, &ServiceError{Service: name, Err: err}
+	}
+
+	j.runCount++
+	run := &JobRun{
+		ID:        j.runCount,
+		Job:       name,
+		Trigger:   trigger,
+		Status:    JobRunning,
+		StartedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	j.current = run
+	started := *run
+	location, timeout := j.def.Executable, j.timeout
+	gg.mux.Unlock()
+
+	log.WithFields(log.Fields{
+		"job":     name,
+		"run":     run.ID,
+		"trigger": trigger,
+	}).Debug("Running job")
+	gg.events.Publish(EventJobStarted, name, fmt.Sprintf("Started run %d of %s", run.ID, name), &started)
+	go gg.runJob(name, j, run, location, args, env, timeout)
+
+	if !wait {
+		return &started, nil
+	}
+	<-run.done
+	gg.mux.Lock()
+	finished := *run
+	gg.mux.Unlock()
+	return &finished, nil
+}
+
+// runJob runs the process and records how it went
+func (gg *GladiusGuardian) runJob(name string, j *job, run *JobRun, location string, args, env []string, timeout time.Duration) {
+	j.appendLog(gg, name, fmt.Sprintf("Starting run %d (%s)", run.ID, run.Trigger))
+	exitCode, err := gg.execJob(name, j, location, args, env, timeout)
+
+	gg.mux.Lock()
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+	run.DurationSeconds = finishedAt.Sub(run.StartedAt).Seconds()
+	if exitCode >= 0 {
+		run.ExitCode = &exitCode
+	}
+	run.Status = JobSucceeded
+	if err != nil {
+		run.Status = JobFailed
+		run.Error = err.Error()
+	}
+	j.current = nil
+	j.runs = append(j.runs, run)
+	if len(j.runs) > maxJobRuns {
+		j.runs = j.runs[len(j.runs)-maxJobRuns:]
+	}
+	finished := *run
+	gg.mux.Unlock()
+	close(run.done)
+
+	message := fmt.Sprintf("Run %d of %s succeeded", run.ID, name)
+	if err != nil {
+		message = fmt.Sprintf("Run %d of %s failed: %s", run.ID, name, err)
+		log.WithFields(log.Fields{
+			"job": name,
+			"run": run.ID,
+			"err": err,
+		}).Warn("Job failed")
+	}
+	j.appendLog(gg, name, message)
+	gg.events.Publish(EventJobFinished, name, message, &finished)
+}
+
+// execJob runs the process to completion, returning its exit code or -1 if it
+// didn't get one
+func (gg *GladiusGuardian) execJob(name string, j *job, location string, args, env []string, timeout time.Duration) (int, error) {
+	resolved, secrets, err := gg.resolveEnv(env)
+	if err != nil {
+		return -1, err
+	}
+	return runToCompletion(location, args, resolved, timeout, func(line string) {
+		j.appendLog(gg, name, redactSecrets(line, secrets))
+	})
+}
+
+// runToCompletion runs a command, passing each line it writes to output, and
+// kills it if it takes longer than timeout unless that's 0. It returns the
+// exit code, or -1 if it didn't get one
+func runToCompletion(location string, args, env []string, timeout time.Duration, output func(line string)) (int, error) {
+	// Both outputs go to one pipe so the lines stay in order, and WaitDelay
+	// stops a child the command left behind from keeping it going
+	pr, pw := io.Pipe()
+	p := exec.Command(location, args...)
+	p.Env = env
+	p.Stdout = pw
+	p.Stderr = pw
+	p.WaitDelay = 5 * time.Second
+
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			output(scanner.Text())
+		}
+		io.Copy(ioutil.Discard, pr) // Don't block the process on a line too long to scan
+	}()
+
+	if err := p.Start(); err != nil {
+		pw.Close()
+		<-read
+		return -1, fmt.Errorf("couldn't start: %s", err)
+	}
+
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() { p.Process.Kill() })
+	}
+	err := p.Wait()
+	pw.Close()
+	<-read
+
+	if timer != nil && !timer.Stop() {
+		return -1, fmt.Errorf("killed after the %s timeout", timeout)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+		return exitErr.ExitCode(), fmt.Errorf("exited with %d", exitErr.ExitCode())
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// appendLog adds a line to the job's log and forwards it, the lock must not
+// be held
+func (j *job) appendLog(gg *GladiusGuardian, name, line string) {
+	j.logs.Append(line)
+	gg.mux.Lock()
+	forwarder := gg.logForwarder
+	gg.mux.Unlock()
+	if forwarder != nil {
+		forwarder.Forward(name, line)
+	}
+}
+
+// JobNames - Get the names of the configured jobs, sorted
+func (gg *GladiusGuardian) JobNames() []string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	names := make([]string, 0, len(gg.jobs))
+	for name := range gg.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetJobStatus - Get a job's definition, next scheduled run and last run
+func (gg *GladiusGuardian) GetJobStatus(name string) (*JobStatus, error) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	j, ok := gg.jobs[name]
+	if !ok {
+		return nil, &ServiceError{Service: name, Err: ErrJobNotFound}
+	}
+	status := &JobStatus{
+		Name:       name,
+		Executable: j.def.Executable,
+		Args:       j.def.Args,
+		Schedule:   j.def.Schedule,
+		Timeout:    j.def.Timeout,
+		Running:    j.current != nil,
+	}
+	if !j.nextRun.IsZero() {
+		next := j.nextRun
+		status.NextRun = &next
+	}
+	last := j.current
+	if last == nil && len(j.runs) > 0 {
+		last = j.runs[len(j.runs)-1]
+	}
+	if last != nil {
+		run := *last
+		status.LastRun = &run
+	}
+	return status, nil
+}
+
+// GetJobRuns - Get the run in progress and the remembered finished runs of a
+// job, newest first
+func (gg *GladiusGuardian) GetJobRuns(name string) ([]*JobRun, error) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	j, ok := gg.jobs[name]
+	if !ok {
+		return nil, &ServiceError{Service: name, Err: ErrJobNotFound}
+	}
+	runs := make([]*JobRun, 0, len(j.runs)+1)
+	if j.current != nil {
+		run := *j.current
+		runs = append(runs, &run)
+	}
+	for i := len(j.runs) - 1; i >= 0; i-- {
+		run := *j.runs[i]
+		runs = append(runs, &run)
+	}
+	return runs, nil
+}
+
+// GetJobLogs - Get the most recent lines of a job's runs, all of them if
+// lines is 0
+func (gg *GladiusGuardian) GetJobLogs(name string, lines int) ([]string, error) {
+	gg.mux.Lock()
+	j, ok := gg.jobs[name]
+	gg.mux.Unlock()
+	if !ok {
+		return nil, &ServiceError{Service: name, Err: ErrJobNotFound}
+	}
+
+	logLines := j.logs.LogLines()
+	if lines > 0 && len(logLines) > lines {
+		logLines = logLines[len(logLines)-lines:]
+	}
+	return logLines, nil
+}
+
+// RunJobRequest is the optional body of POST /v2/jobs/{job_name}/run
+type RunJobRequest struct {
+	Async bool `json:"async,omitempty" description:"Answer with an operation straight away instead of waiting for the run to finish"`
+}
+
+// V2ListJobsHandler - GET /v2/jobs
+func V2ListJobsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobs := make([]*JobStatus, 0)
+		for _, name := range gg.JobNames() {
+			status, err := gg.GetJobStatus(name)
+			if err != nil {
+				continue // Removed while we were listing
+			}
+			jobs = append(jobs, status)
+		}
+		ResponseHandler(w, r, "Got jobs", true, nil, jobs)
+	}
+}
+
+// V2GetJobHandler - GET /v2/jobs/{job_name}
+func V2GetJobHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := gg.GetJobStatus(mux.Vars(r)["job_name"])
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't get job", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Got job", true, nil, status)
+	}
+}
+
+// V2JobRunsHandler - GET /v2/jobs/{job_name}/runs
+func V2JobRunsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runs, err := gg.GetJobRuns(mux.Vars(r)["job_name"])
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't get job runs", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Got job runs", true, nil, runs)
+	}
+}
+
+// V2RunJobHandler - POST /v2/jobs/{job_name}/run, waits for the run to finish
+// unless it's async. A job that fails is still a successful operation, the
+// run's status says it failed
+func V2RunJobHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["job_name"]
+		req := &RunJobRequest{}
+		if err := decodeOptionalJSONBody(w, r, req); err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+
+		runOperation(gg, w, r, req.Async || wantsAsync(r), "run", name, func(progress func(string)) (interface{}, error) {
+			progress("running " + name)
+			return gg.RunJob(name, TriggerAPI, true)
+		}, func(op *Operation) {
+			if op.err != nil {
+				ErrorHandler(w, r, "Couldn't run job", op.err, ServiceErrorStatus(op.err))
+				return
+			}
+			ResponseHandler(w, r, "Ran job, see the run's status for how it went", true, nil, op.Result)
+		})
+	}
+}
+
+// V2JobLogsHandler - GET /v2/jobs/{job_name}/logs, the lines query parameter
+// limits it to the newest lines
+func V2JobLogsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lines := 0
+		if l := r.URL.Query().Get("lines"); l != "" {
+			var err error
+			lines, err = strconv.Atoi(l)
+			if err != nil || lines < 0 {
+				ErrorHandler(w, r, "Couldn't parse lines, must be a positive number", err, http.StatusBadRequest)
+				return
+			}
+		}
+
+		logs, err := gg.GetJobLogs(mux.Vars(r)["job_name"], lines)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't get job logs", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Got job logs", true, nil, logs)
+	}
+}
@@ -37,9 +37,24 @@ func (fsl *FixedSizeLog) Append(line string) {
 
 // LogLines returns a string slice representing the underlying values
 func (fsl *FixedSizeLog) LogLines() []string {
+	fsl.mux.Lock()
+	defer fsl.mux.Unlock()
+
 	toReturn := make([]string, 0, 1000)
 	for e := fsl.logList.Front(); e != nil; e = e.Next() {
 		toReturn = append(toReturn, e.Value.(string))
 	}
 	return toReturn
 }
+
+// Resize changes the max number of entries, dropping the oldest ones if there
+// are more than that already
+func (fsl *FixedSizeLog) Resize(maxSize int) {
+	fsl.mux.Lock()
+	defer fsl.mux.Unlock()
+
+	fsl.maxLogSize = maxSize
+	for fsl.logList.Len() > maxSize {
+		fsl.logList.Remove(fsl.logList.Front())
+	}
+}
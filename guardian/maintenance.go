@@ -0,0 +1,207 @@
+package guardian
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maintenance is a maintenance mode, while it's on the guardian leaves the
+// service alone: its restart policy doesn't restart it, and global
+// maintenance also skips scheduled job runs. Starting, stopping and running
+// things through the API still works
+type Maintenance struct {
+	Service string     `json:"service,omitempty" description:"Left out for the global maintenance mode"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   time.Time  `json:"since"`
+	Until   *time.Time `json:"until,omitempty" description:"When it ends by itself, left out if it lasts until it's cleared"`
+}
+
+// maintenance is a maintenance mode and the timer that ends it
+type maintenance struct {
+	Maintenance
+	timer *time.Timer
+}
+
+// MaintenanceRequest is the body of PUT /v2/maintenance and
+// PUT /v2/services/{service_name}/maintenance
+type MaintenanceRequest struct {
+	Reason   string `json:"reason,omitempty" description:"Why, shown in the status and events"`
+	Duration string `json:"duration,omitempty" description:"End it by itself after this long, like 2h. Lasts until it's cleared if left out"`
+}
+
+// Validate checks the duration
+func (req *MaintenanceRequest) Validate() []FieldError {
+	if req.Duration == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(req.Duration); err != nil || d <= 0 {
+		return []FieldError{{Field: "duration", Message: "must be a positive duration like 2h"}}
+	}
+	return nil
+}
+
+// MaintenanceStatus is every maintenance mode that's on
+type MaintenanceStatus struct {
+	Global   *Maintenance   `json:"global,omitempty"`
+	Services []*Maintenance `json:"services"`
+}
+
+// SetMaintenance - Put the service, or the whole guardian for an empty name,
+// in maintenance mode. It ends by itself after duration unless that's 0, and
+// replaces the service's maintenance mode if it's already on
+func (gg *GladiusGuardian) SetMaintenance(name, reason string, duration time.Duration) (*Maintenance, error) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	if _, ok := gg.registeredServices[name]; name != "" && !ok {
+		return nil, &ServiceError{Service: name, Err: ErrServiceNotFound}
+	}
+	if old := gg.maintenance[name]; old != nil && old.timer != nil {
+		old.timer.Stop()
+	}
+
+	m := &maintenance{Maintenance: Maintenance{Service: name, Reason: reason, Since: time.Now()}}
+	if duration > 0 {
+		until := m.Since.Add(duration)
+		m.Until = &until
+		m.timer = time.AfterFunc(duration, func() { gg.endMaintenance(name, m) })
+	}
+	gg.maintenance[name] = m
+
+	label := maintenanceLabel(name)
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"reason":       reason,
+		"duration":     duration.String(),
+	}).Warn("Maintenance mode on, supervision is paused")
+	message := "Maintenance mode on for " + label
+	if reason != "" {
+		message += ": " + reason
+	}
+	status := m.Maintenance
+	gg.events.Publish(EventMaintenanceOn, name, message, &status)
+	return &status, nil
+}
+
+// ClearMaintenance - Take the service, or the whole guardian for an empty
+// name, out of maintenance mode. Nothing happens if it isn't in it
+func (gg *GladiusGuardian) ClearMaintenance(name string) error {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	if _, ok := gg.registeredServices[name]; name != "" && !ok {
+		return &ServiceError{Service: name, Err: ErrServiceNotFound}
+	}
+	if m := gg.maintenance[name]; m != nil {
+		gg.clearMaintenance(name, m, "cleared")
+	}
+	return nil
+}
+
+// endMaintenance is called when a maintenance mode expires
+func (gg *GladiusGuardian) endMaintenance(name string, m *maintenance) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	// It could have been replaced or cleared while the timer fired
+	if gg.maintenance[name] == m {
+		gg.clearMaintenance(name, m, "expired")
+	}
+}
+
+// clearMaintenance ends the maintenance mode, the lock must be held
+func (gg *GladiusGuardian) clearMaintenance(name string, m *maintenance, why string) {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	delete(gg.maintenance, name)
+
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"why":          why,
+	}).Info("Maintenance mode off")
+	status := m.Maintenance
+	gg.events.Publish(EventMaintenanceOff, name, "Maintenance mode "+why+" for "+maintenanceLabel(name), &status)
+}
+
+// inMaintenance returns the maintenance mode the service is in, its own or
+// the global one, or nil. The lock must be held
+func (gg *GladiusGuardian) inMaintenance(name string) *Maintenance {
+	if m := gg.maintenance[name]; m != nil {
+		return &m.Maintenance
+	}
+	if m := gg.maintenance[""]; m != nil {
+		return &m.Maintenance
+	}
+	return nil
+}
+
+// GetMaintenance - Every maintenance mode that's on, services sorted by name
+func (gg *GladiusGuardian) GetMaintenance() *MaintenanceStatus {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	status := &MaintenanceStatus{Services: make([]*Maintenance, 0)}
+	for name, m := range gg.maintenance {
+		copied := m.Maintenance
+		if name == "" {
+			status.Global = &copied
+			continue
+		}
+		status.Services = append(status.Services, &copied)
+	}
+	sort.Slice(status.Services, func(i, j int) bool {
+		return status.Services[i].Service < status.Services[j].Service
+	})
+	return status
+}
+
+func maintenanceLabel(name string) string {
+	if name == "" {
+		return "every service"
+	}
+	return name
+}
+
+// V2GetMaintenanceHandler - GET /v2/maintenance
+func V2GetMaintenanceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got maintenance", true, nil, gg.GetMaintenance())
+	}
+}
+
+// V2SetMaintenanceHandler - PUT /v2/maintenance for the global maintenance
+// mode, or PUT /v2/services/{service_name}/maintenance for one service
+func V2SetMaintenanceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &MaintenanceRequest{}
+		if err := decodeOptionalJSONBody(w, r, req); err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		duration, _ := time.ParseDuration(req.Duration)
+
+		m, err := gg.SetMaintenance(mux.Vars(r)["service_name"], req.Reason, duration)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't set maintenance mode", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Maintenance mode on", true, nil, m)
+	}
+}
+
+// V2ClearMaintenanceHandler - DELETE /v2/maintenance or
+// DELETE /v2/services/{service_name}/maintenance
+func V2ClearMaintenanceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := gg.ClearMaintenance(mux.Vars(r)["service_name"]); err != nil {
+			ErrorHandler(w, r, "Couldn't clear maintenance mode", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Maintenance mode off", true, nil, gg.GetMaintenance())
+	}
+}
@@ -0,0 +1,102 @@
+package guardian_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+)
+
+func TestMaintenanceExpiry(t *testing.T) {
+	type step struct {
+		service, reason string
+		duration        time.Duration
+		clear           bool
+	}
+	tests := []struct {
+		name         string
+		steps        []step
+		wantGlobal   string   // Reason of the global maintenance left on
+		wantServices []string // Reasons of the service ones left on
+		wantEvents   []string
+	}{
+		{"expires", []step{{"edged", "a", 100 * time.Millisecond, false}}, "", []string{},
+			[]string{"Maintenance mode on for edged: a", "Maintenance mode expired for edged"}},
+		{"replaced with one that doesn't expire", []step{{"edged", "a", 100 * time.Millisecond, false}, {"edged", "b", 0, false}}, "", []string{"b"},
+			[]string{"Maintenance mode on for edged: a", "Maintenance mode on for edged: b"}},
+		{"replaced with a longer one", []step{{"edged", "a", 100 * time.Millisecond, false}, {"edged", "b", time.Hour, false}}, "", []string{"b"},
+			[]string{"Maintenance mode on for edged: a", "Maintenance mode on for edged: b"}},
+		{"replaced with a shorter one", []step{{"edged", "a", time.Hour, false}, {"edged", "b", 100 * time.Millisecond, false}}, "", []string{},
+			[]string{"Maintenance mode on for edged: a", "Maintenance mode on for edged: b", "Maintenance mode expired for edged"}},
+		{"cleared before it expires", []step{{"edged", "a", 100 * time.Millisecond, false}, {"edged", "", 0, true}}, "", []string{},
+			[]string{"Maintenance mode on for edged: a", "Maintenance mode cleared for edged"}},
+		{"clearing when it's off", []step{{"edged", "", 0, true}}, "", []string{}, []string{}},
+		{"global expires", []step{{"", "upgrade", 100 * time.Millisecond, false}}, "", []string{},
+			[]string{"Maintenance mode on for every service: upgrade", "Maintenance mode expired for every service"}},
+		{"global and service are separate", []step{{"", "upgrade", 0, false}, {"edged", "a", 100 * time.Millisecond, false}}, "upgrade", []string{},
+			[]string{"Maintenance mode on for every service: upgrade", "Maintenance mode on for edged: a", "Maintenance mode expired for edged"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			gg := guardian.New()
+			gg.RegisterService("edged", "edged", nil, 1)
+			for _, s := range test.steps {
+				var err error
+				if s.clear {
+					err = gg.ClearMaintenance(s.service)
+				} else {
+					_, err = gg.SetMaintenance(s.service, s.reason, s.duration)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(300 * time.Millisecond)
+
+			status := gg.GetMaintenance()
+			global := ""
+			if status.Global != nil {
+				global = status.Global.Reason
+			}
+			services := make([]string, 0)
+			for _, m := range status.Services {
+				services = append(services, m.Reason)
+			}
+			if global != test.wantGlobal || !reflect.DeepEqual(services, test.wantServices) {
+				t.Errorf("got global %q and services %q, want %q and %q", global, services, test.wantGlobal, test.wantServices)
+			}
+			events := make([]string, 0)
+			for _, e := range gg.Events().Since(0) {
+				if e.Type == guardian.EventMaintenanceOn || e.Type == guardian.EventMaintenanceOff {
+					events = append(events, e.Message)
+				}
+			}
+			if !reflect.DeepEqual(events, test.wantEvents) {
+				t.Errorf("got events %q, want %q", events, test.wantEvents)
+			}
+		})
+	}
+}
+
+func TestMaintenanceUntil(t *testing.T) {
+	gg := guardian.New()
+	gg.RegisterService("edged", "edged", nil, 1)
+	if _, err := gg.SetMaintenance("missing", "", 0); !errors.Is(err, guardian.ErrServiceNotFound) {
+		t.Errorf("maintenance for a service that isn't registered: got %v", err)
+	}
+
+	m, err := gg.SetMaintenance("edged", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Until == nil || m.Until.Sub(m.Since) != time.Hour {
+		t.Errorf("got until %v since %s, want an hour later", m.Until, m.Since)
+	}
+	if m, _ = gg.SetMaintenance("edged", "", 0); m.Until != nil {
+		t.Errorf("replacing it with one that doesn't expire kept until %s", m.Until)
+	}
+}
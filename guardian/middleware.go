@@ -0,0 +1,23 @@
+package guardian
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// APIMiddleware returns the middleware every API request goes through, in
+// the order they have to run. The body limit goes first so the rest can read
+// the body, failed authentication is limited and requests are audited before
+// they're authenticated so guessed tokens are throttled and recorded, and
+// the service cooldown goes after permissions so denied requests don't start
+// one
+func APIMiddleware(maxBodyBytes int64, limiter *RateLimiter, audit *AuditLog, auth *Authenticator) []mux.MiddlewareFunc {
+	return []mux.MiddlewareFunc{
+		BodyLimitMiddleware(maxBodyBytes),
+		limiter.AddressMiddleware(),
+		AuditMiddleware(audit),
+		AuthMiddleware(auth),
+		limiter.ClientMiddleware(),
+		PermissionMiddleware(),
+		limiter.CooldownMiddleware(),
+	}
+}
@@ -0,0 +1,69 @@
+package guardian_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// apiRouter has start, stop and scale routes behind the API middleware,
+// starting the service "broken" fails with a 409
+func apiRouter(t *testing.T, mode string, limiter *guardian.RateLimiter) (*mux.Router, *guardian.AuditLog) {
+	viper.Set("Auth.Mode", mode)
+	viper.Set("Auth.TokensFile", "")
+	viper.Set("Auth.Tokens", []map[string]interface{}{
+		{"name": "operator", "hash": guardian.HashToken("operator-token"), "role": guardian.RoleOperator},
+		{"name": "viewer", "hash": guardian.HashToken("viewer-token"), "role": guardian.RoleViewer},
+	})
+	auth, err := guardian.NewAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := guardian.NewAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+
+	action := func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["service_name"] == "broken" {
+			guardian.ErrorHandler(w, r, "Couldn't start service", errors.New("it's broken"), http.StatusConflict)
+			return
+		}
+		guardian.ResponseHandler(w, r, "Done", true, nil, nil)
+	}
+	r := mux.NewRouter()
+	r.Use(guardian.APIMiddleware(1<<20, limiter, audit, auth)...)
+	r.HandleFunc("/v2/services", action).Methods("GET").Name("v2_list_services")
+	r.HandleFunc("/v2/services/{service_name}/start", action).Methods("POST").Name("v2_start_service")
+	r.HandleFunc("/v2/services/{service_name}/stop", action).Methods("POST").Name("v2_stop_service")
+	r.HandleFunc("/v2/services/{service_name}/scale", action).Methods("POST").Name("v2_scale_service")
+	return r, audit
+}
+
+type apiRequest struct {
+	addr, token, method, path string
+	want                      int
+}
+
+func serve(t *testing.T, r *mux.Router, requests []apiRequest) {
+	t.Helper()
+	for i, req := range requests {
+		httpReq := httptest.NewRequest(req.method, req.path, nil)
+		httpReq.RemoteAddr = req.addr + ":40000"
+		if req.token != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+req.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httpReq)
+		if w.Code != req.want {
+			t.Errorf("request %d, %s %s from %s: got %d, want %d", i, req.method, req.path, req.addr, w.Code, req.want)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package guardian
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routeDoc describes a named route for the OpenAPI document
+type routeDoc struct {
+	Summary   string
+	Tags      []string
+	Request   interface{}  // Zero value of the body type, nil if there is no body
+	Response  interface{}  // Zero value of the type in the response field
+	Query     []queryParam // Query string parameters
+	WebSocket bool         // Upgrades to a WebSocket instead of answering with JSON
+	Async     bool         // Can answer with an operation instead, see runOperation
+}
+
+type queryParam struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+// routeDocs documents the routes registered in main.go by name, the paths
+// and methods come from the router itself so they can't drift
+var routeDocs = map[string]*routeDoc{
+	"index": {
+		Summary:  "The dashboard for browsers (Accept: text/html), otherwise a pointer to the API docs",
+		Tags:     []string{"guardian"},
+		Response: "",
+	},
+	"dashboard_asset": {
+		Summary: "Scripts and styles of the dashboard, app.js or app.css",
+		Tags:    []string{"guardian"},
+	},
+	"service_stats": {
+		Summary:  "Status of one service, or every service if the name is all",
+		Tags:     []string{"services"},
+		Response: map[string]*serviceStatus{},
+	},
+	"set_state": {
+		Summary:  "Start or stop a service, or every service if the name is all",
+		Tags:     []string{"services"},
+		Request:  SetStateRequest{},
+		Response: map[string]*serviceStatus{},
+		Async:    true,
+	},
+	"desired": {
+		Summary:  "Start, stop or restart whatever differs from the desired state, or only plan it with dry_run",
+		Tags:     []string{"services"},
+		Request:  DesiredStateRequest{},
+		Response: DesiredStateResult{},
+		Async:    true,
+		Query: []queryParam{
+			{Name: "dry_run", Type: "boolean", Description: "Only return the plan"},
+		},
+	},
+	"register_service": {
+		Summary:  "Add a service to supervise, 409 if the name is taken",
+		Tags:     []string{"services"},
+		Request:  RegisterRequest{},
+		Response: serviceStatus{},
+	},
+	"unregister_service": {
+		Summary: "Remove a service registered through the API, 409 if it's running or came from the config",
+		Tags:    []string{"services"},
+		Query: []queryParam{
+			{Name: "stop", Type: "boolean", Description: "Stop it first if it's running"},
+		},
+	},
+	"set_timeout": {
+		Summary:  "Set how long to wait for services, or one service, to start and stop",
+		Tags:     []string{"services"},
+		Request:  SetTimeoutRequest{},
+		Response: TimeoutResponse{},
+	},
+	"service_logs": {
+		Summary:  "Recent log lines of every service",
+		Tags:     []string{"logs"},
+		Response: map[string][]string{},
+	},
+	"service_ws_log": {
+		Summary:   "WebSocket streaming new log lines of a service as text messages",
+		Tags:      []string{"logs"},
+		WebSocket: true,
+	},
+	"version": {
+		Summary:  "Whether the Gladius components are older (-1), current (0) or newer (1) than the official release",
+		Tags:     []string{"guardian"},
+		Response: map[string]int{},
+	},
+	"audit": {
+		Summary:  "Query the audit log of control actions",
+		Tags:     []string{"guardian"},
+		Response: []*AuditEntry{},
+		Query: []queryParam{
+			{Name: "service", Type: "string", Description: "Only entries for this service"},
+			{Name: "identity", Type: "string", Description: "Only entries by this token name"},
+			{Name: "action", Type: "string", Description: "Only entries for this action"},
+			{Name: "since", Type: "string", Description: "Only entries after this RFC 3339 time"},
+			{Name: "limit", Type: "integer", Description: "Newest entries to return, 100 by default"},
+		},
+	},
+	"operations": {
+		Summary:  "Recent operations, newest first",
+		Tags:     []string{"operations"},
+		Response: []*Operation{},
+	},
+	"operation": {
+		Summary:  "Progress and result of an operation started with async",
+		Tags:     []string{"operations"},
+		Response: Operation{},
+	},
+	"events": {
+		Summary:  "Recent events",
+		Tags:     []string{"events"},
+		Response: []*Event{},
+		Query: []queryParam{
+			{Name: "since", Type: "integer", Description: "Only events after this event ID"},
+		},
+	},
+	"events_ws": {
+		Summary:   "WebSocket streaming new events as JSON messages",
+		Tags:      []string{"events"},
+		WebSocket: true,
+		Query: []queryParam{
+			{Name: "since", Type: "integer", Description: "Send the remembered events after this event ID first"},
+		},
+	},
+	"config": {
+		Summary:  "Settings the guardian is running with and whether each came from the file, environment or defaults, secrets are redacted",
+		Tags:     []string{"guardian"},
+		Response: EffectiveConfig{},
+	},
+	"config_reload": {
+		Summary:  "Read the config file again, applying what can change without a restart. 422 if it's invalid, nothing is changed then",
+		Tags:     []string{"guardian"},
+		Response: ReloadResult{},
+	},
+	"openapi": {
+		Summary:  "This document",
+		Tags:     []string{"guardian"},
+		Response: map[string]interface{}{},
+	},
+
+	"v2_list_services": {
+		Summary:  "Status of every registered service",
+		Tags:     []string{"v2"},
+		Response: []*serviceStatus{},
+	},
+	"v2_get_service": {
+		Summary:  "Status of a service, 404 if it isn't registered",
+		Tags:     []string{"v2"},
+		Response: serviceStatus{},
+	},
+	"v2_start_service": {
+		Summary:  "Start a service, 409 if it's already running",
+		Tags:     []string{"v2"},
+		Request:  StartRequest{},
+		Response: serviceStatus{},
+		Async:    true,
+	},
+	"v2_stop_service": {
+		Summary:  "Stop a service, 409 if it isn't running",
+		Tags:     []string{"v2"},
+		Response: serviceStatus{},
+		Async:    true,
+	},
+	"v2_restart": {
+		Summary:  "Stop a service if it's running and start it again",
+		Tags:     []string{"v2"},
+		Request:  StartRequest{},
+		Response: serviceStatus{},
+		Async:    true,
+	},
+	"v2_service_logs": {
+		Summary:  "Recent log lines of a service",
+		Tags:     []string{"v2"},
+		Response: []string{},
+		Query: []queryParam{
+			{Name: "lines", Type: "integer", Description: "Only the newest lines"},
+			{Name: "instance", Type: "integer", Description: "Only the lines of this instance"},
+		},
+	},
+	"v2_scale_service": {
+		Summary:  "Set how many instances of a service run, started or stopped straight away if it's running",
+		Tags:     []string{"v2"},
+		Request:  ScaleRequest{},
+		Response: serviceStatus{},
+		Async:    true,
+	},
+	"v2_list_jobs": {
+		Summary:  "Every configured job with its next and last run",
+		Tags:     []string{"v2"},
+		Response: []*JobStatus{},
+	},
+	"v2_get_job": {
+		Summary:  "A job with its next and last run",
+		Tags:     []string{"v2"},
+		Response: JobStatus{},
+	},
+	"v2_run_job": {
+		Summary:  "Run a job and wait for it to finish, 409 if it's already running",
+		Tags:     []string{"v2"},
+		Request:  RunJobRequest{},
+		Response: JobRun{},
+		Async:    true,
+	},
+	"v2_job_runs": {
+		Summary:  "The run in progress and the recent runs of a job, newest first",
+		Tags:     []string{"v2"},
+		Response: []*JobRun{},
+	},
+	"v2_job_logs": {
+		Summary:  "Recent output of a job's runs",
+		Tags:     []string{"v2"},
+		Response: []string{},
+		Query: []queryParam{
+			{Name: "lines", Type: "integer", Description: "Only the newest lines"},
+		},
+	},
+	"v2_maintenance": {
+		Summary:  "The global maintenance mode and the services in maintenance mode",
+		Tags:     []string{"v2"},
+		Response: MaintenanceStatus{},
+	},
+	"v2_set_maintenance": {
+		Summary:  "Pause restart policies of every service and scheduled jobs, optionally until duration has passed",
+		Tags:     []string{"v2"},
+		Request:  MaintenanceRequest{},
+		Response: Maintenance{},
+	},
+	"v2_clear_maintenance": {
+		Summary:  "End the global maintenance mode, services in their own stay in it",
+		Tags:     []string{"v2"},
+		Response: MaintenanceStatus{},
+	},
+	"v2_set_service_maintenance": {
+		Summary:  "Pause the restart policy of a service, optionally until duration has passed",
+		Tags:     []string{"v2"},
+		Request:  MaintenanceRequest{},
+		Response: Maintenance{},
+	},
+	"v2_clear_service_maintenance": {
+		Summary:  "End the maintenance mode of a service",
+		Tags:     []string{"v2"},
+		Response: MaintenanceStatus{},
+	},
+}
+
+var pathVarPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// OpenAPIHandler - Serve an OpenAPI 3 document generated from the routes
+// registered on the router
+func OpenAPIHandler(router *mux.Router, version string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc := BuildOpenAPI(router, version)
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(doc)
+	}
+}
+
+// BuildOpenAPI generates the OpenAPI document for the router
+func BuildOpenAPI(router *mux.Router, version string) map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil || len(methods) == 0 {
+			methods = []string{"GET"}
+		}
+
+		doc, ok := routeDocs[route.GetName()]
+		if !ok {
+			doc = &routeDoc{Summary: tmpl, Response: map[string]interface{}{}}
+		}
+
+		path := pathVarPattern.ReplaceAllString(tmpl, "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		for _, method := range methods {
+			paths[path][strings.ToLower(method)] = operation(route.GetName(), tmpl, doc)
+		}
+		return nil
+	})
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":       "Gladius Guardian",
+			"description": "Watchdog service for managing the various Gladius processes",
+			"version":     version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+			"schemas": map[string]interface{}{
+				"Error": envelopeSchema(nil),
+			},
+		},
+		"security": []map[string][]string{{"bearer": {}}},
+	}
+}
+
+func operation(name, tmpl string, doc *routeDoc) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary": doc.Summary,
+	}
+	if name != "" {
+		op["operationId"] = name
+	}
+	if len(doc.Tags) > 0 {
+		op["tags"] = doc.Tags
+	}
+
+	params := make([]map[string]interface{}, 0)
+	for _, m := range pathVarPattern.FindAllStringSubmatch(tmpl, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]string{"type": "string"},
+		})
+	}
+	query := doc.Query
+	if doc.Async {
+		query = append(query, queryParam{Name: "async", Type: "boolean", Description: "Answer with 202 and an operation straight away instead of waiting"})
+	}
+	for _, q := range query {
+		params = append(params, map[string]interface{}{
+			"name":        q.Name,
+			"in":          "query",
+			"description": q.Description,
+			"schema":      map[string]string{"type": q.Type},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if doc.Request != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": schemaFor(reflect.TypeOf(doc.Request)),
+				},
+			},
+		}
+	}
+
+	errorResponse := map[string]interface{}{
+		"description": "Error, see the code and fields",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]string{"$ref": "#/components/schemas/Error"},
+			},
+		},
+	}
+	responses := map[string]interface{}{
+		"400": errorResponse,
+		"401": errorResponse,
+		"403": errorResponse,
+		"404": errorResponse,
+		"409": errorResponse,
+		"429": errorResponse,
+	}
+	if doc.WebSocket {
+		responses["101"] = map[string]interface{}{"description": "Switching to the WebSocket protocol"}
+	} else {
+		var resType reflect.Type
+		if doc.Response != nil {
+			resType = reflect.TypeOf(doc.Response)
+		}
+		responses["200"] = map[string]interface{}{
+			"description": "Success",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": envelopeSchema(resType),
+				},
+			},
+		}
+	}
+	if doc.Async {
+		responses["202"] = map[string]interface{}{
+			"description": "Operation started, or still running after " + syncOperationWait.String() + " without async. Poll the URL in the Location header",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": envelopeSchema(reflect.TypeOf(Operation{})),
+				},
+			},
+		}
+	}
+	op["responses"] = responses
+
+	return op
+}
+
+// envelopeSchema is the Response envelope with the response field set to t
+func envelopeSchema(t reflect.Type) map[string]interface{} {
+	s := schemaFor(reflect.TypeOf(Response{}))
+	res := map[string]interface{}{"nullable": true}
+	if t != nil {
+		res = schemaFor(t)
+	}
+	s["properties"].(map[string]interface{})["response"] = res
+	return s
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaFor builds a JSON schema for a Go type from its json tags, fields
+// tagged required:"true" are required and description tags are used as is
+func schemaFor(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		required := make([]string, 0)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if f.PkgPath != "" || tag == "-" {
+				continue // Unexported or skipped
+			}
+			name := jsonFieldName(f)
+			prop := schemaFor(f.Type)
+			if d := f.Tag.Get("description"); d != "" {
+				prop["description"] = d
+			}
+			props[name] = prop
+			if f.Tag.Get("required") == "true" {
+				required = append(required, name)
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+		if len(required) > 0 {
+			sort.Strings(required)
+			s["required"] = required
+		}
+		return s
+	}
+	return map[string]interface{}{}
+}
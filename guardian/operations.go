@@ -0,0 +1,294 @@
+package guardian
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Statuses an operation goes through
+const (
+	OperationPending   = "pending"
+	OperationRunning   = "running"
+	OperationSucceeded = "succeeded"
+	OperationFailed    = "failed"
+)
+
+// Operation is a start, stop or restart that runs in the background, its ID
+// can be polled or watched for on the event stream
+type Operation struct {
+	ID        string      `json:"id"`
+	Action    string      `json:"action"`
+	Service   string      `json:"service"`
+	Identity  string      `json:"identity,omitempty"`
+	Status    string      `json:"status" description:"pending, running, succeeded or failed"`
+	Progress  string      `json:"progress"`
+	Error     string      `json:"error,omitempty"`
+	ErrorCode string      `json:"error_code,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+	Created   time.Time   `json:"created"`
+	Started   *time.Time  `json:"started,omitempty"`
+	Finished  *time.Time  `json:"finished,omitempty"`
+
+	err  error         // The error as returned, for the status code
+	done chan struct{} // Closed when the operation finishes
+}
+
+// operationFunc does the work of an operation, calling progress as it goes
+type operationFunc func(progress func(string)) (interface{}, error)
+
+// operationStore runs operations and remembers the most recent ones
+type operationStore struct {
+	mux         sync.Mutex
+	operations  map[string]*Operation
+	order       []string // IDs, oldest first
+	maxFinished int
+	events      *EventBus
+}
+
+func newOperationStore(events *EventBus, maxFinished int) *operationStore {
+	return &operationStore{
+		operations:  make(map[string]*Operation),
+		maxFinished: maxFinished,
+		events:      events,
+	}
+}
+
+// Start runs f in the background and returns the new operation
+func (s *operationStore) Start(action, service, identity string, f operationFunc) *Operation {
+	op := &Operation{
+		ID:       newOperationID(),
+		Action:   action,
+		Service:  service,
+		Identity: identity,
+		Status:   OperationPending,
+		Progress: "queued",
+		Created:  time.Now(),
+		done:     make(chan struct{}),
+	}
+
+	s.mux.Lock()
+	s.operations[op.ID] = op
+	s.order = append(s.order, op.ID)
+	s.prune()
+	s.mux.Unlock()
+	s.announce(op)
+
+	go func() {
+		s.update(op, func() {
+			now := time.Now()
+			op.Status = OperationRunning
+			op.Progress = "in progress"
+			op.Started = &now
+		})
+
+		result, err := f(func(progress string) {
+			s.update(op, func() { op.Progress = progress })
+		})
+
+		s.update(op, func() {
+			now := time.Now()
+			op.Finished = &now
+			op.Result = result
+			op.err = err
+			if err != nil {
+				op.Status = OperationFailed
+				op.Progress = "failed"
+				op.Error = err.Error()
+				op.ErrorCode = codeForStatus(ServiceErrorStatus(err))
+			} else {
+				op.Status = OperationSucceeded
+				op.Progress = "done"
+			}
+		})
+		close(op.done)
+	}()
+
+	return s.snapshot(op)
+}
+
+// Get returns a copy of the operation, or nil if it's unknown or has been
+// forgotten
+func (s *operationStore) Get(id string) *Operation {
+	s.mux.Lock()
+	op, ok := s.operations[id]
+	s.mux.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.snapshot(op)
+}
+
+// List returns copies of the remembered operations, newest first
+func (s *operationStore) List() []*Operation {
+	s.mux.Lock()
+	ops := make([]*Operation, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		ops = append(ops, s.operations[s.order[i]])
+	}
+	s.mux.Unlock()
+
+	for i, op := range ops {
+		ops[i] = s.snapshot(op)
+	}
+	return ops
+}
+
+// Wait blocks until the operation finishes, or for at most timeout if it
+// isn't 0, and returns its state and whether it finished
+func (s *operationStore) Wait(id string, timeout time.Duration) (*Operation, bool) {
+	s.mux.Lock()
+	op, ok := s.operations[id]
+	s.mux.Unlock()
+	if !ok {
+		return nil, false
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case <-op.done:
+		return s.snapshot(op), true
+	case <-expired:
+		return s.snapshot(op), false
+	}
+}
+
+func (s *operationStore) update(op *Operation, f func()) {
+	s.mux.Lock()
+	f()
+	s.mux.Unlock()
+	s.announce(op)
+}
+
+func (s *operationStore) snapshot(op *Operation) *Operation {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	c := *op
+	return &c
+}
+
+func (s *operationStore) announce(op *Operation) {
+	c := s.snapshot(op)
+	if s.events != nil {
+		message := c.Action + " " + c.Status + ": " + c.Progress
+		if c.Error != "" {
+			message = c.Action + " failed: " + c.Error
+		}
+		s.events.Publish(EventOperation, c.Service, message, c)
+	}
+}
+
+// prune forgets the oldest finished operations beyond the limit, the lock
+// must be held
+func (s *operationStore) prune() {
+	finished := 0
+	for _, id := range s.order {
+		if s.operations[id].Finished != nil {
+			finished++
+		}
+	}
+
+	kept := s.order[:0]
+	for _, id := range s.order {
+		if finished > s.maxFinished && s.operations[id].Finished != nil {
+			delete(s.operations, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+}
+
+func newOperationID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		// Not secret, just unique
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// wantsAsync returns true if the async query parameter is set
+func wantsAsync(r *http.Request) bool {
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+	return async
+}
+
+// APIWriteTimeout is the write timeout of the API server, every answer has to
+// be written within it
+const APIWriteTimeout = 15 * time.Second
+
+// syncOperationWait is how long a request that didn't ask for an operation
+// waits for one, well within APIWriteTimeout so there's time left to answer
+const syncOperationWait = APIWriteTimeout / 3
+
+// runOperation starts an operation and either answers with 202 and the
+// operation straight away, or waits for it and hands the result to done.
+// Operations still running after syncOperationWait are answered with 202 as
+// if they were async. Answers with 202 are audited again once the operation
+// finishes
+func runOperation(gg *GladiusGuardian, w http.ResponseWriter, r *http.Request, async bool, action, service string, f operationFunc, done func(op *Operation)) {
+	identity := ""
+	if id := IdentityFromRequest(r); id != nil {
+		identity = id.Name
+	}
+
+	op := gg.operations.Start(action, service, identity, f)
+	message := "Started " + action + " operation, poll it for the result"
+	if !async {
+		finished, ok := gg.operations.Wait(op.ID, syncOperationWait)
+		if ok {
+			done(finished)
+			return
+		}
+		op = finished
+		message = "The " + action + " operation is taking a while, poll it for the result"
+	}
+
+	log.WithFields(log.Fields{
+		"operation":    op.ID,
+		"action":       action,
+		"service_name": service,
+		"async":        async,
+	}).Debug("Answering with the operation")
+	gg.auditOperation(r, op)
+
+	w.Header().Set("Location", "/service/operations/"+op.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeResponse(w, r, Response{
+		Message:  message,
+		Success:  true,
+		Response: op,
+		Endpoint: endpoint(r),
+	})
+}
+
+// GetOperationHandler - Get the progress and result of an operation
+func GetOperationHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op := gg.operations.Get(mux.Vars(r)["operation_id"])
+		if op == nil {
+			ErrorHandler(w, r, "Couldn't get operation", &APIError{Code: CodeNotFound, Message: "no such operation, it may have been forgotten"}, http.StatusNotFound)
+			return
+		}
+		ResponseHandler(w, r, "Got operation", true, nil, op)
+	}
+}
+
+// GetOperationsHandler - List the remembered operations, newest first
+func GetOperationsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got operations", true, nil, gg.operations.List())
+	}
+}
@@ -1,28 +1,128 @@
 package guardian
 
 import (
-	"errors"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-
-	"github.com/buger/jsonparser"
+	"reflect"
+	"strings"
 )
 
-func getJSONFields(w http.ResponseWriter, r *http.Request, fields ...string) (map[string][]byte, error) {
-	body, err := ioutil.ReadAll(r.Body)
+// decodeJSONBody strictly decodes the request body into v, unknown fields,
+// wrong types and missing required fields are all errors. The error is
+// always an *APIError
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body, err := readBody(w, r)
 	if err != nil {
-		ErrorHandler(w, r, "", err, http.StatusBadRequest)
-		return nil, errors.New("error decoding body")
+		return err
+	}
+	if len(body) == 0 {
+		return &APIError{Code: CodeInvalidBody, Message: "request body is empty, expected a JSON object"}
+	}
+	return decodeJSON(body, v)
+}
+
+// decodeOptionalJSONBody is decodeJSONBody for endpoints where the body can
+// be left out entirely
+func decodeOptionalJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body, err := readBody(w, r)
+	if err != nil || len(body) == 0 {
+		return err
+	}
+	return decodeJSON(body, v)
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	// The body limit middleware normally catches this first
+	reader := r.Body
+	if maxBytes := configInt64("API.MaxBodyBytes"); maxBytes > 0 {
+		reader = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, &APIError{Code: CodeInvalidBody, Message: "couldn't read body: " + err.Error()}
+	}
+	return bytes.TrimSpace(body), nil
+}
+
+func decodeJSON(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if dec.More() {
+		return &APIError{Code: CodeInvalidBody, Message: "unexpected data after the JSON object"}
 	}
 
-	vals := make(map[string][]byte)
+	fields := checkRequired(v)
+	if len(fields) == 0 {
+		if validator, ok := v.(requestValidator); ok {
+			fields = validator.Validate()
+		}
+	}
+	if len(fields) > 0 {
+		return &APIError{Code: CodeValidation, Message: "request body is invalid", Fields: fields}
+	}
 
-	for _, field := range fields {
-		valBytes, _, _, err := jsonparser.Get(body, field)
-		if err == nil {
-			vals[field] = valBytes
+	return nil
+}
+
+// decodeError turns a JSON decoding error into field errors where possible
+func decodeError(err error) *APIError {
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		field := e.Field
+		if field == "" {
+			field = "(body)"
+		}
+		return &APIError{
+			Code:    CodeValidation,
+			Message: "request body is invalid",
+			Fields: []FieldError{{
+				Field:   field,
+				Message: fmt.Sprintf("must be %s, got %s", jsonTypeName(e.Type), e.Value),
+			}},
 		}
+	case *json.SyntaxError:
+		return &APIError{Code: CodeInvalidBody, Message: fmt.Sprintf("invalid JSON at offset %d: %s", e.Offset, e)}
 	}
 
-	return vals, nil
+	// The decoder has no error type for unknown fields
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		return &APIError{
+			Code:    CodeValidation,
+			Message: "request body is invalid",
+			Fields: []FieldError{{
+				Field:   strings.Trim(strings.TrimPrefix(msg, "json: unknown field "), `"`),
+				Message: "is not a known field",
+			}},
+		}
+	}
+
+	return &APIError{Code: CodeInvalidBody, Message: "couldn't decode body: " + err.Error()}
+}
+
+// jsonTypeName describes a Go type in JSON terms for error messages
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Ptr:
+		return jsonTypeName(t.Elem())
+	}
+	return t.String()
 }
@@ -0,0 +1,227 @@
+package guardian
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Roles a token can have
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// Permission is an action a token can be allowed to take
+type Permission string
+
+// Permissions checked by the router
+const (
+	PermissionRead    Permission = "read"    // Status, logs, versions
+	PermissionStart   Permission = "start"   // Start a service
+	PermissionStop    Permission = "stop"    // Stop a service
+	PermissionRestart Permission = "restart" // Restart a service
+	PermissionAdmin   Permission = "admin"   // Guardian settings and everything else
+)
+
+// rolePermissions are the permissions each role has unless a token narrows
+// them down
+var rolePermissions = map[string][]Permission{
+	RoleViewer:   {PermissionRead},
+	RoleOperator: {PermissionRead, PermissionStart, PermissionStop, PermissionRestart},
+	RoleAdmin:    {PermissionRead, PermissionStart, PermissionStop, PermissionRestart, PermissionAdmin},
+}
+
+// routePermissions maps the names of the routes registered in main.go to the
+// permission needed to use them. Unnamed routes need read for GET and admin
+// for everything else
+var routePermissions = map[string]func(r *http.Request) Permission{
+	"index":              staticPermission(PermissionRead),
+	"dashboard_asset":    staticPermission(PermissionRead),
+	"service_stats":      staticPermission(PermissionRead),
+	"set_state":          setStatePermission,
+	"set_timeout":        staticPermission(PermissionAdmin),
+	"desired":            staticPermission(PermissionRead), // Checked per service by the handler
+	"service_logs":       staticPermission(PermissionRead),
+	"service_ws_log":     staticPermission(PermissionRead),
+	"version":            staticPermission(PermissionRead),
+	"audit":              staticPermission(PermissionAdmin),
+	"openapi":            staticPermission(PermissionRead),
+	"operations":         staticPermission(PermissionRead),
+	"operation":          staticPermission(PermissionRead),
+	"events":             staticPermission(PermissionRead),
+	"events_ws":          staticPermission(PermissionRead),
+	"config":             staticPermission(PermissionAdmin),
+	"config_reload":      staticPermission(PermissionAdmin),
+	"register_service":   staticPermission(PermissionAdmin),
+	"unregister_service": staticPermission(PermissionAdmin),
+
+	"v2_list_services": staticPermission(PermissionRead),
+	"v2_get_service":   staticPermission(PermissionRead),
+	"v2_start_service": staticPermission(PermissionStart),
+	"v2_stop_service":  staticPermission(PermissionStop),
+	"v2_restart":       staticPermission(PermissionRestart),
+	"v2_service_logs":  staticPermission(PermissionRead),
+	"v2_scale_service": staticPermission(PermissionRestart),
+	"v2_list_jobs":     staticPermission(PermissionRead),
+	"v2_get_job":       staticPermission(PermissionRead),
+	"v2_run_job":       staticPermission(PermissionStart),
+	"v2_job_runs":      staticPermission(PermissionRead),
+	"v2_job_logs":      staticPermission(PermissionRead),
+	"v2_maintenance":   staticPermission(PermissionRead),
+
+	// Pausing supervision of one service is an operator's call, of every
+	// service and the jobs an admin's
+	"v2_set_service_maintenance":   staticPermission(PermissionRestart),
+	"v2_clear_service_maintenance": staticPermission(PermissionRestart),
+	"v2_set_maintenance":           staticPermission(PermissionAdmin),
+	"v2_clear_maintenance":         staticPermission(PermissionAdmin),
+}
+
+func staticPermission(p Permission) func(r *http.Request) Permission {
+	return func(r *http.Request) Permission { return p }
+}
+
+// setStatePermission needs start or stop depending on the requested state,
+// the body is decoded the same way the handler does it so both see the same
+// state, and put back for the handler
+func setStatePermission(r *http.Request) Permission {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return PermissionAdmin
+	}
+
+	req := &SetStateRequest{}
+	if err := decodeJSON(body, req); err != nil {
+		// Let the handler report the bad body, but only to someone who could
+		// have done either
+		return PermissionAdmin
+	}
+	if *req.Running {
+		return PermissionStart
+	}
+	return PermissionStop
+}
+
+// validate checks the role and permissions of a token from the config
+func (t *APIToken) validate() error {
+	if t.Role == "" {
+		t.Role = RoleViewer
+	}
+	allowed, ok := rolePermissions[t.Role]
+	if !ok {
+		return fmt.Errorf("unknown role %q for token %q, must be viewer, operator or admin", t.Role, t.Name)
+	}
+	for _, p := range t.Permissions {
+		if !hasPermission(allowed, p) {
+			return fmt.Errorf("token %q has permission %q which its role %s doesn't allow", t.Name, p, t.Role)
+		}
+	}
+	return nil
+}
+
+// Allowed returns an error if the identity can't take the action on the
+// service. An empty service means the action isn't about a service
+func (id *Identity) Allowed(p Permission, service string) error {
+	// Narrowed permissions only limit actions, reading comes with the role
+	perms := rolePermissions[id.Role]
+	if len(id.Permissions) > 0 && p != PermissionRead {
+		perms = id.Permissions
+	}
+	if !hasPermission(perms, p) {
+		return fmt.Errorf("%s %q does not have the %s permission", id.Role, id.Name, p)
+	}
+
+	// Reading is never scoped, only actions on services are
+	if service == "" || p == PermissionRead || len(id.Services) == 0 {
+		return nil
+	}
+	if service == "all" {
+		return fmt.Errorf("%q is limited to some services so can't act on all of them", id.Name)
+	}
+	for _, s := range id.Services {
+		if s == service {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not allowed to %s %s", id.Name, p, service)
+}
+
+// AllowedJob returns an error if the identity can't take the action on the
+// job. Jobs can do anything, so a token limited to some services can only
+// read them
+func (id *Identity) AllowedJob(p Permission, job string) error {
+	if err := id.Allowed(p, ""); err != nil {
+		return err
+	}
+	if p != PermissionRead && len(id.Services) > 0 {
+		return fmt.Errorf("%q is limited to some services so can't %s job %s", id.Name, p, job)
+	}
+	return nil
+}
+
+// PermissionMiddleware checks the identity from the auth middleware against
+// the permission the matched route needs, it must be used after
+// AuthMiddleware
+func PermissionMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := IdentityFromRequest(r)
+			if id == nil {
+				ErrorHandler(w, r, "Forbidden", errors.New("request has no identity"), http.StatusForbidden)
+				return
+			}
+
+			p := RequiredPermission(r)
+			service := mux.Vars(r)["service_name"]
+			err := id.Allowed(p, service)
+			if job, ok := mux.Vars(r)["job_name"]; ok {
+				err = id.AllowedJob(p, job)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"identity":     id.Name,
+					"role":         id.Role,
+					"permission":   p,
+					"service_name": service,
+					"endpoint":     r.URL.Path,
+				}).Info("Denied request")
+				ErrorHandler(w, r, "Forbidden", err, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequiredPermission returns the permission needed for the route the request
+// matched
+func RequiredPermission(r *http.Request) Permission {
+	if route := mux.CurrentRoute(r); route != nil {
+		if f, ok := routePermissions[route.GetName()]; ok {
+			return f(r)
+		}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return PermissionRead
+	}
+	return PermissionAdmin
+}
+
+func hasPermission(perms []Permission, p Permission) bool {
+	for _, have := range perms {
+		if have == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package guardian_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+func TestIdentityAllowed(t *testing.T) {
+	viewer := &guardian.Identity{Name: "v", Role: guardian.RoleViewer}
+	operator := &guardian.Identity{Name: "o", Role: guardian.RoleOperator}
+	admin := &guardian.Identity{Name: "a", Role: guardian.RoleAdmin}
+	scoped := &guardian.Identity{Name: "s", Role: guardian.RoleOperator, Services: []string{"edged"}}
+	narrowed := &guardian.Identity{Name: "n", Role: guardian.RoleOperator, Permissions: []guardian.Permission{guardian.PermissionRestart}}
+
+	tests := []struct {
+		id      *guardian.Identity
+		p       guardian.Permission
+		service string
+		allowed bool
+	}{
+		{viewer, guardian.PermissionRead, "edged", true},
+		{viewer, guardian.PermissionStart, "edged", false},
+		{operator, guardian.PermissionStop, "edged", true},
+		{operator, guardian.PermissionAdmin, "", false},
+		{admin, guardian.PermissionAdmin, "", true},
+		{scoped, guardian.PermissionStart, "edged", true},
+		{scoped, guardian.PermissionStart, "network-gateway", false},
+		{scoped, guardian.PermissionStop, "all", false},
+		{scoped, guardian.PermissionRead, "network-gateway", true},
+		{narrowed, guardian.PermissionRestart, "edged", true},
+		{narrowed, guardian.PermissionStop, "edged", false},
+		{narrowed, guardian.PermissionRead, "edged", true},
+	}
+	for _, test := range tests {
+		err := test.id.Allowed(test.p, test.service)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s %s %q: got %v, want allowed %t", test.id.Name, test.p, test.service, err, test.allowed)
+		}
+	}
+}
+
+func TestRequiredPermission(t *testing.T) {
+	var got guardian.Permission
+	record := func(w http.ResponseWriter, r *http.Request) { got = guardian.RequiredPermission(r) }
+	r := mux.NewRouter()
+	r.HandleFunc("/service/set_state/{service_name}", record).Methods("PUT").Name("set_state")
+	r.HandleFunc("/service/config", record).Methods("GET").Name("config")
+	r.HandleFunc("/v2/services/{service_name}/scale", record).Methods("POST").Name("v2_scale_service")
+	r.HandleFunc("/unnamed", record).Methods("GET", "POST")
+
+	tests := []struct {
+		method, path, body string
+		want               guardian.Permission
+	}{
+		{"PUT", "/service/set_state/edged", `{"running": true}`, guardian.PermissionStart},
+		{"PUT", "/service/set_state/edged", `{"running": false}`, guardian.PermissionStop},
+		{"PUT", "/service/set_state/edged", `not json`, guardian.PermissionAdmin},
+		// The last key wins and case doesn't matter, like in the handler
+		{"PUT", "/service/set_state/edged", `{"running": false, "running": true}`, guardian.PermissionStart},
+		{"PUT", "/service/set_state/edged", `{"running": false, "Running": true}`, guardian.PermissionStart},
+		{"PUT", "/service/set_state/edged", `{"RUNNING": true}`, guardian.PermissionStart},
+		{"PUT", "/service/set_state/edged", `{"running": true, "Running": false}`, guardian.PermissionStop},
+		{"PUT", "/service/set_state/edged", `{"running": true, "bogus": 1}`, guardian.PermissionAdmin},
+		{"PUT", "/service/set_state/edged", `{}`, guardian.PermissionAdmin},
+		{"GET", "/service/config", "", guardian.PermissionAdmin},
+		{"POST", "/v2/services/edged/scale", `{"instances": 2}`, guardian.PermissionRestart},
+		{"GET", "/unnamed", "", guardian.PermissionRead},
+		{"POST", "/unnamed", "", guardian.PermissionAdmin},
+	}
+	for _, test := range tests {
+		got = ""
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if got != test.want {
+			t.Errorf("%s %s %s: got %q, want %q", test.method, test.path, test.body, got, test.want)
+		}
+	}
+}
+
+// permissionRouter has a few real routes behind the auth and permission
+// middleware, with a token per case
+func permissionRouter(t *testing.T) *mux.Router {
+	viper.Set("Auth.Mode", guardian.AuthModeToken)
+	viper.Set("Auth.TokensFile", "")
+	viper.Set("Auth.Tokens", []map[string]interface{}{
+		{"name": "admin", "hash": guardian.HashToken("admin-token"), "role": guardian.RoleAdmin},
+		{"name": "operator", "hash": guardian.HashToken("operator-token"), "role": guardian.RoleOperator},
+		{"name": "edged-operator", "hash": guardian.HashToken("edged-token"), "role": guardian.RoleOperator, "services": []string{"edged"}},
+		{"name": "viewer", "hash": guardian.HashToken("viewer-token"), "role": guardian.RoleViewer},
+	})
+	auth, err := guardian.NewAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r := mux.NewRouter()
+	r.Use(guardian.AuthMiddleware(auth), guardian.PermissionMiddleware())
+	r.HandleFunc("/v2/services/{service_name}/start", ok).Methods("POST").Name("v2_start_service")
+	r.HandleFunc("/v2/jobs/{job_name}", ok).Methods("GET").Name("v2_get_job")
+	r.HandleFunc("/v2/jobs/{job_name}/run", ok).Methods("POST").Name("v2_run_job")
+	return r
+}
+
+func TestJobPermissions(t *testing.T) {
+	r := permissionRouter(t)
+
+	tests := []struct {
+		token, method, path string
+		want                int
+	}{
+		{"admin-token", "POST", "/v2/jobs/migrate/run", http.StatusOK},
+		{"operator-token", "POST", "/v2/jobs/migrate/run", http.StatusOK},
+		{"edged-token", "POST", "/v2/jobs/migrate/run", http.StatusForbidden},
+		{"edged-token", "GET", "/v2/jobs/migrate", http.StatusOK},
+		{"edged-token", "POST", "/v2/services/edged/start", http.StatusOK},
+		{"viewer-token", "POST", "/v2/jobs/migrate/run", http.StatusForbidden},
+		{"wrong-token", "POST", "/v2/jobs/migrate/run", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("%s %s %s: got %d, want %d", test.token, test.method, test.path, w.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package guardian
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clockTicks is USER_HZ, which is 100 on every Linux platform we run on
+const clockTicks = 100
+
+// processUsage returns the CPU time and resident memory of a process from
+// /proc
+func processUsage(pid int) (cpuSeconds float64, rss uint64, err error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name can contain spaces, so start after its closing paren
+	s := string(stat)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	// utime and stime are fields 14 and 15 of the whole line
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	pages, _ := strconv.ParseUint(fields[21], 10, 64)
+
+	return float64(utime+stime) / clockTicks, pages * uint64(os.Getpagesize()), nil
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package guardian
+
+import "errors"
+
+// processUsage is only implemented on Linux
+func processUsage(pid int) (cpuSeconds float64, rss uint64, err error) {
+	return 0, 0, errors.New("process usage is only available on Linux")
+}
@@ -0,0 +1,347 @@
+package guardian
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// RateLimiter limits how often each client can call the API and how often
+// any one service can be started, stopped or restarted
+type RateLimiter struct {
+	rate     float64 // Requests per second, 0 disables client limits
+	burst    float64
+	cooldown time.Duration // Minimum time between operations on a service
+
+	mux       sync.Mutex
+	clients   map[string]*tokenBucket
+	lastOps   map[string]time.Time
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate requests per second per
+// client with bursts up to burst, and one operation per service every
+// cooldown
+func NewRateLimiter(rate float64, burst int, cooldown time.Duration) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:     rate,
+		burst:    float64(burst),
+		cooldown: cooldown,
+		clients:  make(map[string]*tokenBucket),
+		lastOps:  make(map[string]time.Time),
+	}
+}
+
+// SetLimits changes the limits, used when the config is reloaded
+func (rl *RateLimiter) SetLimits(rate float64, burst int, cooldown time.Duration) {
+	if burst < 1 {
+		burst = 1
+	}
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	rl.rate = rate
+	rl.burst = float64(burst)
+	rl.cooldown = cooldown
+}
+
+func (rl *RateLimiter) limits() (float64, time.Duration) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	return rl.rate, rl.cooldown
+}
+
+// allowClient takes a token from the client's bucket, it returns how long to
+// wait if there wasn't one
+func (rl *RateLimiter) allowClient(key string, now time.Time) (bool, time.Duration) {
+	return rl.takeToken(key, now, true)
+}
+
+// allowAttempt returns whether the client has a token left without taking
+// it, used to stop clients before they try to authenticate
+func (rl *RateLimiter) allowAttempt(key string, now time.Time) (bool, time.Duration) {
+	return rl.takeToken(key, now, false)
+}
+
+func (rl *RateLimiter) takeToken(key string, now time.Time, take bool) (bool, time.Duration) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	if rl.rate <= 0 {
+		return true, 0 // Disabled by a reload since the middleware checked
+	}
+	rl.prune(now)
+
+	b, ok := rl.clients[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.clients[key] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	if take {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// allowOperation records an operation on the service unless one happened
+// within the cooldown. An operation on all services waits for the last one
+// on any service, and the other way around. It returns the time it replaced
+// so releaseOperation can put it back
+func (rl *RateLimiter) allowOperation(service string, now time.Time) (bool, time.Duration, time.Time) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	previous := rl.lastOps[service]
+	last := previous
+	if service == "all" {
+		for _, t := range rl.lastOps {
+			if t.After(last) {
+				last = t
+			}
+		}
+	} else if t := rl.lastOps["all"]; t.After(last) {
+		last = t
+	}
+	if wait := rl.cooldown - now.Sub(last); !last.IsZero() && wait > 0 {
+		return false, wait, previous
+	}
+	rl.lastOps[service] = now
+	return true, 0, previous
+}
+
+// releaseOperation undoes allowOperation for an operation that didn't
+// happen, so a rejected request doesn't start the cooldown
+func (rl *RateLimiter) releaseOperation(service string, previous time.Time) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	if previous.IsZero() {
+		delete(rl.lastOps, service)
+		return
+	}
+	rl.lastOps[service] = previous
+}
+
+// allowOperations is allowOperation for several services at once, either
+// every one of them is recorded or none are. It returns the service that has
+// to wait, or the times to release each service with
+func (rl *RateLimiter) allowOperations(services []string, now time.Time) (bool, string, time.Duration, map[string]time.Time) {
+	previous := make(map[string]time.Time)
+	for _, service := range services {
+		ok, wait, p := rl.allowOperation(service, now)
+		if !ok {
+			for s, p := range previous {
+				rl.releaseOperation(s, p)
+			}
+			return false, service, wait, nil
+		}
+		previous[service] = p
+	}
+	return true, "", 0, previous
+}
+
+// prune forgets clients whose buckets have refilled so the map doesn't grow
+// forever
+func (rl *RateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+	for key, b := range rl.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.clients, key)
+		}
+	}
+}
+
+// AddressMiddleware limits failed authentication by address. It goes before
+// AuthMiddleware, requests answered with a 401 use up the address's budget
+// and once it's gone the address is turned away before its token is even
+// checked, so tokens can't be guessed faster than the rate limit
+func (rl *RateLimiter) AddressMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rate, _ := rl.limits()
+			if rate <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := "auth:" + clientKey(r)
+			if ok, wait := rl.allowAttempt(key, time.Now()); !ok {
+				log.WithFields(log.Fields{
+					"client":   key,
+					"endpoint": r.URL.Path,
+				}).Info("Rate limited failed authentication")
+				tooManyRequests(w, r, errors.New("too many requests that failed to authenticate"), wait)
+				return
+			}
+
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			if sw.status == http.StatusUnauthorized {
+				rl.allowClient(key, time.Now())
+			}
+		})
+	}
+}
+
+// ClientMiddleware limits each client by its identity, or its address if it
+// didn't authenticate. It goes after AuthMiddleware
+func (rl *RateLimiter) ClientMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rate, _ := rl.limits()
+			if rate <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := clientKey(r)
+			if ok, wait := rl.allowClient(key, time.Now()); !ok {
+				log.WithFields(log.Fields{
+					"client":   key,
+					"endpoint": r.URL.Path,
+				}).Debug("Rate limited request")
+				tooManyRequests(w, r, fmt.Errorf("rate limit of %g requests per second exceeded", rate), wait)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// cooldownRoutes are the routes that start, stop or restart services. The
+// desired route can change several, its handler checks each of them
+var cooldownRoutes = map[string]bool{
+	"set_state":        true,
+	"v2_start_service": true,
+	"v2_stop_service":  true,
+	"v2_restart":       true,
+	"v2_scale_service": true,
+}
+
+// CooldownMiddleware stops a service from being started, stopped or
+// restarted more often than the cooldown. It goes after PermissionMiddleware
+// so requests that were never allowed don't start a cooldown, and requests
+// the handler rejects don't either
+func (rl *RateLimiter) CooldownMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			service := mux.Vars(r)["service_name"]
+			_, cooldown := rl.limits()
+			route := mux.CurrentRoute(r)
+			if cooldown <= 0 || service == "" || route == nil || !cooldownRoutes[route.GetName()] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ok, wait, previous := rl.allowOperation(service, time.Now())
+			if !ok {
+				tooManyRequests(w, r, fmt.Errorf("%s was changed less than %s ago", service, cooldown), wait)
+				return
+			}
+
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			if sw.status >= 400 {
+				rl.releaseOperation(service, previous)
+			}
+		})
+	}
+}
+
+// statusWriter keeps the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack lets WebSocket upgrades through
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	return h.Hijack()
+}
+
+// BodyLimitMiddleware rejects request bodies over maxBytes before anything
+// else reads them. It goes first so later middleware can read the body
+// freely
+func BodyLimitMiddleware(maxBytes int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maxBytes <= 0 || r.Body == nil || r.Method == http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+			r.Body.Close()
+			if err != nil {
+				ErrorHandler(w, r, fmt.Sprintf("Request body must be at most %d bytes", maxBytes), err, http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, err error, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	ErrorHandler(w, r, "Too many requests", err, http.StatusTooManyRequests)
+}
+
+func clientKey(r *http.Request) string {
+	if id := IdentityFromRequest(r); id != nil && id.Name != "localhost" {
+		return "identity:" + id.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
@@ -0,0 +1,63 @@
+package guardian_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+)
+
+func TestFailedAuthenticationIsThrottled(t *testing.T) {
+	r, _ := apiRouter(t, guardian.AuthModeToken, guardian.NewRateLimiter(0.001, 3, 0))
+
+	serve(t, r, []apiRequest{
+		{"10.0.0.1", "guess-1", "POST", "/v2/services/edged/start", http.StatusUnauthorized},
+		{"10.0.0.1", "guess-2", "POST", "/v2/services/edged/start", http.StatusUnauthorized},
+		{"10.0.0.1", "guess-3", "POST", "/v2/services/edged/start", http.StatusUnauthorized},
+		// The address is out of attempts, even with a good token
+		{"10.0.0.1", "guess-4", "POST", "/v2/services/edged/start", http.StatusTooManyRequests},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/edged/start", http.StatusTooManyRequests},
+		// Others aren't held up
+		{"10.0.0.2", "operator-token", "POST", "/v2/services/edged/start", http.StatusOK},
+	})
+}
+
+func TestClientRateLimit(t *testing.T) {
+	r, _ := apiRouter(t, guardian.AuthModeToken, guardian.NewRateLimiter(0.001, 2, 0))
+
+	serve(t, r, []apiRequest{
+		{"10.0.0.1", "viewer-token", "GET", "/v2/services", http.StatusOK},
+		{"10.0.0.1", "viewer-token", "GET", "/v2/services", http.StatusOK},
+		{"10.0.0.1", "viewer-token", "GET", "/v2/services", http.StatusTooManyRequests},
+		// Limited by token, not address
+		{"10.0.0.1", "operator-token", "GET", "/v2/services", http.StatusOK},
+	})
+}
+
+func TestServiceCooldown(t *testing.T) {
+	r, _ := apiRouter(t, guardian.AuthModeToken, guardian.NewRateLimiter(0, 0, time.Hour))
+
+	serve(t, r, []apiRequest{
+		// Denied requests don't start a cooldown
+		{"10.0.0.1", "viewer-token", "POST", "/v2/services/edged/start", http.StatusForbidden},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/edged/start", http.StatusOK},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/edged/stop", http.StatusTooManyRequests},
+		// all covers every service, and every service all
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/all/stop", http.StatusTooManyRequests},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/network-gateway/stop", http.StatusOK},
+		// Scaling changes the service too
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/network-gateway/scale", http.StatusTooManyRequests},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/sleeper/scale", http.StatusOK},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/sleeper/start", http.StatusTooManyRequests},
+		// Failed requests don't either
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/broken/start", http.StatusConflict},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/broken/start", http.StatusConflict},
+	})
+
+	r, _ = apiRouter(t, guardian.AuthModeToken, guardian.NewRateLimiter(0, 0, time.Hour))
+	serve(t, r, []apiRequest{
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/all/stop", http.StatusOK},
+		{"10.0.0.1", "operator-token", "POST", "/v2/services/edged/start", http.StatusTooManyRequests},
+	})
+}
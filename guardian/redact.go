@@ -0,0 +1,93 @@
+package guardian
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Redacted replaces secret values wherever the guardian logs or returns them
+const Redacted = "[REDACTED]"
+
+// secretKeyParts mark a JSON field or environment variable as secret if its
+// name contains one of them
+var secretKeyParts = []string{"pass", "secret", "token", "key", "credential", "auth"}
+
+// IsSecretKey returns true if the name looks like it holds a secret
+func IsSecretKey(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range secretKeyParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactEnv returns a copy of env with the values of secret looking
+// variables replaced, @file: and @secret: references are kept as they only
+// name where the value is
+func RedactEnv(env []string) []string {
+	if env == nil {
+		return nil
+	}
+	redacted := make([]string, len(env))
+	for i, e := range env {
+		redacted[i] = redactEnvEntry(e)
+	}
+	return redacted
+}
+
+func redactEnvEntry(e string) string {
+	parts := strings.SplitN(e, "=", 2)
+	if len(parts) == 2 && IsSecretKey(parts[0]) && !isSecretRef(parts[1]) {
+		return parts[0] + "=" + Redacted
+	}
+	return e
+}
+
+// RedactJSON returns the body with the values of secret looking fields and
+// environment variables replaced, bodies that aren't JSON are dropped
+func RedactJSON(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		b, _ := json.Marshal(Redacted + " (not JSON)")
+		return b
+	}
+
+	b, err := json.Marshal(redactValue("", v))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func redactValue(key string, v interface{}) interface{} {
+	if key != "" && IsSecretKey(key) {
+		return Redacted
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			t[k] = redactValue(k, val)
+		}
+		return t
+	case []interface{}:
+		for i, val := range t {
+			t[i] = redactValue("", val)
+		}
+		return t
+	case string:
+		return redactEnvEntry(t) // Environment variables come as KEY=VALUE strings
+	default:
+		return v
+	}
+}
+
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, FileRefPrefix) || strings.HasPrefix(value, SecretRefPrefix)
+}
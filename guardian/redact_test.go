@@ -0,0 +1,27 @@
+package guardian_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+)
+
+func TestRedactEnv(t *testing.T) {
+	tests := []struct {
+		env, want []string
+	}{
+		{nil, nil},
+		{[]string{"GLADIUSBASE=/opt/gladius"}, []string{"GLADIUSBASE=/opt/gladius"}},
+		{[]string{"DB_PASSWORD=hunter2"}, []string{"DB_PASSWORD=" + guardian.Redacted}},
+		{[]string{"api_token=abc", "PORT=8080"}, []string{"api_token=" + guardian.Redacted, "PORT=8080"}},
+		{[]string{"API_KEY=@secret:api-key"}, []string{"API_KEY=@secret:api-key"}},
+		{[]string{"TLS_KEY=@file:/etc/key.pem"}, []string{"TLS_KEY=@file:/etc/key.pem"}},
+		{[]string{"NOVALUE"}, []string{"NOVALUE"}},
+	}
+	for _, test := range tests {
+		if got := guardian.RedactEnv(test.env); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.env, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package guardian
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// What triggered a config reload
+const (
+	ReloadSignal = "signal"
+	ReloadFile   = "file"
+	ReloadAPI    = "api"
+)
+
+// ReloadResult is what a config reload changed and what still needs a
+// restart to take effect
+type ReloadResult struct {
+	Trigger         string              `json:"trigger" description:"signal, file or api"`
+	Changed         []string            `json:"changed" description:"Settings whose value changed"`
+	Applied         []string            `json:"applied" description:"Changed settings that are now in effect"`
+	RestartGuardian []string            `json:"restart_guardian,omitempty" description:"Changed settings that only take effect when the guardian restarts"`
+	RestartServices map[string][]string `json:"restart_services,omitempty" description:"Running services still using old settings until they're restarted, and why"`
+	Errors          []string            `json:"errors,omitempty" description:"Settings that couldn't be applied, their previous values are still in effect"`
+}
+
+// configMux guards the global viper config, a reload replaces it while
+// services and requests are reading it
+var configMux sync.RWMutex
+
+// ReplaceConfig - Run replace, which changes the global viper config, while
+// nothing reads it through ReadConfig or the config helpers
+func ReplaceConfig(replace func() error) error {
+	configMux.Lock()
+	defer configMux.Unlock()
+	return replace()
+}
+
+// ReadConfig - Run read, which reads the global viper config, where a reload
+// can't replace the config halfway through
+func ReadConfig(read func()) {
+	configMux.RLock()
+	defer configMux.RUnlock()
+	read()
+}
+
+func configInt(key string) int {
+	configMux.RLock()
+	defer configMux.RUnlock()
+	return viper.GetInt(key)
+}
+
+func configInt64(key string) int64 {
+	configMux.RLock()
+	defer configMux.RUnlock()
+	return viper.GetInt64(key)
+}
+
+func configString(key string) string {
+	configMux.RLock()
+	defer configMux.RUnlock()
+	return viper.GetString(key)
+}
+
+func configStrings(key string) []string {
+	configMux.RLock()
+	defer configMux.RUnlock()
+	return viper.GetStringSlice(key)
+}
+
+// ConfigReloader reads the config again and applies the settings that can
+// be changed while the guardian is running
+type ConfigReloader struct {
+	gg       *GladiusGuardian
+	audit    *AuditLog
+	read     func() ([]string, error) // Reads the config, returning changed keys
+	appliers []*configApplier
+	mux      sync.Mutex
+}
+
+type configApplier struct {
+	keys  []string
+	apply func() error
+}
+
+// NewConfigReloader returns a reloader that uses read to replace the config,
+// read must leave the config alone if the new one is invalid
+func NewConfigReloader(gg *GladiusGuardian, audit *AuditLog, read func() ([]string, error)) *ConfigReloader {
+	return &ConfigReloader{gg: gg, audit: audit, read: read}
+}
+
+// Live registers the settings that apply takes into use, a key covers the
+// keys below it so "Auth" includes "Auth.Mode". apply can be nil for settings
+// that are read every time they're used. Changed settings without one are
+// reported as needing a guardian restart
+func (cr *ConfigReloader) Live(apply func() error, keys ...string) {
+	cr.mux.Lock()
+	defer cr.mux.Unlock()
+	cr.appliers = append(cr.appliers, &configApplier{keys: keys, apply: apply})
+}
+
+// Reload reads the config and applies what changed
+func (cr *ConfigReloader) Reload(trigger string) (*ReloadResult, error) {
+	cr.mux.Lock()
+	defer cr.mux.Unlock()
+
+	changed, err := cr.read()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"trigger": trigger,
+			"err":     err,
+		}).Warn("Config is invalid, keeping the running config")
+		cr.record(trigger, err)
+		cr.gg.events.Publish(EventConfigRejected, "", "config rejected: "+err.Error(), nil)
+		return nil, err
+	}
+
+	result := &ReloadResult{Trigger: trigger, Changed: changed, Applied: make([]string, 0)}
+	matched := make(map[*configApplier][]string)
+	for _, key := range changed {
+		a := cr.applierFor(key)
+		if a == nil {
+			result.RestartGuardian = append(result.RestartGuardian, key)
+			continue
+		}
+		matched[a] = append(matched[a], key)
+	}
+
+	// Run the appliers in the order they were registered
+	for _, a := range cr.appliers {
+		keys, ok := matched[a]
+		if !ok {
+			continue
+		}
+		if a.apply != nil {
+			if err := a.apply(); err != nil {
+				result.Errors = append(result.Errors, strings.Join(keys, ", ")+": "+err.Error())
+				continue
+			}
+		}
+		result.Applied = append(result.Applied, keys...)
+	}
+	sort.Strings(result.Applied)
+
+	result.RestartServices = cr.gg.outdatedServices()
+
+	log.WithFields(log.Fields{
+		"trigger":          trigger,
+		"changed":          strings.Join(result.Changed, ", "),
+		"restart_guardian": strings.Join(result.RestartGuardian, ", "),
+	}).Info("Reloaded config")
+	cr.record(trigger, nil)
+	cr.gg.events.Publish(EventConfigReloaded, "", reloadMessage(result), result)
+	return result, nil
+}
+
+// applierFor returns the applier covering the key, or nil
+func (cr *ConfigReloader) applierFor(key string) *configApplier {
+	key = strings.ToLower(key)
+	for _, a := range cr.appliers {
+		for _, k := range a.keys {
+			k = strings.ToLower(k)
+			if key == k || strings.HasPrefix(key, k+".") {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// record adds reloads that didn't come through the API to the audit log,
+// those are recorded by AuditMiddleware
+func (cr *ConfigReloader) record(trigger string, err error) {
+	if cr.audit == nil || trigger == ReloadAPI {
+		return
+	}
+	entry := &AuditEntry{Identity: "guardian", Action: "config_reload_" + trigger, Success: err == nil}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	cr.audit.Record(entry)
+}
+
+func reloadMessage(result *ReloadResult) string {
+	if len(result.Changed) == 0 {
+		return "config reloaded, nothing changed"
+	}
+	message := "config reloaded, changed " + strings.Join(result.Changed, ", ")
+	if len(result.RestartGuardian) > 0 {
+		message += "; guardian restart needed for " + strings.Join(result.RestartGuardian, ", ")
+	}
+	if len(result.RestartServices) > 0 {
+		names := make([]string, 0, len(result.RestartServices))
+		for name := range result.RestartServices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		message += "; restart needed for " + strings.Join(names, ", ")
+	}
+	return message
+}
+
+// outdatedServices returns the running services that were started with an
+// executable or default environment that has since changed, including values
+// its templates use like the ports, or run a different number of instances
+func (gg *GladiusGuardian) outdatedServices() map[string][]string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	outdated := make(map[string][]string)
+	for name, registered := range gg.registeredServices {
+		running := 0
+		changed := make(map[string]bool)
+		for _, inst := range gg.instances[name] {
+			if inst.cmd == nil || inst.started == nil {
+				continue
+			}
+			running++
+			if registered.execName != inst.started.execName {
+				changed["executable changed"] = true
+			}
+			if env, _, err := gg.expand(name, inst.index, gg.environment(name, nil), nil); err != nil || !hasPrefix(inst.started.env, env) {
+				changed["environment changed"] = true
+			}
+		}
+		if running > 0 && running != gg.instanceCount(name) {
+			changed["instances changed"] = true
+		}
+		var reasons []string
+		for _, reason := range []string{"executable changed", "environment changed", "instances changed"} {
+			if changed[reason] {
+				reasons = append(reasons, reason)
+			}
+		}
+		if len(reasons) > 0 {
+			outdated[name] = reasons
+		}
+	}
+	if len(outdated) == 0 {
+		return nil
+	}
+	return outdated
+}
+
+func hasPrefix(env, prefix []string) bool {
+	if len(env) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if env[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ReloadConfigHandler - Read the config file again and apply what can be
+// applied without a restart
+func ReloadConfigHandler(cr *ConfigReloader) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := cr.Reload(ReloadAPI)
+		if err != nil {
+			ErrorHandler(w, r, "Config is invalid, nothing was changed", err, http.StatusUnprocessableEntity)
+			return
+		}
+		ResponseHandler(w, r, reloadMessage(result), true, nil, result)
+	}
+}
@@ -5,21 +5,40 @@ import (
 	"net/http"
 )
 
+// Response is the envelope every endpoint answers with
 type Response struct {
-	Message  string      `json:"message"`
-	Success  bool        `json:"success"`
-	Error    string      `json:"error"`
-	Response interface{} `json:"response"`
-	Endpoint string      `json:"endpoint"`
+	Message  string       `json:"message"`
+	Success  bool         `json:"success"`
+	Error    string       `json:"error"`
+	Code     string       `json:"code,omitempty"`   // Machine readable error code
+	Fields   []FieldError `json:"fields,omitempty"` // Problems with individual request fields
+	Response interface{}  `json:"response"`
+	Endpoint string       `json:"endpoint"`
 }
 
-// ErrorHandler - Default Error Handler
+// ErrorHandler - Default Error Handler, the code comes from the error if it's
+// an *APIError and from the status code otherwise
 func ErrorHandler(w http.ResponseWriter, r *http.Request, m string, e error, statusCode int) {
-	w.WriteHeader(statusCode)
+	responseStruct := Response{
+		Message:  m,
+		Success:  false,
+		Code:     codeForStatus(statusCode),
+		Endpoint: endpoint(r),
+	}
+	if e != nil {
+		responseStruct.Error = e.Error()
+	}
+	if apiErr, ok := e.(*APIError); ok {
+		responseStruct.Code = apiErr.Code
+		responseStruct.Fields = apiErr.Fields
+	}
 
-	ResponseHandler(w, r, m, false, e, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	writeResponse(w, r, responseStruct)
 }
 
+// ResponseHandler - Default response handler
 func ResponseHandler(w http.ResponseWriter, r *http.Request, m string, success bool, err error, res interface{}) {
 	errorString := ""
 
@@ -32,9 +51,14 @@ func ResponseHandler(w http.ResponseWriter, r *http.Request, m string, success b
 		Success:  success,
 		Error:    errorString,
 		Response: res,
-		Endpoint: r.URL.String(),
+		Endpoint: endpoint(r),
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse(w, r, responseStruct)
+}
+
+func writeResponse(w http.ResponseWriter, r *http.Request, responseStruct Response) {
 	enc := json.NewEncoder(w)
 	enc.SetEscapeHTML(false) // So we can have an & come through in our URL's
 	parseErr := enc.Encode(responseStruct)
@@ -43,3 +67,14 @@ func ResponseHandler(w http.ResponseWriter, r *http.Request, m string, success b
 		ErrorHandler(w, r, "Could not parse response JSON", parseErr, http.StatusInternalServerError)
 	}
 }
+
+// endpoint is the URL of the request for the response, without a token the
+// client put in the query
+func endpoint(r *http.Request) string {
+	u := *r.URL
+	if q := u.Query(); q.Get("token") != "" {
+		q.Del("token")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,348 @@
+package guardian
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// restartCheckInterval is how often the memory and uptime of instances with a
+// restart policy are checked
+var restartCheckInterval = 15 * time.Second
+
+// DefaultMaxMemoryFor is how long an instance can be over MaxMemory before
+// it's restarted if the policy doesn't say
+const DefaultMaxMemoryFor = 5 * time.Minute
+
+// What made a restart policy restart a service
+const (
+	RestartTriggerSchedule = "schedule"
+	RestartTriggerMemory   = "memory"
+	RestartTriggerUptime   = "uptime"
+)
+
+// RestartPolicy is when the guardian restarts a running service by itself,
+// from the service's section in Restarts in the config
+type RestartPolicy struct {
+	Schedule     string // Cron expression, every instance is restarted
+	MaxMemory    string // Restart an instance using more than this, like 512MB
+	MaxMemoryFor string // For this long, 5m if not set
+	MaxUptime    string // Restart an instance that's been up this long, like 24h
+	Jitter       string // Wait a random time up to this before restarting
+}
+
+// restartPolicy is a parsed RestartPolicy and its state
+type restartPolicy struct {
+	spec        string
+	schedule    *Schedule
+	maxRSS      uint64
+	rssFor      time.Duration
+	maxUptime   time.Duration
+	jitter      time.Duration
+	stop        chan struct{}     // Closed when the policy is replaced
+	nextRestart time.Time         // Next scheduled restart
+	overSince   map[int]time.Time // When each instance went over MaxMemory
+}
+
+// restartEvent is the data of a service_restarting event
+type restartEvent struct {
+	Trigger      string  `json:"trigger" description:"schedule, memory or uptime"`
+	Reason       string  `json:"reason"`
+	Instance     int     `json:"instance" description:"-1 when every instance is restarted"`
+	DelaySeconds float64 `json:"delay_seconds" description:"The jitter waited before restarting"`
+}
+
+// Validate returns an error for each setting that doesn't parse, the fields
+// are named like the config keys
+func (p *RestartPolicy) Validate() []FieldError {
+	_, errs := p.compile()
+	return errs
+}
+
+func (p *RestartPolicy) compile() (*restartPolicy, []FieldError) {
+	var errs []FieldError
+	rp := &restartPolicy{spec: p.Schedule, rssFor: DefaultMaxMemoryFor, overSince: make(map[int]time.Time)}
+	duration := func(field, value string, d *time.Duration) {
+		if value == "" {
+			return
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("is %q, must be a positive duration like 10m", value)})
+			return
+		}
+		*d = parsed
+	}
+
+	if p.Schedule != "" {
+		s, err := ParseSchedule(p.Schedule)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "Schedule", Message: err.Error()})
+		}
+		rp.schedule = s
+	}
+	if p.MaxMemory != "" {
+		n, err := parseBytes(p.MaxMemory)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "MaxMemory", Message: err.Error()})
+		}
+		rp.maxRSS = n
+	}
+	duration("MaxMemoryFor", p.MaxMemoryFor, &rp.rssFor)
+	duration("MaxUptime", p.MaxUptime, &rp.maxUptime)
+	duration("Jitter", p.Jitter, &rp.jitter)
+	return rp, errs
+}
+
+// parseBytes parses a size like 512MB or 2GB, the units are powers of 1024
+func parseBytes(s string) (uint64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	mult := uint64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   uint64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, mult = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("is %q, must be a size like 512MB", s)
+	}
+	return uint64(n * float64(mult)), nil
+}
+
+// SetRestartPolicies - Replace the restart policies of services by name,
+// invalid ones are skipped with a warning
+func (gg *GladiusGuardian) SetRestartPolicies(policies map[string]*RestartPolicy) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	for name, rp := range gg.restartPolicies {
+		close(rp.stop)
+		delete(gg.restartPolicies, name)
+	}
+	for name, p := range policies {
+		rp, errs := p.compile()
+		if len(errs) > 0 {
+			log.WithFields(log.Fields{
+				"service_name": name,
+				"err":          errs[0].Field + " " + errs[0].Message,
+			}).Warn("Skipping invalid restart policy")
+			continue
+		}
+		rp.stop = make(chan struct{})
+		gg.restartPolicies[name] = rp
+		go gg.superviseRestarts(name, rp)
+	}
+}
+
+// restartCandidate is an instance a restart policy wants to restart
+type restartCandidate struct {
+	index   int
+	trigger string
+	reason  string
+}
+
+// superviseRestarts restarts the service when its schedule fires, and its
+// instances when they use too much memory or have been up too long, until the
+// policy is replaced
+func (gg *GladiusGuardian) superviseRestarts(name string, rp *restartPolicy) {
+	// Seeded here so a fleet started together doesn't pick the same delays
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	var next time.Time
+	if rp.schedule != nil {
+		next = rp.schedule.Next(time.Now())
+		gg.mux.Lock()
+		rp.nextRestart = next
+		gg.mux.Unlock()
+	}
+
+	for {
+		wait := restartCheckInterval
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		select {
+		case <-time.After(wait):
+		case <-rp.stop:
+			return
+		}
+
+		now := time.Now()
+		var candidates []restartCandidate
+		if !next.IsZero() && !now.Before(next) {
+			next = rp.schedule.Next(now)
+			gg.mux.Lock()
+			rp.nextRestart = next
+			gg.mux.Unlock()
+			candidates = append(candidates, restartCandidate{index: -1, trigger: RestartTriggerSchedule, reason: "scheduled restart (" + rp.spec + ")"})
+		} else {
+			candidates = gg.restartCandidates(name, rp, now)
+		}
+
+		for _, c := range candidates {
+			var delay time.Duration
+			if rp.jitter > 0 {
+				delay = time.Duration(random.Int63n(int64(rp.jitter)))
+			}
+			if !gg.policyRestart(name, rp, c, delay) {
+				return
+			}
+		}
+	}
+}
+
+// restartCandidates returns the running instances over the policy's memory
+// or uptime limits, none while the service is in maintenance mode
+func (gg *GladiusGuardian) restartCandidates(name string, rp *restartPolicy, now time.Time) []restartCandidate {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	if gg.inMaintenance(name) != nil {
+		rp.overSince = make(map[int]time.Time) // Start counting again once it's over
+		return nil
+	}
+	var candidates []restartCandidate
+	for _, inst := range gg.instances[name] {
+		if inst.cmd == nil {
+			delete(rp.overSince, inst.index)
+			continue
+		}
+		if uptime := now.Sub(inst.startedAt); rp.maxUptime > 0 && uptime >= rp.maxUptime {
+			candidates = append(candidates, restartCandidate{
+				index:   inst.index,
+				trigger: RestartTriggerUptime,
+				reason:  fmt.Sprintf("up for %s, over the %s limit", uptime.Round(time.Second), rp.maxUptime),
+			})
+			continue
+		}
+		if rp.maxRSS == 0 {
+			continue
+		}
+		_, rss, err := processUsage(inst.cmd.Process.Pid)
+		if err != nil || rss <= rp.maxRSS {
+			delete(rp.overSince, inst.index)
+			continue
+		}
+		since, ok := rp.overSince[inst.index]
+		if !ok {
+			rp.overSince[inst.index] = now
+			continue
+		}
+		if now.Sub(since) >= rp.rssFor {
+			candidates = append(candidates, restartCandidate{
+				index:   inst.index,
+				trigger: RestartTriggerMemory,
+				reason:  fmt.Sprintf("using %d MiB, over the %d MiB limit for %s", rss>>20, rp.maxRSS>>20, now.Sub(since).Round(time.Second)),
+			})
+		}
+	}
+	return candidates
+}
+
+// policyRestart waits out delay and restarts the instance, or the whole
+// service for an index of -1. It returns false if the policy was replaced
+// in the meantime
+func (gg *GladiusGuardian) policyRestart(name string, rp *restartPolicy, c restartCandidate, delay time.Duration) bool {
+	gg.mux.Lock()
+	running := gg.running(name)
+	paused := gg.inMaintenance(name) != nil
+	label := name
+	if c.index >= 0 {
+		label = gg.label(name, c.index)
+	}
+	gg.mux.Unlock()
+	if !running {
+		return true // Nothing to restart, a scheduled restart doesn't start it
+	}
+	if paused {
+		log.WithFields(log.Fields{
+			"service_name": label,
+			"trigger":      c.trigger,
+			"reason":       c.reason,
+		}).Info("Not restarting service, it's in maintenance mode")
+		return true
+	}
+
+	log.WithFields(log.Fields{
+		"service_name": label,
+		"trigger":      c.trigger,
+		"reason":       c.reason,
+		"delay":        delay.Round(time.Second).String(),
+	}).Info("Restarting service by its restart policy")
+	gg.events.Publish(EventServiceRestarting, name,
+		fmt.Sprintf("Restarting %s in %s: %s", label, delay.Round(time.Second), c.reason),
+		&restartEvent{Trigger: c.trigger, Reason: c.reason, Instance: c.index, DelaySeconds: delay.Seconds()})
+
+	select {
+	case <-time.After(delay):
+	case <-rp.stop:
+		return false
+	}
+	gg.mux.Lock()
+	paused = gg.inMaintenance(name) != nil
+	gg.mux.Unlock()
+	if paused {
+		return true // Went into maintenance while we were waiting
+	}
+
+	var err error
+	if c.index < 0 {
+		// Started again the way the first instance was
+		gg.mux.Lock()
+		first := gg.instance(name, 0)
+		env, args := first.extraEnv, first.extraArgs
+		gg.mux.Unlock()
+		err = gg.restartServiceInternal(name, env, args, 0)
+	} else {
+		err = gg.restartInstance(name, c.index)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"service_name": label,
+			"trigger":      c.trigger,
+			"err":          err,
+		}).Warn("Restart policy couldn't restart service")
+	}
+
+	gg.mux.Lock()
+	if c.index < 0 {
+		rp.overSince = make(map[int]time.Time)
+	} else {
+		delete(rp.overSince, c.index)
+	}
+	gg.mux.Unlock()
+	return true
+}
+
+// restartInstance stops one running instance of the service and starts it
+// again with the env and args it was started with
+func (gg *GladiusGuardian) restartInstance(name string, index int) error {
+	gg.mux.Lock()
+	instances := gg.instances[name]
+	if index >= len(instances) || instances[index].cmd == nil {
+		gg.mux.Unlock()
+		return &ServiceError{Service: name, Err: ErrServiceStopped}
+	}
+	inst := instances[index]
+	env, args := inst.extraEnv, inst.extraArgs
+	err := gg.stopInstances(name, []*instance{inst}, 0)
+	gg.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	return gg.startInstance(name, index, env, args, 0)
+}
@@ -0,0 +1,80 @@
+// +build linux darwin
+
+package guardian
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// Often enough for the tests to see a policy at work
+	restartCheckInterval = 50 * time.Millisecond
+}
+
+func TestRestartPolicy(t *testing.T) {
+	viper.Set("MaxLogLines", 100)
+
+	tests := []struct {
+		name        string
+		maintenance bool
+		wantStarts  int // At least
+	}{
+		{"restarts with the same env", false, 3},
+		{"paused by maintenance", true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			exec := filepath.Join(dir, "marker.sh")
+			out := filepath.Join(dir, "started")
+			script := "#!/bin/sh\necho \"$MARK\" >> " + out + "\nexec sleep 60\n"
+			if err := ioutil.WriteFile(exec, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			gg := New()
+			gg.RegisterService("marker", exec, nil, 1)
+			if err := gg.SetServiceTimeouts("marker", 50*time.Millisecond, 2*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			defer gg.StopService("all", 0)
+			defer gg.SetRestartPolicies(nil)
+
+			if err := gg.StartService("marker", []string{"MARK=extra"}, 0); err != nil {
+				t.Fatal(err)
+			}
+			if test.maintenance {
+				if _, err := gg.SetMaintenance("marker", "testing", time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+			gg.SetRestartPolicies(map[string]*RestartPolicy{"marker": {MaxUptime: "100ms"}})
+
+			var starts []string
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+				started, err := ioutil.ReadFile(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				starts = strings.Split(strings.TrimSuffix(string(started), "\n"), "\n")
+				if !test.maintenance && len(starts) >= test.wantStarts {
+					break
+				}
+			}
+			if len(starts) < test.wantStarts || (test.maintenance && len(starts) != test.wantStarts) {
+				t.Fatalf("started %d times, want %d", len(starts), test.wantStarts)
+			}
+			for i, mark := range starts {
+				if mark != "extra" {
+					t.Errorf("start %d got MARK=%q, want the env it was first started with", i, mark)
+				}
+			}
+		})
+	}
+}
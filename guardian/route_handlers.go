@@ -3,16 +3,18 @@ package guardian
 import (
 	"fmt"
 	"net/http"
-	"strconv"
-	"time"
 
-	"github.com/buger/jsonparser"
 	"github.com/gladiusio/gladius-guardian/updater"
 	"github.com/gorilla/mux"
-	"github.com/spf13/viper"
 )
 
+// IndexHandler - The dashboard for browsers, a pointer to the docs for
+// everything else
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	if wantsHTML(r) {
+		serveDashboard(w, r)
+		return
+	}
 	ResponseHandler(w, r, "There's nothing here, check our API docs at https://github.com/gladiusio/gladius-guardian", true, nil, "")
 }
 
@@ -21,99 +23,87 @@ func GetServicesHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http
 		vars := mux.Vars(r)
 		sn := vars["service_name"]
 
-		ResponseHandler(w, r, "Got service status", true, nil, gg.GetServicesStatus(sn))
+		status, err := gg.GetServicesStatus(sn)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't get service status", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Got service status", true, nil, status)
 	}
 }
 
 func ServiceStateHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get desired run state, optionally environment variables
-		vals, err := getJSONFields(w, r, "running", "environment_vars")
-		if err != nil {
+		req := &SetStateRequest{}
+		if err := decodeJSONBody(w, r, req); err != nil {
 			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
 			return
 		}
-		if _, ok := vals["running"]; !ok {
-			ErrorHandler(w, r, "Need 'running' in request", err, http.StatusBadRequest)
-			return
-		}
 
 		// Get the service name from the URL
 		vars := mux.Vars(r)
 		sn := vars["service_name"]
 
-		environmentVars := make([]string, 0)
-
-		// Defaults will be used if empty, so only specify if we have some to add
-		if envBytes, ok := vals["environment_vars"]; ok {
-			// Add our defaults just in case, they can be overriden if they are redefined
-			environmentVars = append(environmentVars, viper.GetStringSlice("DefaultEnvironment")...)
-
-			// Add the desired environment vars
-			jsonparser.ArrayEach(envBytes, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-				environmentVars = append(environmentVars, string(value))
+		// Start or stop the service, in the background if asked to
+		async := req.Async || wantsAsync(r)
+		if *req.Running {
+			runOperation(gg, w, r, async, "start", sn, func(progress func(string)) (interface{}, error) {
+				progress(fmt.Sprintf("starting %s and waiting out the start timeout", sn))
+				if err := gg.StartService(sn, req.EnvironmentVars, req.timeout()); err != nil {
+					return nil, err
+				}
+				return gg.GetServicesStatus(sn)
+			}, func(op *Operation) {
+				if op.err != nil {
+					ErrorHandler(w, r, "Error starting service", op.err, http.StatusBadRequest)
+					return
+				}
+				ResponseHandler(w, r, "Attempted to start service, check logs to make sure it didn't fail after timeout", true, nil, op.Result)
 			})
-		}
-
-		// Parse the run state they want
-		setRunning, err := strconv.ParseBool(string(vals["running"]))
-		if err != nil {
-			ErrorHandler(w, r, "Could not parse running as type bool", err, http.StatusBadRequest)
-			return
-		}
-
-		// Start or stop the service
-		if setRunning {
-			err = gg.StartService(sn, environmentVars)
-			if err != nil {
-				ErrorHandler(w, r, "Error starting service", err, http.StatusBadRequest)
-				return
-			}
-			ResponseHandler(w, r, "Attempted to start service, check logs to make sure it didn't fail after timeout", true, nil, gg.GetServicesStatus(sn))
 		} else {
-			err = gg.StopService(sn)
-			if err != nil {
-				ErrorHandler(w, r, "Error stoping service", err, http.StatusBadRequest)
-				return
-			}
-			time.Sleep(200 * time.Millisecond)
-			ResponseHandler(w, r, "Stopped Service", true, nil, gg.GetServicesStatus(sn))
+			runOperation(gg, w, r, async, "stop", sn, func(progress func(string)) (interface{}, error) {
+				progress("stopping " + sn)
+				if err := gg.StopService(sn, req.timeout()); err != nil {
+					return nil, err
+				}
+				return gg.GetServicesStatus(sn)
+			}, func(op *Operation) {
+				if op.err != nil {
+					ErrorHandler(w, r, "Error stoping service", op.err, http.StatusBadRequest)
+					return
+				}
+				ResponseHandler(w, r, "Stopped Service", true, nil, op.Result)
+			})
 		}
-
 	}
 }
 
 func SetStartTimeoutHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vals, err := getJSONFields(w, r, "timeout")
-		if err != nil {
+		req := &SetTimeoutRequest{}
+		if err := decodeJSONBody(w, r, req); err != nil {
 			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
 			return
 		}
-		if _, ok := vals["timeout"]; !ok {
-			ErrorHandler(w, r, "Need 'timeout' in request", err, http.StatusBadRequest)
+		if err := gg.SetServiceTimeouts(req.Service, seconds(req.Timeout), seconds(req.StopTimeout)); err != nil {
+			ErrorHandler(w, r, "Couldn't set timeout", err, ServiceErrorStatus(err))
 			return
 		}
-		t, err := strconv.Atoi(string(vals["timeout"]))
-		if err != nil {
-			ErrorHandler(w, r, "Couldn't parse timeout, must be in seconds", err, http.StatusBadRequest)
-			return
+		resp := &TimeoutResponse{Service: req.Service}
+		if req.Timeout != nil {
+			resp.Timeout = *req.Timeout
 		}
-		dur := time.Duration(t) * time.Second
-		gg.SetTimeout(&dur)
-		response := make(map[string]int)
-		response["timeout"] = t
-		ResponseHandler(w, r, "Set timeout", true, nil, response)
+		if req.StopTimeout != nil {
+			resp.StopTimeout = *req.StopTimeout
+		}
+		ResponseHandler(w, r, "Set timeout", true, nil, resp)
 	}
 }
 
 func GetOldLogsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		toReturn := make(map[string]([]string))
-		for name, fsl := range gg.serviceLogs {
-			toReturn[name] = fsl.LogLines()
-		}
-		ResponseHandler(w, r, "Got logs", true, nil, toReturn)
+		ResponseHandler(w, r, "Got logs", true, nil, gg.GetAllLogs())
 	}
 }
 
@@ -136,6 +126,7 @@ func VersionHandler() func(w http.ResponseWriter, r *http.Request) {
 		officialVersions, err := updater.GetOfficialVersions()
 		if err != nil {
 			ErrorHandler(w, r, "Couldn't get official versions", err, http.StatusBadRequest)
+			return
 		}
 
 		modules := [3]string{"guardian", "edged", "network-gateway"}
@@ -162,6 +153,6 @@ func VersionHandler() func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		ResponseHandler(w, r, fmt.Sprintf("Got version for %s", service), true, nil, response["service"])
+		ResponseHandler(w, r, fmt.Sprintf("Got version for %s", service), true, nil, response[fmt.Sprintf("gladius-%s", service)])
 	}
 }
@@ -0,0 +1,201 @@
+package guardian
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Machine readable error codes returned in the code field of a Response
+const (
+	CodeBadRequest   = "bad_request"
+	CodeInvalidBody  = "invalid_body"
+	CodeValidation   = "validation_failed"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeBodyTooLarge = "body_too_large"
+	CodeRateLimited  = "rate_limited"
+	CodeInternal     = "internal_error"
+	CodeUnavailable  = "unavailable"
+)
+
+// FieldError describes a problem with a single field of a request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// APIError is an error with a machine readable code, and field errors if the
+// request body didn't validate
+type APIError struct {
+	Code    string
+	Message string
+	Fields  []FieldError
+}
+
+func (e *APIError) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		parts[i] = f.Field + " " + f.Message
+	}
+	return e.Message + ": " + strings.Join(parts, ", ")
+}
+
+// codeForStatus is the code used for errors that don't carry their own
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeBodyTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// requestValidator is implemented by request bodies that check more than
+// required fields
+type requestValidator interface {
+	Validate() []FieldError
+}
+
+// SetStateRequest is the body of PUT /service/set_state/{service_name}
+type SetStateRequest struct {
+	Running         *bool    `json:"running" required:"true" description:"Whether the service should be running"`
+	EnvironmentVars []string `json:"environment_vars,omitempty" description:"KEY=VALUE pairs added to the default environment when starting"`
+	Timeout         *int     `json:"timeout,omitempty" description:"Seconds to wait for this start, or for this stop before killing it, instead of the service's timeout"`
+	Async           bool     `json:"async,omitempty" description:"Answer with an operation straight away instead of waiting"`
+}
+
+// Validate checks the environment variables are KEY=VALUE pairs and the
+// timeout is positive
+func (req *SetStateRequest) Validate() []FieldError {
+	errs := ValidateEnv("environment_vars", req.EnvironmentVars)
+	return append(errs, validateSeconds("timeout", req.Timeout)...)
+}
+
+// timeout is the requested timeout, 0 for the service's own
+func (req *SetStateRequest) timeout() time.Duration {
+	return seconds(req.Timeout)
+}
+
+// SetTimeoutRequest is the body of POST /service/set_timeout
+type SetTimeoutRequest struct {
+	Service     string `json:"service,omitempty" description:"Service to set the timeouts of, every service without its own if empty"`
+	Timeout     *int   `json:"timeout,omitempty" description:"Seconds to wait for a service to start"`
+	StopTimeout *int   `json:"stop_timeout,omitempty" description:"Seconds a service gets to exit after SIGTERM before it's killed"`
+}
+
+// Validate checks there's at least one timeout and they're positive
+func (req *SetTimeoutRequest) Validate() []FieldError {
+	if req.Timeout == nil && req.StopTimeout == nil {
+		return []FieldError{{Field: "timeout", Message: "is required unless stop_timeout is set"}}
+	}
+	errs := validateSeconds("timeout", req.Timeout)
+	return append(errs, validateSeconds("stop_timeout", req.StopTimeout)...)
+}
+
+// TimeoutResponse is returned after setting the timeouts
+type TimeoutResponse struct {
+	Service     string `json:"service,omitempty" description:"Service the timeouts were set for, every service if empty"`
+	Timeout     int    `json:"timeout,omitempty" description:"Seconds to wait for a service to start"`
+	StopTimeout int    `json:"stop_timeout,omitempty" description:"Seconds a service gets to exit after SIGTERM before it's killed"`
+}
+
+func validateSeconds(field string, n *int) []FieldError {
+	if n != nil && *n <= 0 {
+		return []FieldError{{Field: field, Message: "must be a positive number of seconds"}}
+	}
+	return nil
+}
+
+func seconds(n *int) time.Duration {
+	if n == nil {
+		return 0
+	}
+	return time.Duration(*n) * time.Second
+}
+
+// ValidateEnv returns an error for every entry that isn't KEY=VALUE or has a
+// bad template
+func ValidateEnv(field string, env []string) []FieldError {
+	var errs []FieldError
+	for i, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t\n") {
+			errs = append(errs, FieldError{
+				Field:   fmt.Sprintf("%s[%d]", field, i),
+				Message: "must be in the form KEY=VALUE",
+			})
+			continue
+		}
+		if isSecretRef(parts[1]) && strings.TrimPrefix(strings.TrimPrefix(parts[1], FileRefPrefix), SecretRefPrefix) == "" {
+			errs = append(errs, FieldError{
+				Field:   fmt.Sprintf("%s[%d]", field, i),
+				Message: "reference is missing a file or secret name",
+			})
+		}
+	}
+	return append(errs, ValidateTemplates(field, env)...)
+}
+
+// checkRequired returns an error for every field tagged required that is
+// still nil after decoding
+func checkRequired(v interface{}) []FieldError {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var errs []FieldError
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.Tag.Get("required") != "true" {
+			continue
+		}
+		fv := rv.Field(i)
+		switch fv.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			if fv.IsNil() {
+				errs = append(errs, FieldError{Field: jsonFieldName(f), Message: "is required"})
+			}
+		case reflect.String:
+			if fv.Len() == 0 {
+				errs = append(errs, FieldError{Field: jsonFieldName(f), Message: "is required"})
+			}
+		}
+	}
+	return errs
+}
+
+// jsonFieldName returns the name a struct field has in JSON
+func jsonFieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
@@ -0,0 +1,283 @@
+package guardian
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Environment values starting with these are read when the service is
+// spawned instead of being passed as is, like DB_PASSWORD=@secret:db
+const (
+	FileRefPrefix   = "@file:"   // Contents of a file, without the trailing newline
+	SecretRefPrefix = "@secret:" // A value from the secret store
+)
+
+// minRedactLength is the shortest secret scrubbed from service output, a
+// secret of "1" would mangle every line
+const minRedactLength = 4
+
+// ErrSecretNotFound is returned for names that aren't in the store
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretStore is a local file of secrets encrypted with AES-256-GCM, the key
+// is kept in a separate file that only the guardian's user can read
+type SecretStore struct {
+	path    string
+	keyPath string
+	mux     sync.Mutex
+}
+
+// secretsFile is the JSON in the store file, values are base64 of the nonce
+// followed by the sealed value
+type secretsFile struct {
+	Secrets map[string]string `json:"secrets"`
+}
+
+// NewSecretStore returns a store kept in path with its key in keyPath, both
+// are created by the first Set
+func NewSecretStore(path, keyPath string) *SecretStore {
+	return &SecretStore{path: path, keyPath: keyPath}
+}
+
+// Get returns the value of a secret
+func (s *SecretStore) Get(name string) (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	f, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	sealed, ok := f.Secrets[name]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	gcm, err := s.cipher(false)
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return "", errors.New("secret is corrupt")
+	}
+	value, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", errors.New("couldn't decrypt secret, the key file may have changed")
+	}
+	return string(value), nil
+}
+
+// Set adds or replaces a secret, creating the key if there isn't one yet
+func (s *SecretStore) Set(name, value string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	f, err := s.read()
+	if err != nil {
+		return err
+	}
+	gcm, err := s.cipher(true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// The name is authenticated so values can't be swapped between names
+	f.Secrets[name] = base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), []byte(name)))
+	return s.write(f)
+}
+
+// Delete removes a secret
+func (s *SecretStore) Delete(name string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	f, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := f.Secrets[name]; !ok {
+		return ErrSecretNotFound
+	}
+	delete(f.Secrets, name)
+	return s.write(f)
+}
+
+// Names returns the names of every secret, sorted
+func (s *SecretStore) Names() ([]string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	f, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(f.Secrets))
+	for name := range f.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *SecretStore) read() (*secretsFile, error) {
+	f := &secretsFile{Secrets: make(map[string]string)}
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %s", s.path, err)
+	}
+	if f.Secrets == nil {
+		f.Secrets = make(map[string]string)
+	}
+	return f, nil
+}
+
+func (s *SecretStore) write(f *secretsFile) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(b, '\n'), 0600)
+}
+
+// cipher loads the key, or creates it if create is set and there isn't one
+func (s *SecretStore) cipher(create bool) (cipher.AEAD, error) {
+	b, err := ioutil.ReadFile(s.keyPath)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		b = []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+		if err := writeFileAtomic(s.keyPath, b, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't read the secrets key: %s", err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s isn't a base64 256 bit key", s.keyPath)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeFileAtomic writes to a temporary file and renames it over path, so a
+// crash can't leave half a file
+func writeFileAtomic(path string, b []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SetSecretStore - Set the store @secret: references are read from
+func (gg *GladiusGuardian) SetSecretStore(s *SecretStore) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	gg.secrets = s
+}
+
+// resolveEnv replaces file and secret references with their values. It also
+// returns the values that were read, and those of secret looking variables,
+// so they can be scrubbed from the service's output
+func (gg *GladiusGuardian) resolveEnv(env []string) ([]string, []string, error) {
+	gg.mux.Lock()
+	store := gg.secrets
+	gg.mux.Unlock()
+
+	resolved := make([]string, len(env))
+	var secrets []string
+	for i, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			resolved[i] = e
+			continue
+		}
+		key, value := parts[0], parts[1]
+
+		switch {
+		case strings.HasPrefix(value, FileRefPrefix):
+			b, err := ioutil.ReadFile(strings.TrimPrefix(value, FileRefPrefix))
+			if err != nil {
+				return nil, nil, fmt.Errorf("couldn't read %s: %s", key, err)
+			}
+			value = strings.TrimRight(string(b), "\r\n")
+			secrets = append(secrets, value)
+		case strings.HasPrefix(value, SecretRefPrefix):
+			if store == nil {
+				return nil, nil, fmt.Errorf("couldn't read %s: no secret store", key)
+			}
+			v, err := store.Get(strings.TrimPrefix(value, SecretRefPrefix))
+			if err != nil {
+				return nil, nil, fmt.Errorf("couldn't read %s: %s", key, err)
+			}
+			value = v
+			secrets = append(secrets, value)
+		case IsSecretKey(key):
+			secrets = append(secrets, value)
+		}
+		resolved[i] = key + "=" + value
+	}
+	return resolved, secrets, nil
+}
+
+// redactSecrets replaces every secret in the line
+func redactSecrets(line string, secrets []string) string {
+	for _, s := range secrets {
+		if len(s) >= minRedactLength {
+			line = strings.Replace(line, s, Redacted, -1)
+		}
+	}
+	return line
+}
+
+// loggableEnv is the environment an instance was spawned with for logs, with
+// secret looking variables and resolved secrets hidden
+func (gg *GladiusGuardian) loggableEnv(name string, index int, env []string) string {
+	gg.mux.Lock()
+	secrets := gg.instance(name, index).secrets
+	gg.mux.Unlock()
+
+	return redactSecrets(strings.Join(RedactEnv(env), ", "), secrets)
+}
@@ -0,0 +1,137 @@
+package guardian
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSecretStore(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSecretStore(filepath.Join(dir, "secrets.json"), filepath.Join(dir, "secrets.key"))
+	if _, err := s.Get("db"); err != ErrSecretNotFound {
+		t.Errorf("getting from a store that doesn't exist yet: got %v", err)
+	}
+	for name, value := range map[string]string{"db": "hunter22", "api": "abc123"} {
+		if err := s.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, err := os.Stat(s.keyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file: got %v, %v, want mode 0600", info, err)
+	}
+	if b, _ := ioutil.ReadFile(s.path); strings.Contains(string(b), "hunter22") {
+		t.Error("the store file has the secret in the clear")
+	}
+
+	// A swapped value doesn't decrypt under another name, and a value sealed
+	// with another key doesn't decrypt at all
+	f, _ := s.read()
+	f.Secrets["swapped"] = f.Secrets["db"]
+	s.write(f)
+	other := NewSecretStore(s.path, filepath.Join(dir, "other.key"))
+	other.Set("unused", "x")
+
+	tests := []struct {
+		name    string
+		store   *SecretStore
+		want    string
+		wantErr string
+	}{
+		{"db", s, "hunter22", ""},
+		{"api", s, "abc123", ""},
+		{"missing", s, "", ErrSecretNotFound.Error()},
+		{"swapped", s, "", "couldn't decrypt"},
+		{"db", other, "", "couldn't decrypt"},
+	}
+	for _, test := range tests {
+		got, err := test.store.Get(test.name)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got %q, %v, want an error with %q", test.name, got, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+
+	if err := s.Delete("swapped"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("swapped"); err != ErrSecretNotFound {
+		t.Errorf("deleting a secret twice: got %v", err)
+	}
+	if names, err := s.Names(); err != nil || !reflect.DeepEqual(names, []string{"api", "db", "unused"}) {
+		t.Errorf("got names %v, %v", names, err)
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	dir := t.TempDir()
+	store := NewSecretStore(filepath.Join(dir, "secrets.json"), filepath.Join(dir, "secrets.key"))
+	if err := store.Set("db", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "tls.key")
+	ioutil.WriteFile(keyFile, []byte("key-contents\n"), 0600)
+
+	tests := []struct {
+		name        string
+		store       *SecretStore
+		env         []string
+		want        []string
+		wantSecrets []string
+		wantErr     string
+	}{
+		{"plain", store, []string{"PORT=8080", "NOVALUE"}, []string{"PORT=8080", "NOVALUE"}, nil, ""},
+		{"secret", store, []string{"DB_URL=@secret:db"}, []string{"DB_URL=hunter22"}, []string{"hunter22"}, ""},
+		{"file", store, []string{"TLS=@file:" + keyFile}, []string{"TLS=key-contents"}, []string{"key-contents"}, ""},
+		{"secret looking key", store, []string{"API_TOKEN=abcdef"}, []string{"API_TOKEN=abcdef"}, []string{"abcdef"}, ""},
+		{"missing secret", store, []string{"DB_URL=@secret:nope"}, nil, nil, "couldn't read DB_URL: secret not found"},
+		{"missing file", store, []string{"TLS=@file:" + keyFile + ".missing"}, nil, nil, "couldn't read TLS"},
+		{"no store", nil, []string{"DB_URL=@secret:db"}, nil, nil, "no secret store"},
+	}
+	for _, test := range tests {
+		gg := New()
+		gg.SetSecretStore(test.store)
+		got, secrets, err := gg.resolveEnv(test.env)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got %v, want an error with %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(secrets, test.wantSecrets) {
+			t.Errorf("%s: got %q and secrets %q, want %q and %q", test.name, got, secrets, test.want, test.wantSecrets)
+		}
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		line    string
+		secrets []string
+		want    string
+	}{
+		{"connecting with s3cr3t-value", []string{"s3cr3t-value"}, "connecting with " + Redacted},
+		{"a=s3cr3t-value b=s3cr3t-value", []string{"s3cr3t-value"}, "a=" + Redacted + " b=" + Redacted},
+		{"two secrets: first-secret second-secret", []string{"first-secret", "second-secret"}, "two secrets: " + Redacted + " " + Redacted},
+		{"nothing to hide", []string{"s3cr3t-value"}, "nothing to hide"},
+		{"short values like on are kept", []string{"on"}, "short values like on are kept"},
+		{"no secrets", nil, "no secrets"},
+	}
+	for _, test := range tests {
+		if got := redactSecrets(test.line, test.secrets); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.line, got, test.want)
+		}
+	}
+}
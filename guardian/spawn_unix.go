@@ -7,25 +7,25 @@ import (
 	"errors"
 	"fmt"
 	"os/exec"
-	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // spawnProcess - spawn a unix process
-func (gg *GladiusGuardian) spawnProcess(name, location string, env []string, timeout *time.Duration) (*exec.Cmd, error) {
-	p := exec.Command(location)
+func (gg *GladiusGuardian) spawnProcess(name string, inst *instance, location string, args, env []string, timeout time.Duration) (*exec.Cmd, chan struct{}, error) {
+	p := exec.Command(location, args...)
 	p.Env = env
 
 	// Create standard err and out pipes
 	stdOut, err := p.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("Error creating StdoutPipe for command: %s", err)
+		return nil, nil, fmt.Errorf("Error creating StdoutPipe for command: %s", err)
 	}
 	stdErr, err := p.StderrPipe()
 	if err != nil {
-		return nil, fmt.Errorf("Error creating StderrPipe for command: %s", err)
+		return nil, nil, fmt.Errorf("Error creating StderrPipe for command: %s", err)
 	}
 
 	// Read both of those in
@@ -34,13 +34,13 @@ func (gg *GladiusGuardian) spawnProcess(name, location string, env []string, tim
 	go func() {
 		defer stdOut.Close()
 		for scanner.Scan() {
-			gg.AppendToLog(name, scanner.Text())
+			gg.appendLog(name, inst.index, scanner.Text())
 		}
 	}()
 	go func() {
 		defer stdErr.Close()
 		for stdErrScanner.Scan() {
-			gg.AppendToLog(name, stdErrScanner.Text())
+			gg.appendLog(name, inst.index, stdErrScanner.Text())
 		}
 	}()
 
@@ -49,42 +49,50 @@ func (gg *GladiusGuardian) spawnProcess(name, location string, env []string, tim
 	if err != nil {
 		log.WithFields(log.Fields{
 			"exec_location":    location,
-			"environment_vars": strings.Join(env, ", "),
+			"environment_vars": gg.loggableEnv(name, inst.index, env),
 			"err":              err,
 		}).Warn("Couldn't spawn process")
-		return nil, fmt.Errorf("Error starting process: %s", err)
+		return nil, nil, fmt.Errorf("Error starting process: %s", err)
 	}
 
+	exited := make(chan struct{})
 	go func() {
 		err := p.Wait()
-		gg.services[name] = nil // Set out service to nil when it dies
+		gg.processExited(name, inst, p, exited, err) // Set out service to nil when it dies
 		if err != nil {
-			// Only log errors if we didn't kill it
-			if err.Error() != "signal: killed" {
+			// Only log errors if we didn't stop it
+			if err.Error() != "signal: killed" && err.Error() != "signal: terminated" {
 				log.WithFields(log.Fields{
 					"exec_location":    location,
-					"environment_vars": strings.Join(env, ", "),
+					"environment_vars": gg.loggableEnv(name, inst.index, env),
 					"err":              err,
 				}).Error("Service errored out")
-				gg.AppendToLog(name, "Exiting... "+err.Error())
+				gg.appendLog(name, inst.index, "Exiting... "+err.Error())
 			}
 		}
 	}()
 
-	// Wait for the process to start
-	time.Sleep(*timeout)
-	if p.ProcessState != nil { // ProcessState is only non-nil if p.Wait() concludes
-		if p.ProcessState.Exited() {
-			return nil, fmt.Errorf("process %s already exited, check the logs for errors", name)
-		}
+	// Wait for the process to start, exited is closed once p.Wait() concludes
+	select {
+	case <-exited:
+		return nil, nil, fmt.Errorf("process %s already exited, check the logs for errors", name)
+	case <-time.After(timeout):
+	}
+	return p, exited, nil
+}
+
+// terminateProcess - ask a unix process to exit with SIGTERM
+func terminateProcess(gg *GladiusGuardian, name string, p *exec.Cmd) error {
+	err := p.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		return errors.New("could not signal unix process")
 	}
-	return p, nil
+	return nil
 }
 
 // killProcess - kill a unix process
-func killProcess(gg *GladiusGuardian, name string) error {
-	service := gg.services[name]
-	err := service.Process.Kill()
+func killProcess(gg *GladiusGuardian, name string, p *exec.Cmd) error {
+	err := p.Process.Kill()
 	if err != nil {
 		return errors.New("could not kill unix process")
 	}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,19 +15,19 @@ import (
 )
 
 // spawnProcess - spawn a windows process
-func (gg *GladiusGuardian) spawnProcess(name, location string, env []string, timeout *time.Duration) (*exec.Cmd, error) {
+func (gg *GladiusGuardian) spawnProcess(name string, inst *instance, location string, args, env []string, timeout time.Duration) (*exec.Cmd, chan struct{}, error) {
 	log.Info("Starting service")
-	p := exec.Command("cmd.exe", "/C", location)
+	p := exec.Command("cmd.exe", append([]string{"/C", location}, args...)...)
 	p.Env = append(os.Environ(), env...)
 
 	// Create standard err and out pipes
 	stdOut, err := p.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("Error creating StdoutPipe for command: %s", err)
+		return nil, nil, fmt.Errorf("Error creating StdoutPipe for command: %s", err)
 	}
 	stdErr, err := p.StderrPipe()
 	if err != nil {
-		return nil, fmt.Errorf("Error creating StderrPipe for command: %s", err)
+		return nil, nil, fmt.Errorf("Error creating StderrPipe for command: %s", err)
 	}
 
 	// Pipe stdout to the logs
@@ -35,21 +36,21 @@ func (gg *GladiusGuardian) spawnProcess(name, location string, env []string, tim
 	go func() {
 		defer stdOut.Close()
 		for scanner.Scan() {
-			gg.AppendToLog(name, scanner.Text())
+			gg.appendLog(name, inst.index, scanner.Text())
 		}
 		err = scanner.Err()
 		if err != nil {
-			gg.AppendToLog(name, "STDOUT ERR: "+err.Error())
+			gg.appendLog(name, inst.index, "STDOUT ERR: "+err.Error())
 		}
 	}()
 	go func() {
 		defer stdErr.Close()
 		for stdErrScanner.Scan() {
-			gg.AppendToLog(name, stdErrScanner.Text())
+			gg.appendLog(name, inst.index, stdErrScanner.Text())
 		}
 		err = stdErrScanner.Err()
 		if err != nil {
-			gg.AppendToLog(name, "STDERR ERR: "+err.Error())
+			gg.appendLog(name, inst.index, "STDERR ERR: "+err.Error())
 		}
 	}()
 
@@ -58,69 +59,65 @@ func (gg *GladiusGuardian) spawnProcess(name, location string, env []string, tim
 	if err != nil {
 		log.WithFields(log.Fields{
 			"exec_location":    location,
-			"environment_vars": strings.Join(env, ", "),
+			"environment_vars": gg.loggableEnv(name, inst.index, env),
 			"err":              err,
 		}).Warn("Couldn't spawn process")
-		return nil, fmt.Errorf("\nError starting process: %s", err)
+		return nil, nil, fmt.Errorf("\nError starting process: %s", err)
 	}
 
-	// Timeout test, can we find the process before the timeout?
-	time.Sleep(*timeout)
-	process, err := GetProcess(location + ".exe")
-	if err != nil {
-		return nil, fmt.Errorf("could not finding process %s or failed to start before timeout, check the logs for errors", name)
-	}
-
-	// this waits for the process to end
+	// this waits for the process to end, cmd.exe exits with the service
+	exited := make(chan struct{})
 	go func() {
-		_, err := process.Wait()
-		gg.services[name] = nil // Set out service to nil when it dies
+		err := p.Wait()
+		gg.processExited(name, inst, p, exited, err) // Set out service to nil when it dies
 		if err != nil {
 			// Only log errors if we didn't kill it
 			if err.Error() != "signal: killed" {
 				log.WithFields(log.Fields{
 					"exec_location":    location,
-					"environment_vars": strings.Join(env, ", "),
+					"environment_vars": gg.loggableEnv(name, inst.index, env),
 					"err":              err,
 				}).Error("Service errored out")
-				gg.AppendToLog(name, "Exiting... "+err.Error())
+				gg.appendLog(name, inst.index, "Exiting... "+err.Error())
 			}
 		}
 	}()
 
-	return p, nil
+	// Wait for the process to start, exited is closed once p.Wait() concludes
+	select {
+	case <-exited:
+		return nil, nil, fmt.Errorf("process %s already exited, check the logs for errors", name)
+	case <-time.After(timeout):
+	}
+	return p, exited, nil
 }
 
-// GetProcess - Returns process obj (Windows only)
-func GetProcess(name string) (*os.Process, error) {
-	// find process id by name
-	processID, err := win.GetProcessWindows(name)
-	if err != nil {
-		return nil, fmt.Errorf("error getting process id")
-	}
-	// load the process up to return it
-	process, err := os.FindProcess(processID)
+// terminateProcess - ask a windows process and the ones it started to close.
+// Console programs can't be asked, taskkill fails for them and they're killed
+func terminateProcess(gg *GladiusGuardian, name string, p *exec.Cmd) error {
+	out, err := exec.Command("taskkill", "/T", "/PID", strconv.Itoa(p.Process.Pid)).CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("error loading process")
+		return fmt.Errorf("could not ask windows process to close: %s", strings.TrimSpace(string(out)))
 	}
-
-	return process, nil
+	return nil
 }
 
-// killProcess - kill a windows process
-func killProcess(gg *GladiusGuardian, name string) error {
-	// get the process by name
-	process, err := GetProcess("gladius-" + name + ".exe")
+// killProcess - kill a windows process and every process it started, p is
+// the cmd.exe the service runs under
+func killProcess(gg *GladiusGuardian, name string, p *exec.Cmd) error {
+	children, err := win.Descendants(p.Process.Pid)
 	if err != nil {
-		return errors.New("could not find windows process")
+		return errors.New("could not list windows processes")
+	}
+	for _, pid := range children {
+		if process, err := os.FindProcess(pid); err == nil {
+			process.Kill() // It may have exited already
+		}
 	}
-	log.Info("Stopping service")
 
-	// kill the process
-	err = process.Kill()
+	err = p.Process.Kill()
 	if err != nil {
 		return errors.New("could not kill windows process")
 	}
-
 	return nil
 }
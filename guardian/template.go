@@ -0,0 +1,117 @@
+package guardian
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is what {{...}} in service environments and arguments can
+// use, like GLADIUSBASE={{.Base}} or --port={{.Ports.EdgeD}}
+type TemplateData struct {
+	Base     string         // The Gladius base
+	Service  string         // Name of the service being started
+	Hostname string         // Name of this machine
+	Instance int            // Index of the instance, from 0
+	Ports    map[string]int // The Ports settings
+}
+
+// templateValues is where the data that isn't about the service comes from
+type templateValues struct {
+	base  string
+	ports func() map[string]int
+}
+
+// SetTemplateValues - Set the Gladius base and where the ports come from for
+// templates, ports is called on every start so reloaded ports are used
+func (gg *GladiusGuardian) SetTemplateValues(base string, ports func() map[string]int) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	gg.templateValues = &templateValues{base: base, ports: ports}
+}
+
+// templateData returns the data for starting an instance of the service
+func (gg *GladiusGuardian) templateData(name string, instance int) *TemplateData {
+	data := &TemplateData{Service: name, Instance: instance, Ports: make(map[string]int)}
+	data.Hostname, _ = os.Hostname()
+	if gg.templateValues != nil {
+		data.Base = gg.templateValues.base
+		if gg.templateValues.ports != nil {
+			ReadConfig(func() { data.Ports = gg.templateValues.ports() })
+		}
+	}
+	return data
+}
+
+// expand fills in the templates in env and args for an instance of the
+// service, the lock must be held
+func (gg *GladiusGuardian) expand(name string, index int, env, args []string) ([]string, []string, error) {
+	data := gg.templateData(name, index)
+	env, err := ExpandTemplates(env, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	args, err = ExpandTemplates(args, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return env, args, nil
+}
+
+// ExpandTemplates returns a copy of values with their templates filled in,
+// unknown fields and ports are an error rather than an empty string
+func ExpandTemplates(values []string, data *TemplateData) ([]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	expanded := make([]string, len(values))
+	for i, value := range values {
+		if !strings.Contains(value, "{{") {
+			expanded[i] = value
+			continue
+		}
+		t, err := parseTemplate(value)
+		if err != nil {
+			return nil, err
+		}
+		var b bytes.Buffer
+		if err := t.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("couldn't expand %q: %s", value, err)
+		}
+		expanded[i] = b.String()
+	}
+	return expanded, nil
+}
+
+// templateFuncs can be used in templates, like {{add .Ports.EdgeD .Instance}}
+// for a port per instance
+var templateFuncs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"mul": func(a, b int) int { return a * b },
+}
+
+func parseTemplate(value string) (*template.Template, error) {
+	t, err := template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("bad template %q: %s", value, err)
+	}
+	return t, nil
+}
+
+// ValidateTemplates returns an error for every value that isn't a valid
+// template, what it refers to is only checked when it's expanded
+func ValidateTemplates(field string, values []string) []FieldError {
+	var errs []FieldError
+	for i, value := range values {
+		if !strings.Contains(value, "{{") {
+			continue
+		}
+		if _, err := parseTemplate(value); err != nil {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("%s[%d]", field, i), Message: err.Error()})
+		}
+	}
+	return errs
+}
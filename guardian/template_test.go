@@ -0,0 +1,77 @@
+package guardian_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gladiusio/gladius-guardian/guardian"
+)
+
+func TestExpandTemplates(t *testing.T) {
+	data := &guardian.TemplateData{
+		Base:     "/opt/gladius",
+		Service:  "edged",
+		Hostname: "node1",
+		Instance: 2,
+		Ports:    map[string]int{"EdgeD": 8080, "edged": 8080},
+	}
+
+	tests := []struct {
+		name    string
+		values  []string
+		want    []string
+		wantErr string
+	}{
+		{"nil", nil, nil, ""},
+		{"no templates", []string{"PORT=8080", "--verbose"}, []string{"PORT=8080", "--verbose"}, ""},
+		{"fields", []string{"GLADIUSBASE={{.Base}}", "NAME={{.Service}}-{{.Hostname}}-{{.Instance}}"}, []string{"GLADIUSBASE=/opt/gladius", "NAME=edged-node1-2"}, ""},
+		{"ports", []string{"--port={{.Ports.EdgeD}}", "--port={{.Ports.edged}}"}, []string{"--port=8080", "--port=8080"}, ""},
+		{"funcs", []string{"--port={{add .Ports.EdgeD .Instance}}", "--id={{mul .Instance 10}}"}, []string{"--port=8082", "--id=20"}, ""},
+		{"unknown port", []string{"--port={{.Ports.Missing}}"}, nil, "couldn't expand"},
+		{"unknown field", []string{"{{.Nope}}"}, nil, "couldn't expand"},
+		{"bad template", []string{"{{.Base"}, nil, "bad template"},
+		{"unknown func", []string{"{{sub .Instance 1}}"}, nil, "bad template"},
+	}
+	for _, test := range tests {
+		got, err := guardian.ExpandTemplates(test.values, data)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got %q, %v, want an error with %q", test.name, got, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+
+	// The values passed in are left alone
+	values := []string{"{{.Base}}"}
+	guardian.ExpandTemplates(values, data)
+	if values[0] != "{{.Base}}" {
+		t.Errorf("expanding changed the values to %q", values)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []string // Fields with errors
+	}{
+		{nil, nil},
+		{[]string{"--port={{.Ports.EdgeD}}", "plain {not a template}"}, nil},
+		// Only parsed, what they refer to is checked when they're expanded
+		{[]string{"{{.Ports.Missing}}"}, nil},
+		{[]string{"ok", "{{.Base", "{{sub 1 1}}"}, []string{"args[1]", "args[2]"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, err := range guardian.ValidateTemplates("args", test.values) {
+			got = append(got, err.Field)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got errors for %q, want %q", test.values, got, test.want)
+		}
+	}
+}
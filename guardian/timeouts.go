@@ -0,0 +1,93 @@
+package guardian
+
+import (
+	"time"
+)
+
+// Used if the config doesn't set a valid timeout
+const (
+	DefaultStartTimeout = 3 * time.Second
+	DefaultStopTimeout  = 10 * time.Second
+)
+
+// timeoutOverride holds timeouts set through the API, zero means not set
+type timeoutOverride struct {
+	start time.Duration
+	stop  time.Duration
+}
+
+// SetServiceTimeouts - Set the start and stop timeouts of a service until the
+// guardian restarts, zero leaves a timeout as it is. An empty name sets the
+// ones of every service that doesn't have its own
+func (gg *GladiusGuardian) SetServiceTimeouts(name string, start, stop time.Duration) error {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	if _, ok := gg.registeredServices[name]; name != "" && !ok {
+		return &ServiceError{Service: name, Err: ErrServiceNotFound}
+	}
+	gg.setTimeouts(name, start, stop)
+	return nil
+}
+
+func (gg *GladiusGuardian) setTimeouts(name string, start, stop time.Duration) {
+	o := gg.timeouts[name]
+	if o == nil {
+		o = &timeoutOverride{}
+		gg.timeouts[name] = o
+	}
+	if start > 0 {
+		o.start = start
+	}
+	if stop > 0 {
+		o.stop = stop
+	}
+}
+
+// startTimeout is how long to wait for a service to start, from the most
+// specific setting: set for the service through the API, its Timeouts section
+// in the config, set for every service through the API and then StartTimeout.
+// The lock must be held
+func (gg *GladiusGuardian) startTimeout(name string) time.Duration {
+	if o := gg.timeouts[name]; o != nil && o.start > 0 {
+		return o.start
+	}
+	if d := configTimeout("Timeouts." + name + ".Start"); d > 0 {
+		return d
+	}
+	if o := gg.timeouts[""]; o != nil && o.start > 0 {
+		return o.start
+	}
+	if d := configTimeout("StartTimeout"); d > 0 {
+		return d
+	}
+	return DefaultStartTimeout
+}
+
+// stopTimeout is how long a service gets to exit before it's killed, looked
+// up like startTimeout. The lock must be held
+func (gg *GladiusGuardian) stopTimeout(name string) time.Duration {
+	if o := gg.timeouts[name]; o != nil && o.stop > 0 {
+		return o.stop
+	}
+	if d := configTimeout("Timeouts." + name + ".Stop"); d > 0 {
+		return d
+	}
+	if o := gg.timeouts[""]; o != nil && o.stop > 0 {
+		return o.stop
+	}
+	if d := configTimeout("StopTimeout"); d > 0 {
+		return d
+	}
+	return DefaultStopTimeout
+}
+
+// configTimeout returns the duration in the config, or 0 if it isn't set or
+// isn't valid
+func configTimeout(key string) time.Duration {
+	d, err := time.ParseDuration(configString(key))
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,69 @@
+package guardian
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestTimeoutPrecedence(t *testing.T) {
+	defer viper.Set("Timeouts", map[string]interface{}{})
+	defer viper.Set("StartTimeout", "")
+	defer viper.Set("StopTimeout", "")
+
+	tests := []struct {
+		name                string
+		service             map[string]interface{} // Timeouts.edged
+		start, stop         string                 // StartTimeout and StopTimeout
+		api, apiAll         *timeoutOverride       // Set for edged and for every service
+		wantStart, wantStop time.Duration
+	}{
+		{"defaults", nil, "", "", nil, nil, DefaultStartTimeout, DefaultStopTimeout},
+		{"config", nil, "5s", "20s", nil, nil, 5 * time.Second, 20 * time.Second},
+		{"invalid config", nil, "soon", "-1s", nil, nil, DefaultStartTimeout, DefaultStopTimeout},
+		{"service config", map[string]interface{}{"Start": "7s", "Stop": "30s"}, "5s", "20s", nil, nil, 7 * time.Second, 30 * time.Second},
+		{"service start only", map[string]interface{}{"Start": "7s"}, "5s", "20s", nil, nil, 7 * time.Second, 20 * time.Second},
+		{"api for every service", map[string]interface{}{"Start": "7s"}, "5s", "20s", nil, &timeoutOverride{start: time.Second, stop: 2 * time.Second}, 7 * time.Second, 2 * time.Second},
+		{"api for the service", map[string]interface{}{"Start": "7s", "Stop": "30s"}, "5s", "20s", &timeoutOverride{start: 9 * time.Second}, &timeoutOverride{stop: 2 * time.Second}, 9 * time.Second, 30 * time.Second},
+	}
+	for _, test := range tests {
+		viper.Set("Timeouts", map[string]interface{}{"edged": test.service})
+		viper.Set("StartTimeout", test.start)
+		viper.Set("StopTimeout", test.stop)
+		gg := New()
+		gg.RegisterService("edged", "edged", nil, 1)
+		if o := test.api; o != nil {
+			if err := gg.SetServiceTimeouts("edged", o.start, o.stop); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if o := test.apiAll; o != nil {
+			if err := gg.SetServiceTimeouts("", o.start, o.stop); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		gg.mux.Lock()
+		start, stop := gg.startTimeout("edged"), gg.stopTimeout("edged")
+		gg.mux.Unlock()
+		if start != test.wantStart || stop != test.wantStop {
+			t.Errorf("%s: got start %s and stop %s, want %s and %s", test.name, start, stop, test.wantStart, test.wantStop)
+		}
+	}
+}
+
+func TestSetServiceTimeouts(t *testing.T) {
+	gg := New()
+	gg.RegisterService("edged", "edged", nil, 1)
+	if err := gg.SetServiceTimeouts("missing", time.Second, 0); err == nil {
+		t.Error("set the timeouts of a service that isn't registered")
+	}
+
+	// Zero leaves a timeout as it was
+	gg.SetServiceTimeouts("edged", time.Second, 2*time.Second)
+	gg.SetServiceTimeouts("edged", 0, 5*time.Second)
+	if o := gg.timeouts["edged"]; o.start != time.Second || o.stop != 5*time.Second {
+		t.Errorf("got start %s and stop %s, want 1s and 5s", o.start, o.stop)
+	}
+}
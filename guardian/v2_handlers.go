@@ -0,0 +1,141 @@
+package guardian
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// StartRequest is the optional body of POST /v2/services/{service_name}/start
+// and /restart
+type StartRequest struct {
+	EnvironmentVars []string `json:"environment_vars,omitempty" description:"KEY=VALUE pairs added to the default environment"`
+	Timeout         *int     `json:"timeout,omitempty" description:"Seconds to wait for the start, and for the stop of a restart, instead of the service's timeouts"`
+	Async           bool     `json:"async,omitempty" description:"Answer with an operation straight away instead of waiting"`
+}
+
+// Validate checks the environment variables are KEY=VALUE pairs and the
+// timeout is positive
+func (req *StartRequest) Validate() []FieldError {
+	errs := ValidateEnv("environment_vars", req.EnvironmentVars)
+	return append(errs, validateSeconds("timeout", req.Timeout)...)
+}
+
+// V2ListServicesHandler - GET /v2/services
+func V2ListServicesHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		services := make([]*serviceStatus, 0)
+		for _, name := range gg.ServiceNames() {
+			status, err := gg.GetServiceStatus(name)
+			if err != nil {
+				continue // Removed while we were listing
+			}
+			services = append(services, status)
+		}
+		ResponseHandler(w, r, "Got services", true, nil, services)
+	}
+}
+
+// V2GetServiceHandler - GET /v2/services/{service_name}
+func V2GetServiceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := gg.GetServiceStatus(mux.Vars(r)["service_name"])
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't get service", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Got service", true, nil, status)
+	}
+}
+
+// V2ServiceActionHandler - POST /v2/services/{service_name}/{action} where
+// action is start, stop or restart
+func V2ServiceActionHandler(gg *GladiusGuardian, action string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sn := mux.Vars(r)["service_name"]
+
+		// Only single services here, all isn't special in v2
+		if _, err := gg.GetServiceStatus(sn); err != nil {
+			ErrorHandler(w, r, "Couldn't "+action+" service", err, ServiceErrorStatus(err))
+			return
+		}
+
+		req := &StartRequest{}
+		if action != "stop" {
+			if err := decodeOptionalJSONBody(w, r, req); err != nil {
+				ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+				return
+			}
+		}
+
+		var message, progressMessage string
+		var run func() error
+		switch action {
+		case "start":
+			message = "Started service"
+			progressMessage = "starting " + sn + " and waiting out the start timeout"
+			run = func() error { return gg.StartService(sn, req.EnvironmentVars, seconds(req.Timeout)) }
+		case "stop":
+			message = "Stopped service"
+			progressMessage = "stopping " + sn
+			run = func() error { return gg.StopService(sn, 0) }
+		case "restart":
+			message = "Restarted service"
+			progressMessage = "restarting " + sn
+			run = func() error { return gg.RestartService(sn, req.EnvironmentVars, seconds(req.Timeout)) }
+		}
+
+		runOperation(gg, w, r, req.Async || wantsAsync(r), action, sn, func(progress func(string)) (interface{}, error) {
+			progress(progressMessage)
+			if err := run(); err != nil {
+				return nil, err
+			}
+			status, err := gg.GetServiceStatus(sn)
+			if err != nil {
+				return nil, nil // Taken out of the config and removed once stopped
+			}
+			return status, nil
+		}, func(op *Operation) {
+			if op.err != nil {
+				ErrorHandler(w, r, "Couldn't "+action+" service", op.err, ServiceErrorStatus(op.err))
+				return
+			}
+			ResponseHandler(w, r, message, true, nil, op.Result)
+		})
+	}
+}
+
+// V2ServiceLogsHandler - GET /v2/services/{service_name}/logs, the lines
+// query parameter limits it to the newest lines and instance to the lines of
+// one instance
+func V2ServiceLogsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lines := 0
+		if l := r.URL.Query().Get("lines"); l != "" {
+			var err error
+			lines, err = strconv.Atoi(l)
+			if err != nil || lines < 0 {
+				ErrorHandler(w, r, "Couldn't parse lines, must be a positive number", err, http.StatusBadRequest)
+				return
+			}
+		}
+
+		index := -1
+		if i := r.URL.Query().Get("instance"); i != "" {
+			var err error
+			index, err = strconv.Atoi(i)
+			if err != nil || index < 0 {
+				ErrorHandler(w, r, "Couldn't parse instance, must be a positive number", err, http.StatusBadRequest)
+				return
+			}
+		}
+
+		logs, err := gg.GetLogs(mux.Vars(r)["service_name"], index, lines)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't get logs", err, ServiceErrorStatus(err))
+			return
+		}
+		ResponseHandler(w, r, "Got logs", true, nil, logs)
+	}
+}
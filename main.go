@@ -2,22 +2,40 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/gladiusio/gladius-common/pkg/routing"
 	"github.com/gladiusio/gladius-common/pkg/utils"
+	"github.com/gladiusio/gladius-guardian/cli"
 	"github.com/gladiusio/gladius-guardian/config"
+	"github.com/gladiusio/gladius-guardian/forwarder"
 	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/gladiusio/gladius-guardian/server"
 	"github.com/gladiusio/gladius-guardian/service"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// version of the guardian reported by the API
+const version = "0.7.1"
+
 func main() {
+	// The config checks and reads the guardian's sections through this
+	config.SetSections(guardianSections{})
+
+	// Client commands talk to a running guardian, everything else is for the
+	// service manager
+	if cli.IsCommand(os.Args[1:]) {
+		os.Exit(cli.Run(version, os.Args[1:]))
+	}
+
 	service.SetupService(run)
 }
 
@@ -33,59 +51,288 @@ func run() {
 	r := mux.NewRouter()
 	gg := guardian.New()
 
-	// Register our two daemons
-	gg.RegisterService(
-		"edged",
-		viper.GetString("NetworkdExecutable"),
-		viper.GetStringSlice("DefaultEnvironment"),
-	)
-	gg.RegisterService(
-		"network-gateway",
-		viper.GetString("ControldExecutable"),
-		viper.GetStringSlice("DefaultEnvironment"),
+	// Optionally ship service and guardian logs somewhere else
+	fwd, err := forwarder.FromConfig()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Couldn't setup log forwarding")
+	}
+	if fwd != nil {
+		gg.SetLogForwarder(fwd)
+		if viper.GetBool("LogForwarding.GuardianLogs") {
+			log.AddHook(forwarder.NewHook(fwd))
+		}
+	}
+
+	// Where @secret: references in service environments are read from
+	gg.SetSecretStore(secretStore())
+
+	// What templates in service environments and args can use
+	gg.SetTemplateValues(base, config.Ports)
+
+	registerServices(gg)
+	syncJobs(gg)
+	setRestartPolicies(gg)
+
+	// Services registered through the API and saved
+	servicesPath := viper.GetString("ServicesFile")
+	if servicesPath == "" {
+		servicesPath = filepath.Join(base, "gladius-guardian-services.json")
+	}
+	if err := gg.LoadPersistedServices(servicesPath); err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"path": servicesPath,
+		}).Warn("Couldn't load saved services")
+	}
+
+	// Only allow browser pages from trusted origins, this applies to the log
+	// WebSockets as well as the REST routes
+	originPolicy := guardian.NewOriginPolicy(viper.GetStringSlice("API.AllowedOrigins"))
+	gg.SetOriginPolicy(originPolicy)
+
+	// Every route requires a token unless auth is explicitly limited to
+	// localhost
+	auth, err := guardian.NewAuthenticator()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Couldn't setup API authentication")
+	}
+
+	// Record every control action, including denied ones
+	auditPath := viper.GetString("Audit.File")
+	if auditPath == "" {
+		auditPath = filepath.Join(base, "gladius-guardian-audit.log")
+	}
+	auditLog, err := guardian.NewAuditLog(auditPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"path": auditPath,
+		}).Fatal("Couldn't open audit log")
+	}
+	gg.SetAuditLog(auditLog) // Operations answered with 202 are recorded again when they end
+
+	limiter := guardian.NewRateLimiter(
+		viper.GetFloat64("RateLimit.RequestsPerSecond"),
+		viper.GetInt("RateLimit.Burst"),
+		viper.GetDuration("RateLimit.ServiceCooldown"),
 	)
 
-	// Handle the index
-	r.HandleFunc("/", guardian.IndexHandler)
+	// Settings that can change without a restart when the config is reloaded,
+	// anything else is reported as needing one
+	reloader := guardian.NewConfigReloader(gg, auditLog, config.Reload)
+	reloader.Live(nil, "LogLevel", "DefaultEnvironment", "Ports.EdgeD", "Ports.NetworkGateway", "StartTimeout", "StopTimeout", "Timeouts")
+	reloader.Live(func() error {
+		registerServices(gg)
+		return nil
+	}, "NetworkdExecutable", "ControldExecutable", "NetworkdInstances", "ControldInstances", "Services", "Hooks")
+	reloader.Live(func() error {
+		syncJobs(gg)
+		return nil
+	}, "Jobs")
+	reloader.Live(func() error {
+		setRestartPolicies(gg)
+		return nil
+	}, "Restarts")
+	reloader.Live(func() error {
+		gg.SetMaxLogLines(viper.GetInt("MaxLogLines"))
+		return nil
+	}, "MaxLogLines")
+	reloader.Live(func() error {
+		originPolicy.Update(viper.GetStringSlice("API.AllowedOrigins"))
+		return nil
+	}, "API.AllowedOrigins")
+	reloader.Live(func() error {
+		limiter.SetLimits(
+			viper.GetFloat64("RateLimit.RequestsPerSecond"),
+			viper.GetInt("RateLimit.Burst"),
+			viper.GetDuration("RateLimit.ServiceCooldown"),
+		)
+		return nil
+	}, "RateLimit")
+	reloader.Live(auth.Reload, "Auth.Tokens")
+
+	r.Use(guardian.APIMiddleware(viper.GetInt64("API.MaxBodyBytes"), limiter, auditLog, auth)...)
+
+	// The dashboard, and a pointer to the docs for API clients
+	r.HandleFunc("/", guardian.IndexHandler).Name("index")
+	r.HandleFunc("/dashboard/{asset}", guardian.DashboardAssetHandler).Methods("GET").Name("dashboard_asset")
 
-	// Guardian related endpoints
-	r.HandleFunc("/service/stats/{service_name}", guardian.GetServicesHandler(gg)).Methods("GET")
-	r.HandleFunc("/service/set_state/{service_name}", guardian.ServiceStateHandler(gg)).Methods("PUT")
-	r.HandleFunc("/service/set_timeout", guardian.SetStartTimeoutHandler(gg)).Methods("POST")
-	r.HandleFunc("/service/logs", guardian.GetOldLogsHandler(gg)).Methods("GET")
-	r.HandleFunc("/service/ws/logs/{service_name}", guardian.GetNewLogsWebSocketHandler(gg))
+	// Guardian related endpoints, the route names are what permissions are
+	// checked against
+	r.HandleFunc("/service/stats/{service_name}", guardian.GetServicesHandler(gg)).Methods("GET").Name("service_stats")
+	r.HandleFunc("/service/set_state/{service_name}", guardian.ServiceStateHandler(gg)).Methods("PUT").Name("set_state")
+	r.HandleFunc("/service/desired", guardian.DesiredStateHandler(gg, limiter)).Methods("PUT").Name("desired")
+	r.HandleFunc("/service/register", guardian.RegisterServiceHandler(gg)).Methods("POST").Name("register_service")
+	r.HandleFunc("/service/set_timeout", guardian.SetStartTimeoutHandler(gg)).Methods("POST").Name("set_timeout")
+	r.HandleFunc("/service/logs", guardian.GetOldLogsHandler(gg)).Methods("GET").Name("service_logs")
+	r.HandleFunc("/service/ws/logs/{service_name}", guardian.GetNewLogsWebSocketHandler(gg)).Name("service_ws_log")
+	r.HandleFunc("/service/audit", guardian.GetAuditLogHandler(auditLog)).Methods("GET").Name("audit")
+	r.HandleFunc("/service/operations", guardian.GetOperationsHandler(gg)).Methods("GET").Name("operations")
+	r.HandleFunc("/service/operations/{operation_id}", guardian.GetOperationHandler(gg)).Methods("GET").Name("operation")
+	r.HandleFunc("/service/events", guardian.GetEventsHandler(gg)).Methods("GET").Name("events")
+	r.HandleFunc("/service/ws/events", guardian.GetEventsWebSocketHandler(gg)).Name("events_ws")
+	r.HandleFunc("/service/{service_name}", guardian.UnregisterServiceHandler(gg)).Methods("DELETE").Name("unregister_service")
+	r.HandleFunc("/service/config", guardian.GetConfigHandler(effectiveConfig)).Methods("GET").Name("config")
+	r.HandleFunc("/service/config/reload", guardian.ReloadConfigHandler(reloader)).Methods("POST").Name("config_reload")
+
+	// The v2 API, the routes above are kept for the Gladius manager
+	v2 := r.PathPrefix("/v2").Subrouter()
+	v2.HandleFunc("/services", guardian.V2ListServicesHandler(gg)).Methods("GET").Name("v2_list_services")
+	v2.HandleFunc("/services/{service_name}", guardian.V2GetServiceHandler(gg)).Methods("GET").Name("v2_get_service")
+	v2.HandleFunc("/services/{service_name}/start", guardian.V2ServiceActionHandler(gg, "start")).Methods("POST").Name("v2_start_service")
+	v2.HandleFunc("/services/{service_name}/stop", guardian.V2ServiceActionHandler(gg, "stop")).Methods("POST").Name("v2_stop_service")
+	v2.HandleFunc("/services/{service_name}/restart", guardian.V2ServiceActionHandler(gg, "restart")).Methods("POST").Name("v2_restart")
+	v2.HandleFunc("/services/{service_name}/logs", guardian.V2ServiceLogsHandler(gg)).Methods("GET").Name("v2_service_logs")
+	v2.HandleFunc("/services/{service_name}/scale", guardian.V2ScaleServiceHandler(gg)).Methods("POST").Name("v2_scale_service")
+	v2.HandleFunc("/jobs", guardian.V2ListJobsHandler(gg)).Methods("GET").Name("v2_list_jobs")
+	v2.HandleFunc("/jobs/{job_name}", guardian.V2GetJobHandler(gg)).Methods("GET").Name("v2_get_job")
+	v2.HandleFunc("/jobs/{job_name}/run", guardian.V2RunJobHandler(gg)).Methods("POST").Name("v2_run_job")
+	v2.HandleFunc("/jobs/{job_name}/runs", guardian.V2JobRunsHandler(gg)).Methods("GET").Name("v2_job_runs")
+	v2.HandleFunc("/jobs/{job_name}/logs", guardian.V2JobLogsHandler(gg)).Methods("GET").Name("v2_job_logs")
+	v2.HandleFunc("/services/{service_name}/maintenance", guardian.V2SetMaintenanceHandler(gg)).Methods("PUT").Name("v2_set_service_maintenance")
+	v2.HandleFunc("/services/{service_name}/maintenance", guardian.V2ClearMaintenanceHandler(gg)).Methods("DELETE").Name("v2_clear_service_maintenance")
+	v2.HandleFunc("/maintenance", guardian.V2GetMaintenanceHandler(gg)).Methods("GET").Name("v2_maintenance")
+	v2.HandleFunc("/maintenance", guardian.V2SetMaintenanceHandler(gg)).Methods("PUT").Name("v2_set_maintenance")
+	v2.HandleFunc("/maintenance", guardian.V2ClearMaintenanceHandler(gg)).Methods("DELETE").Name("v2_clear_maintenance")
 
 	// Version
-	r.HandleFunc("/service/version/{service_name}", guardian.VersionHandler()).Methods("GET")
+	r.HandleFunc("/service/version/{service_name}", guardian.VersionHandler()).Methods("GET").Name("version")
 
 	// add the version endpoint from gladius-common
-	routing.AppendVersionEndpoints(r, "0.7.1")
+	routing.AppendVersionEndpoints(r, version)
+
+	// Generated from the routes above so it always matches them
+	r.HandleFunc("/openapi.json", guardian.OpenAPIHandler(r, version)).Methods("GET").Name("openapi")
+
+	// Setup the listeners before the server so config errors are fatal
+	listeners, tlsReloader, err := server.Listeners()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Couldn't setup API listeners")
+	}
 
 	// Setup a custom server so we can gracefully stop later
 	srv := &http.Server{
-		Addr:         "0.0.0.0:7791",
-		WriteTimeout: time.Second * 15,
+		WriteTimeout: guardian.APIWriteTimeout,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
-		Handler:      r,
+		Handler:      guardian.CORSHandler(originPolicy, r),
+	}
+
+	// Run our server on each listener in a goroutine so that it doesn't block.
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				log.Println(err)
+			}
+		}(l)
 	}
 
-	// Run our server in a goroutine so that it doesn't block.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+
+	// Reload the config and TLS certificates on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+		for range hup {
+			reloader.Reload(guardian.ReloadSignal)
+			if tlsReloader == nil {
+				continue
+			}
+			if err := tlsReloader.Reload(); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Warn("Couldn't reload TLS certificates, keeping the old ones")
+				continue
+			}
+			log.Info("Reloaded TLS certificates")
 		}
 	}()
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	// And when the config file changes
+	if viper.GetBool("WatchConfig") {
+		err := config.Watch(func() {
+			reloader.Reload(guardian.ReloadFile)
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't watch the config file, it will only be reloaded on SIGHUP")
+		}
+	}
 
 	<-c // Block until we receive our signal.
 
-	gg.StopService("all")
+	err = gg.StopService("all", 0)
+	shutdown := &guardian.AuditEntry{Identity: "guardian", Action: "shutdown", Service: "all", Success: err == nil}
+	if err != nil {
+		shutdown.Error = err.Error()
+	}
+	auditLog.Record(shutdown)
+	auditLog.Close()
+	if fwd != nil {
+		fwd.Close(5 * time.Second)
+	}
 	stopHTTPServer(srv)
 }
 
+// registerServices registers our two daemons and the services in the config,
+// again after a config reload to pick up changes
+func registerServices(gg *guardian.GladiusGuardian) {
+	gg.RegisterService("edged", viper.GetString("NetworkdExecutable"), nil, viper.GetInt("NetworkdInstances"))
+	gg.RegisterService("network-gateway", viper.GetString("ControldExecutable"), nil, viper.GetInt("ControldInstances"))
+	for _, name := range []string{"edged", "network-gateway"} {
+		hooks, err := hooksFrom(viper.GetViper(), name)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"service_name": name,
+				"err":          err,
+			}).Warn("Couldn't read the service's hooks in the config")
+		}
+		gg.SetServiceHooks(name, hooks)
+	}
+
+	defs, err := servicesFrom(viper.GetViper())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't read the services in the config")
+		return
+	}
+	gg.SyncConfigServices(defs)
+}
+
+// syncJobs schedules the jobs in the config, again after a config reload
+func syncJobs(gg *guardian.GladiusGuardian) {
+	defs, err := jobsFrom(viper.GetViper())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't read the jobs in the config")
+		return
+	}
+	gg.SyncJobs(defs)
+}
+
+// setRestartPolicies applies the restart policies in the config, again after
+// a config reload
+func setRestartPolicies(gg *guardian.GladiusGuardian) {
+	policies, err := restartPoliciesFrom(viper.GetViper())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't read the restart policies in the config")
+		return
+	}
+	gg.SetRestartPolicies(policies)
+}
+
 func stopHTTPServer(srv *http.Server) {
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
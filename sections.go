@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/gladiusio/gladius-guardian/config"
+	"github.com/gladiusio/gladius-guardian/guardian"
+	"github.com/spf13/viper"
+)
+
+// guardianSections reads and checks the parts of the config that are in the
+// guardian's types, see config.Sections
+type guardianSections struct{}
+
+func (guardianSections) Read(f func()) {
+	guardian.ReadConfig(f)
+}
+
+func (guardianSections) Replace(f func() error) error {
+	return guardian.ReplaceConfig(f)
+}
+
+// Validate checks the default environment, the instances of the built in
+// services, and the Services, Hooks, Restarts and Jobs sections
+func (guardianSections) Validate(v *viper.Viper) []*config.Problem {
+	var problems []*config.Problem
+	fail := func(key, format string, args ...interface{}) {
+		problems = append(problems, &config.Problem{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, fe := range guardian.ValidateEnv("DefaultEnvironment", v.GetStringSlice("DefaultEnvironment")) {
+		fail(fe.Field, "%s", fe.Message)
+	}
+	for _, key := range []string{"NetworkdInstances", "ControldInstances"} {
+		if n := v.GetInt(key); n < 1 || n > guardian.MaxInstances {
+			fail(key, "must be between 1 and %d", guardian.MaxInstances)
+		}
+	}
+
+	defs, err := servicesFrom(v)
+	if err != nil {
+		fail("Services", "%s", err)
+	}
+	for _, def := range defs {
+		if def.Name == "edged" || def.Name == "network-gateway" {
+			fail("Services."+def.Name, "is already a built in service")
+		}
+		for _, fe := range def.Validate() {
+			fail("Services."+def.Name+"."+fe.Field, "%s", fe.Message)
+		}
+	}
+
+	for name := range v.GetStringMap("Hooks") {
+		if name != "edged" && name != "network-gateway" {
+			fail("Hooks."+name, "is only for the built in services, put PreStart and PostStop in the service's own section")
+			continue
+		}
+		hooks, err := hooksFrom(v, name)
+		if err != nil {
+			fail("Hooks."+name, "%s", err)
+			continue
+		}
+		if hooks.PreStart != nil {
+			for _, fe := range hooks.PreStart.Validate("PreStart") {
+				fail("Hooks."+name+"."+fe.Field, "%s", fe.Message)
+			}
+		}
+		if hooks.PostStop != nil {
+			for _, fe := range hooks.PostStop.Validate("PostStop") {
+				fail("Hooks."+name+"."+fe.Field, "%s", fe.Message)
+			}
+		}
+	}
+
+	policies, err := restartPoliciesFrom(v)
+	if err != nil {
+		fail("Restarts", "%s", err)
+	}
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, fe := range policies[name].Validate() {
+			fail("Restarts."+name+"."+fe.Field, "%s", fe.Message)
+		}
+	}
+
+	jobs, err := jobsFrom(v)
+	if err != nil {
+		fail("Jobs", "%s", err)
+	}
+	for _, def := range jobs {
+		for _, fe := range def.Validate() {
+			fail("Jobs."+def.Name+"."+fe.Field, "%s", fe.Message)
+		}
+	}
+
+	return problems
+}
+
+// Check looks for the executables of services and jobs, and expands the
+// templates and secret references that are otherwise only used when a
+// service starts or a job runs
+func (guardianSections) Check(v *viper.Viper) []*config.Problem {
+	var problems []*config.Problem
+
+	executables := make(map[string]string)
+	envs := map[string][]string{"DefaultEnvironment": v.GetStringSlice("DefaultEnvironment")}
+	args := make(map[string][]string)
+	if defs, err := servicesFrom(v); err == nil {
+		for _, def := range defs {
+			executables["Services."+def.Name+".Executable"] = def.Executable
+			envs["Services."+def.Name+".EnvironmentVars"] = def.EnvironmentVars
+			args["Services."+def.Name+".Args"] = def.Args
+		}
+	}
+	if defs, err := jobsFrom(v); err == nil {
+		for _, def := range defs {
+			executables["Jobs."+def.Name+".Executable"] = def.Executable
+			envs["Jobs."+def.Name+".EnvironmentVars"] = def.EnvironmentVars
+			args["Jobs."+def.Name+".Args"] = def.Args
+		}
+	}
+
+	keys := make([]string, 0, len(executables))
+	for key := range executables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if exe := executables[key]; exe != "" {
+			if _, err := exec.LookPath(exe); err != nil {
+				problems = append(problems, &config.Problem{Key: key, Message: fmt.Sprintf("%q isn't an executable file or in PATH", exe)})
+			}
+		}
+	}
+
+	data := &guardian.TemplateData{Base: config.Dir(), Service: "service", Ports: config.PortsFrom(v)}
+	for _, values := range []map[string][]string{envs, args} {
+		for _, key := range sortedKeys(values) {
+			expanded, err := guardian.ExpandTemplates(values[key], data)
+			if err != nil {
+				problems = append(problems, &config.Problem{Key: key, Message: err.Error()})
+				delete(values, key)
+				continue
+			}
+			values[key] = expanded
+		}
+	}
+	names, _ := secretStore().Names()
+	for _, key := range sortedKeys(envs) {
+		for _, e := range envs[key] {
+			parts := strings.SplitN(e, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if strings.HasPrefix(parts[1], guardian.FileRefPrefix) {
+				if _, err := os.Stat(strings.TrimPrefix(parts[1], guardian.FileRefPrefix)); err != nil {
+					problems = append(problems, &config.Problem{Key: key, Message: parts[0] + ": " + err.Error()})
+				}
+			}
+			if name := strings.TrimPrefix(parts[1], guardian.SecretRefPrefix); name != parts[1] && !contains(names, name) {
+				problems = append(problems, &config.Problem{Key: key, Message: fmt.Sprintf("%s: secret %q isn't in the secret store", parts[0], name)})
+			}
+		}
+	}
+
+	return problems
+}
+
+// Redact hides secret looking settings, the secret variables of environment
+// lists and passwords in URLs
+func (guardianSections) Redact(key string, value interface{}) interface{} {
+	name := key[strings.LastIndex(key, ".")+1:]
+	if key == "auth.tokens" || (guardian.IsSecretKey(name) && !strings.HasSuffix(name, "file")) {
+		if value == nil || value == "" {
+			return value
+		}
+		return guardian.Redacted
+	}
+
+	switch v := value.(type) {
+	case []string:
+		return guardian.RedactEnv(v)
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, e := range v {
+			if s, ok := e.(string); ok {
+				redacted[i] = guardian.RedactEnv([]string{s})[0]
+			} else {
+				redacted[i] = e
+			}
+		}
+		return redacted
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "REDACTED") // Brackets would be escaped
+				return u.String()
+			}
+		}
+	}
+	return value
+}
+
+// effectiveConfig is the running config for the config route
+func effectiveConfig() *guardian.EffectiveConfig {
+	ec := config.Effective()
+	settings := make([]*guardian.ConfigSetting, len(ec.Settings))
+	for i, s := range ec.Settings {
+		settings[i] = &guardian.ConfigSetting{Key: s.Key, Value: s.Value, Source: s.Source}
+	}
+	return &guardian.EffectiveConfig{File: ec.File, Settings: settings}
+}
+
+// secretStore is where @secret: environment references are read from
+func secretStore() *guardian.SecretStore {
+	return guardian.NewSecretStore(config.SecretPaths())
+}
+
+// servicesFrom reads the Services section, each service is a table named
+// after it with the fields of guardian.ServiceDefinition, sorted by name
+func servicesFrom(v *viper.Viper) ([]*guardian.ServiceDefinition, error) {
+	names := make([]string, 0)
+	for name := range v.GetStringMap("Services") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]*guardian.ServiceDefinition, 0, len(names))
+	for _, name := range names {
+		def := &guardian.ServiceDefinition{}
+		if err := v.UnmarshalKey("Services."+name, def); err != nil {
+			return nil, fmt.Errorf("couldn't parse Services.%s: %s", name, err)
+		}
+		def.Name = name
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
+
+// hooksFrom reads the hooks of a built in service from its section in Hooks,
+// other services have theirs in their own section
+func hooksFrom(v *viper.Viper, name string) (*guardian.ServiceHooks, error) {
+	hooks := &guardian.ServiceHooks{}
+	if err := v.UnmarshalKey("Hooks."+name, hooks); err != nil {
+		return nil, fmt.Errorf("couldn't parse Hooks.%s: %s", name, err)
+	}
+	return hooks, nil
+}
+
+// restartPoliciesFrom reads the Restarts section by service name
+func restartPoliciesFrom(v *viper.Viper) (map[string]*guardian.RestartPolicy, error) {
+	policies := make(map[string]*guardian.RestartPolicy)
+	for name := range v.GetStringMap("Restarts") {
+		p := &guardian.RestartPolicy{}
+		if err := v.UnmarshalKey("Restarts."+name, p); err != nil {
+			return nil, fmt.Errorf("couldn't parse Restarts.%s: %s", name, err)
+		}
+		policies[name] = p
+	}
+	return policies, nil
+}
+
+// jobsFrom reads the Jobs section, each job is a table named after it with
+// the fields of guardian.JobDefinition, sorted by name
+func jobsFrom(v *viper.Viper) ([]*guardian.JobDefinition, error) {
+	names := make([]string, 0)
+	for name := range v.GetStringMap("Jobs") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]*guardian.JobDefinition, 0, len(names))
+	for _, name := range names {
+		def := &guardian.JobDefinition{}
+		if err := v.UnmarshalKey("Jobs."+name, def); err != nil {
+			return nil, fmt.Errorf("couldn't parse Jobs.%s: %s", name, err)
+		}
+		def.Name = name
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// TLSReloader keeps the certificate, key and client CAs loaded from disk so
+// they can be swapped without closing the listeners
+type TLSReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	cert         *tls.Certificate
+	clientCAs    *x509.CertPool
+	mux          sync.RWMutex
+}
+
+// NewTLSReloader loads the certificate and key, and the client CA bundle if
+// clientCAFile isn't empty in which case clients must present a certificate
+// signed by one of them
+func NewTLSReloader(certFile, keyFile, clientCAFile string) (*TLSReloader, error) {
+	t := &TLSReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload reads the files again, the old ones are kept if there is an error
+func (t *TLSReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load TLS certificate: %s", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if t.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read client CA file: %s", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", t.clientCAFile)
+		}
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.cert = &cert
+	t.clientCAs = clientCAs
+
+	return nil
+}
+
+// Config returns a TLS config that always uses the latest loaded files
+func (t *TLSReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mux.RLock()
+			defer t.mux.RUnlock()
+
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*t.cert},
+			}
+			if t.clientCAs != nil {
+				c.ClientCAs = t.clientCAs
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}
+}
+
+// Listeners creates every listener from the API section of the config, the
+// returned reloader is nil if TLS isn't enabled
+func Listeners() ([]net.Listener, *TLSReloader, error) {
+	var reloader *TLSReloader
+	certFile, keyFile := viper.GetString("API.TLS.CertFile"), viper.GetString("API.TLS.KeyFile")
+	clientCAFile := viper.GetString("API.TLS.ClientCAFile")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, nil, errors.New("both API.TLS.CertFile and API.TLS.KeyFile are needed for TLS")
+		}
+		var err error
+		reloader, err = NewTLSReloader(certFile, keyFile, clientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if clientCAFile != "" {
+		return nil, nil, errors.New("API.TLS.ClientCAFile needs a certificate and key to be set")
+	}
+
+	addresses := viper.GetStringSlice("API.Listen")
+	if len(addresses) == 0 && viper.GetString("API.UnixSocket") == "" {
+		addresses = []string{fmt.Sprintf("0.0.0.0:%d", viper.GetInt("Ports.Guardian"))}
+	}
+
+	listeners := make([]net.Listener, 0, len(addresses)+1)
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for _, address := range addresses {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("couldn't listen on %s: %s", address, err)
+		}
+		if reloader != nil {
+			l = tls.NewListener(l, reloader.Config())
+		}
+		log.WithFields(log.Fields{
+			"address": address,
+			"tls":     reloader != nil,
+		}).Info("API listening")
+		listeners = append(listeners, l)
+	}
+
+	if path := viper.GetString("API.UnixSocket"); path != "" {
+		mode, err := strconv.ParseUint(viper.GetString("API.UnixSocketMode"), 8, 32)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("invalid API.UnixSocketMode: %s", err)
+		}
+		l, err := ListenUnix(path, os.FileMode(mode))
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		log.WithFields(log.Fields{
+			"path": path,
+			"mode": fmt.Sprintf("%04o", mode),
+		}).Info("API listening on unix socket")
+		listeners = append(listeners, l)
+	}
+
+	return listeners, reloader, nil
+}
+
+// ListenUnix listens on a unix socket at path with the given permissions,
+// replacing a stale socket left behind by a previous run
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// Only remove it if nothing is listening on it anymore
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	// The socket is created owner only so nobody else can connect before
+	// it's given its mode
+	var l net.Listener
+	err := withUmask(0177, func() (err error) {
+		l, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("couldn't set permissions on %s: %s", path, err)
+	}
+	return l, nil
+}
@@ -0,0 +1,279 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/server"
+	"github.com/spf13/viper"
+)
+
+// writeCert writes a self signed certificate for 127.0.0.1 and its key to
+// dir, the serial tells reloaded certificates apart
+func writeCert(t *testing.T, dir string, serial int64) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "guardian"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func setListenConfig(listen []string, certFile, keyFile, clientCAFile, unixSocket string) {
+	viper.Set("API.Listen", listen)
+	viper.Set("API.TLS.CertFile", certFile)
+	viper.Set("API.TLS.KeyFile", keyFile)
+	viper.Set("API.TLS.ClientCAFile", clientCAFile)
+	viper.Set("API.UnixSocket", unixSocket)
+	viper.Set("API.UnixSocketMode", "0660")
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeCert(t, dir, 1)
+	setListenConfig([]string{"127.0.0.1:0"}, certFile, keyFile, "", "")
+
+	listeners, reloader, err := server.Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || reloader == nil {
+		t.Fatalf("got %d listeners and reloader %v, want one TLS listener", len(listeners), reloader)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go srv.Serve(listeners[0])
+	defer srv.Close()
+	addr := listeners[0].Addr().String()
+
+	serial := func() int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// Plain HTTP only gets told to use HTTPS
+	if resp, err := http.Get("http://" + addr + "/"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("plain HTTP on the TLS listener: got %d", resp.StatusCode)
+		}
+	}
+
+	// New connections get the new certificate after a reload
+	writeCert(t, dir, 2)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("got certificate %d after reloading, want 2", got)
+	}
+	// A broken file keeps the last good one
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0600)
+	if err := reloader.Reload(); err == nil {
+		t.Error("reloading a broken certificate didn't fail")
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("got certificate %d after a failed reload, want 2", got)
+	}
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	certFile, keyFile, cert := writeCert(t, t.TempDir(), 1)
+	setListenConfig([]string{"127.0.0.1:0"}, certFile, keyFile, certFile, "")
+
+	listeners, _, err := server.Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go srv.Serve(listeners[0])
+	defer srv.Close()
+	addr := listeners[0].Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		certs   []tls.Certificate
+		wantErr bool
+	}{
+		{"without a client certificate", nil, true},
+		{"with a client certificate", []tls.Certificate{clientCert}, false},
+	}
+	for _, test := range tests {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: test.certs}}}
+		resp, err := client.Get("https://" + addr + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestListenerConfigErrors(t *testing.T) {
+	certFile, keyFile, _ := writeCert(t, t.TempDir(), 1)
+	tests := []struct {
+		name                            string
+		certFile, keyFile, clientCAFile string
+		want                            string
+	}{
+		{"cert without key", certFile, "", "", "both API.TLS.CertFile and API.TLS.KeyFile"},
+		{"key without cert", "", keyFile, "", "both API.TLS.CertFile and API.TLS.KeyFile"},
+		{"client CAs without TLS", "", "", certFile, "needs a certificate and key"},
+		{"missing cert", certFile + ".missing", keyFile, "", "couldn't load TLS certificate"},
+	}
+	for _, test := range tests {
+		setListenConfig([]string{"127.0.0.1:0"}, test.certFile, test.keyFile, test.clientCAFile, "")
+		listeners, _, err := server.Listeners()
+		for _, l := range listeners {
+			l.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error with %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket permissions are unix only")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "guardian.sock")
+
+	for _, mode := range []os.FileMode{0600, 0660} {
+		l, err := server.ListenUnix(path, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != mode {
+			t.Errorf("got %s, want a socket with mode %s", info.Mode(), mode)
+		}
+		if _, err := server.ListenUnix(path, mode); err == nil || !strings.Contains(err.Error(), "already in use") {
+			t.Errorf("listening on a socket in use: got %v", err)
+		}
+		l.Close()
+	}
+
+	// A socket left behind by a process that's gone is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := server.ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("replacing a stale socket: %s", err)
+	}
+	l.Close()
+
+	// Anything else is left alone
+	file := filepath.Join(dir, "not-a-socket")
+	ioutil.WriteFile(file, nil, 0600)
+	if _, err := server.ListenUnix(file, 0600); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("listening on a regular file: got %v", err)
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket permissions are unix only")
+	}
+	path := filepath.Join(t.TempDir(), "guardian.sock")
+	setListenConfig(nil, "", "", "", path)
+
+	// Only the socket, TCP isn't opened when there's a socket and no addresses
+	listeners, reloader, err := server.Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].Close()
+	if len(listeners) != 1 || reloader != nil || listeners[0].Addr().Network() != "unix" {
+		t.Fatalf("got %d listeners and reloader %v, want just the unix socket", len(listeners), reloader)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })}
+	go srv.Serve(listeners[0])
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) { return net.Dial("unix", path) },
+	}}
+	resp, err := client.Get("http://guardian/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("got %q over the socket", body)
+	}
+}
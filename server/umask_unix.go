@@ -0,0 +1,14 @@
+// +build linux darwin
+
+package server
+
+import "syscall"
+
+// withUmask runs f with the process umask set to mask, so files it creates
+// never have more permissions than that allows. The umask is for the whole
+// process, only use it around quick calls at startup
+func withUmask(mask int, f func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return f()
+}
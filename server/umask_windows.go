@@ -0,0 +1,7 @@
+package server
+
+// withUmask runs f, windows has no umask and unix sockets get their
+// permissions from the directory they're in
+func withUmask(mask int, f func() error) error {
+	return f()
+}
@@ -91,3 +91,40 @@ func GetProcessWindows(name string) (int, error) {
 
 	return 0, fmt.Errorf("No process called: %s", name)
 }
+
+// Descendants returns the IDs of every process started by pid, directly or
+// not, the deepest ones first so they can be killed in order
+func Descendants(pid int) ([]int, error) {
+	procs, err := Processes()
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]int)
+	for _, p := range procs {
+		if p.ProcessID != p.ParentProcessID {
+			children[p.ParentProcessID] = append(children[p.ParentProcessID], p.ProcessID)
+		}
+	}
+
+	var found []int
+	seen := map[int]bool{pid: true}
+	queue := []int{pid}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, child := range children[parent] {
+			if seen[child] {
+				continue // IDs are reused, don't loop on a stale parent
+			}
+			seen[child] = true
+			found = append(found, child)
+			queue = append(queue, child)
+		}
+	}
+
+	// Breadth first finds parents before children, reverse it
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found, nil
+}